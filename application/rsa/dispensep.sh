@@ -0,0 +1,5 @@
+if [ $# -eq 0 ]; then
+    echo "Please enter pid"
+else
+./rsa -user=user0003 -org=org2 -port=localhost:9051 dispensep $1 7
+fi
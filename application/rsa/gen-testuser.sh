@@ -38,6 +38,7 @@ printHelp () {
     echo
     echo "For both modes: In addition to the Fabric CA signatures found in test-network, RSA keys are"
     echo "also generated in keys/user_000x."
+    echo "RSA private keys are encrypted with the passphrase in RSA_KEY_PASSPHRASE, if it is set."
     echo
     echo "Other Modes"
     echo
@@ -82,7 +83,7 @@ storePublicKey () {
         PORT=$ORG2PORT_PEER
     fi
     echo "./rsa -user=user${USER_NUM} -org=org${ORG_NUM} -port=${PORT} storekey user${USER_NUM}"
-    ./rsa -user=Admin -org=org${ORG_NUM} -port=${PORT} storekey user${USER_NUM}
+    ./rsa -user=user${USER_NUM} -org=org${ORG_NUM} -port=${PORT} storekey user${USER_NUM}
 }
 
 createUser () {
@@ -94,7 +95,7 @@ createUser () {
     createUserFabric $USER_NUM $ORG_NUM $ROLE
     cd ${APP_RSA_PATH}
     [ ! -d rsakeys ] && mkdir rsakeys
-    ./rsa genkey user${USER_NUM}
+    ./rsa -org=org${ORG_NUM} genkey user${USER_NUM}
     storePublicKey $USER_NUM $ORG_NUM
 }
 
@@ -1,19 +1,21 @@
 module github.com/clayaedinh/thesis/application/rsa
 
-go 1.19
+go 1.24
 
 require (
 	github.com/hyperledger/fabric-gateway v1.2.0
-	golang.org/x/text v0.6.0
+	github.com/hyperledger/fabric-protos-go-apiv2 v0.2.0
+	github.com/miekg/pkcs11 v1.1.1
+	golang.org/x/crypto v0.17.0
+	golang.org/x/term v0.15.0
+	golang.org/x/text v0.14.0
 	google.golang.org/grpc v1.52.3
 )
 
 require (
 	github.com/golang/protobuf v1.5.2 // indirect
-	github.com/hyperledger/fabric-protos-go-apiv2 v0.2.0 // indirect
-	github.com/miekg/pkcs11 v1.1.1 // indirect
-	golang.org/x/net v0.5.0 // indirect
-	golang.org/x/sys v0.4.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
 	google.golang.org/genproto v0.0.0-20230131230820-1c016267d619 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 )
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/clayaedinh/thesis/application/rsa/src"
-	"github.com/hyperledger/fabric-gateway/pkg/client"
 )
 
 const (
@@ -26,8 +30,52 @@ const (
 	FLAG_H_ORG  = "Specifies the org that the current user belongs to."
 	FLAG_H_USER = "Specifies the user that connects to the network."
 	FLAG_H_PORT = "Specifies the port which the organization peer belongs to."
+	FLAG_H_KEYS = "Specifies where private keys are kept: file, encrypted, or pkcs11. PKCS#11 tokens are set with PKCS11_LIB, PKCS11_TOKEN and PKCS11_PIN."
 )
 
+// Exit codes, so that scripts can tell failures apart
+const (
+	EXIT_OK        = 0
+	EXIT_ERROR     = 1 // any other failure
+	EXIT_USAGE     = 2 // invalid method or arguments
+	EXIT_KEY       = 3 // a key is missing from the local keystore
+	EXIT_CHAINCODE = 4 // the network or chaincode rejected the transaction
+	EXIT_SIGNATURE = 5 // the prescription has no valid prescriber signature
+	EXIT_CANCELLED = 6 // interrupted, or timed out
+)
+
+// Number of arguments each method expects, including the method itself
+var methodArgs = map[string]int{
+	"genkey":       2,
+	"exportkey":    3,
+	"importkey":    3,
+	"storekey":     2,
+	"getkey":       2,
+	"rotatekey":    1,
+	"rotatefinish": 1,
+	"issuep":       9,
+	"createp":      1,
+	"sharep":       3,
+	"unsharep":     3,
+	"sharedto":     2,
+	"readp":        2,
+	"updatep":      9,
+	"dispensep":    3,
+	"fillsp":       2,
+	"statusp":      2,
+	"cancelp":      2,
+	"expirep":      2,
+	"deletep":      2,
+	"migratep":     2,
+	"migrateid":    2,
+	"pseudokey":    1,
+	"rekey":        2,
+	"readeradd":    1,
+	"readerall":    1,
+	"reportgen":    2,
+	"reportread":   1,
+}
+
 func printHelp() {
 	fmt.Println("")
 	fmt.Printf("%vPrescription Blockchain Thesis Application, RSA version%v\n", YELLOW, NC)
@@ -46,189 +94,564 @@ func printHelp() {
 	fmt.Printf("./rsa %v-port=%vlocalhost:port\n", PURPLE, NC)
 	fmt.Println(FLAG_H_PORT)
 	fmt.Println("")
+	fmt.Printf("./rsa %v-keystore=%vstring\n", PURPLE, NC)
+	fmt.Println(FLAG_H_KEYS)
+	fmt.Println("")
 	fmt.Printf("%vAvailable Methods (must be AFTER options)%v:\n", GREEN, NC)
+	fmt.Println("Usernames may be given as <org>/<username>. Without an org, the current user's org is used.")
 	fmt.Printf("./rsa %vstorekey%v <username>\n", CYAN, NC)
 	fmt.Printf("./rsa %vgetkey%v <username>\n", CYAN, NC)
-	fmt.Printf("./rsa %vcreatep%v\n", CYAN, NC)
+	fmt.Printf("./rsa %vrotatekey%v [rsa|x25519|x25519-mlkem768]\n", CYAN, NC)
+	fmt.Printf("./rsa %vrotatefinish%v\n", CYAN, NC)
+	fmt.Printf("./rsa %vexportkey%v <username> <file>\n", CYAN, NC)
+	fmt.Printf("./rsa %vimportkey%v <username> <file>\n", CYAN, NC)
+	fmt.Printf("./rsa %vissuep%v <patient_username> <brand> <dosage> <patient_name> <patient_address> <doctor_name> <doctor_prc> <pieces_total> [valid_days]\n", CYAN, NC)
+	fmt.Printf("./rsa %vcreatep%v [nonce]\n", CYAN, NC)
 	fmt.Printf("./rsa %vsharep%v <pid> <username>\n", CYAN, NC)
+	fmt.Printf("./rsa %vunsharep%v <pid> <username>\n", CYAN, NC)
 	fmt.Printf("./rsa %vreadp%v <id>\n", CYAN, NC)
-	fmt.Printf("./rsa %vupdatep%v <brand> <dosage> <patient_name> <patient_address> <doctor_name> <doctor_prc> <pieces_total>\n", CYAN, NC)
-	fmt.Printf("./rsa %vsetfillp%v <pid> <newfill>\n", CYAN, NC)
+	fmt.Printf("./rsa %vupdatep%v <pid> <brand> <dosage> <patient_name> <patient_address> <doctor_name> <doctor_prc> <pieces_total> [valid_days]\n", CYAN, NC)
+	fmt.Printf("./rsa %vdispensep%v <pid> <quantity>\n", CYAN, NC)
+	fmt.Printf("./rsa %vfillsp%v <pid>\n", CYAN, NC)
+	fmt.Printf("./rsa %vstatusp%v <pid>\n", CYAN, NC)
+	fmt.Printf("./rsa %vcancelp%v <pid>\n", CYAN, NC)
+	fmt.Printf("./rsa %vexpirep%v <pid>\n", CYAN, NC)
 	fmt.Printf("./rsa %vdeletep%v <pid>\n", CYAN, NC)
+	fmt.Printf("./rsa %vmigratep%v <pid>\n", CYAN, NC)
+	fmt.Printf("./rsa %vmigrateid%v <username>...\n", CYAN, NC)
+	fmt.Printf("./rsa %vpseudokey%v\n", CYAN, NC)
+	fmt.Printf("./rsa %vrekey%v <username>...\n", CYAN, NC)
 	fmt.Printf("./rsa %vreaderadd%v <username>\n", CYAN, NC)
 	fmt.Printf("./rsa %vreaderall%v\n", CYAN, NC)
 	fmt.Printf("./rsa %vreportgen%v <pid>\n", CYAN, NC)
 	fmt.Printf("./rsa %vreportread%v <username>\n", CYAN, NC)
 	fmt.Println("")
+	fmt.Printf("%vExit Codes%v:\n", GREEN, NC)
+	fmt.Printf("%v success, %v error, %v invalid method or arguments, %v key missing from the keystore,\n", EXIT_OK, EXIT_ERROR, EXIT_USAGE, EXIT_KEY)
+	fmt.Printf("%v rejected by the chaincode, %v invalid prescriber signature, %v interrupted or timed out\n", EXIT_CHAINCODE, EXIT_SIGNATURE, EXIT_CANCELLED)
+	fmt.Println("")
 
 }
 func main() {
 	//Help Menu
 	if len(os.Args) == 1 || strings.ToLower(os.Args[1]) == "help" {
 		printHelp()
-		os.Exit(0)
+		os.Exit(EXIT_OK)
+	}
+	err := run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v%v%v\n", RED, err, NC)
+	}
+	os.Exit(exitCode(err))
+}
+
+// maps the typed errors of the client to exit codes
+func exitCode(err error) int {
+	var chaincodeErr *src.ChaincodeError
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return EXIT_CANCELLED
+	case errors.Is(err, src.ErrInvalidArgument):
+		return EXIT_USAGE
+	case errors.Is(err, src.ErrKeyNotFound):
+		return EXIT_KEY
+	case errors.Is(err, src.ErrInvalidSignature):
+		return EXIT_SIGNATURE
+	case errors.As(err, &chaincodeErr):
+		return EXIT_CHAINCODE
 	}
+	return EXIT_ERROR
+}
 
+func run() error {
 	//Flags
 	flagOrg := flag.String("org", "org1", FLAG_H_ORG)
 	flagUser := flag.String("user", "Admin", FLAG_H_USER)
 	flagPort := flag.String("port", "localhost:7051", FLAG_H_PORT)
+	flagKeystore := flag.String("keystore", src.KEYSTORE_ENCRYPTED, FLAG_H_KEYS)
 
 	flag.Parse()
 
-	// Methods which do not require a connection to the chaincode
-
-	if flag.Arg(0) == "genkey" {
-		checkEnoughArgs(2)
-		genkey(flag.Arg(1))
-		os.Exit(0)
+	method := flag.Arg(0)
+	expected, ok := methodArgs[method]
+	if !ok {
+		return fmt.Errorf("%w: method '%v'. Do './rsa help' for method options", src.ErrInvalidArgument, method)
+	}
+	if len(flag.Args()) < expected {
+		return fmt.Errorf("%w: method '%v' expected %v arguments, but was only given %v. Do './rsa help' for method options",
+			src.ErrInvalidArgument, method, expected-1, len(flag.Args())-1)
 	}
 
-	//If application is not printing help, it will be interacting with chaincode
-	//So start connection
-	src.SetConnectionVariables(*flagOrg, *flagUser, *flagPort)
-	//src.PrintConnectionVariables()
-	clientConnection, err := src.NewGrpcConnection()
+	// Cancels the running operation on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	keystore, err := src.OpenKeystore(*flagKeystore)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer clientConnection.Close()
+	if closer, ok := keystore.(io.Closer); ok {
+		defer closer.Close()
+	}
+	// The identity also decides the org of usernames
+	user := src.NewClient(src.NewIdentity(*flagOrg, *flagUser, *flagPort), keystore)
 
-	gw, err := src.DefaultGateway(clientConnection)
+	// Methods which do not require a connection to the chaincode
+	switch method {
+	case "genkey":
+		return genkey(user, flag.Arg(1), flag.Arg(2))
+	case "exportkey":
+		return exportkey(user, flag.Arg(1), flag.Arg(2))
+	case "importkey":
+		return importkey(user, flag.Arg(1), flag.Arg(2))
+	}
+
+	//If application is not printing help, it will be interacting with chaincode
+	//So start connection
+	//user.Identity().Print()
+	err = user.Connect()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer gw.Close()
-	contract := src.SmartContract(gw)
+	defer user.Close()
 
 	//We now check which chaincode function is being called
-	if flag.Arg(0) == "storekey" {
-		checkEnoughArgs(2)
-		storekey(contract, flag.Arg(1))
-	} else if flag.Arg(0) == "getkey" {
-		checkEnoughArgs(2)
-		getkey(contract, flag.Arg(1))
-	} else if flag.Arg(0) == "createp" {
-		createp(contract)
-	} else if flag.Arg(0) == "updatep" {
-		checkEnoughArgs(9)
-		updatep(contract, flag.Args())
-	} else if flag.Arg(0) == "setfillp" {
-		checkEnoughArgs(3)
-		setfillp(contract, flag.Arg(1), flag.Arg(2))
-	} else if flag.Arg(0) == "readp" {
-		checkEnoughArgs(2)
-		readp(contract, flag.Arg(1))
-	} else if flag.Arg(0) == "sharep" {
-		checkEnoughArgs(3)
-		sharep(contract, flag.Arg(1), flag.Arg(2))
-	} else if flag.Arg(0) == "sharedto" {
-		checkEnoughArgs(2)
-		sharedto(contract, flag.Arg(1))
-	} else if flag.Arg(0) == "deletep" {
-		checkEnoughArgs(2)
-		deletep(contract, flag.Arg(1))
-	} else if flag.Arg(0) == "readeradd" {
-		readeradd(contract)
-	} else if flag.Arg(0) == "readerall" {
-		checkEnoughArgs(1)
-		readerall(contract)
-	} else if flag.Arg(0) == "reportgen" {
-		checkEnoughArgs(2)
-		reportgen(contract, flag.Arg(1))
-	} else if flag.Arg(0) == "reportread" {
-		reportread(contract)
-	} else {
-		fmt.Printf("%vInvalid method '%v'. Do './rsa help' for method options.\n", RED, flag.Arg(0))
+	switch method {
+	case "storekey":
+		return storekey(ctx, user, flag.Arg(1))
+	case "getkey":
+		return getkey(ctx, user, flag.Arg(1))
+	case "issuep":
+		return issuep(ctx, user, flag.Args())
+	case "rotatekey":
+		return rotatekey(ctx, user, flag.Arg(1))
+	case "rotatefinish":
+		return rotatefinish(ctx, user)
+	case "createp":
+		return createp(ctx, user, flag.Arg(1))
+	case "updatep":
+		return updatep(ctx, user, flag.Args())
+	case "dispensep":
+		return dispensep(ctx, user, flag.Arg(1), flag.Arg(2))
+	case "fillsp":
+		return fillsp(ctx, user, flag.Arg(1))
+	case "readp":
+		return readp(ctx, user, flag.Arg(1))
+	case "sharep":
+		return sharep(ctx, user, flag.Arg(1), flag.Arg(2))
+	case "unsharep":
+		return unsharep(ctx, user, flag.Arg(1), flag.Arg(2))
+	case "sharedto":
+		return sharedto(ctx, user, flag.Arg(1))
+	case "statusp":
+		return statusp(ctx, user, flag.Arg(1))
+	case "cancelp":
+		return cancelp(ctx, user, flag.Arg(1))
+	case "expirep":
+		return expirep(ctx, user, flag.Arg(1))
+	case "deletep":
+		return deletep(ctx, user, flag.Arg(1))
+	case "migratep":
+		return migratep(ctx, user, flag.Arg(1))
+	case "migrateid":
+		return migrateid(ctx, user, flag.Args()[1:])
+	case "pseudokey":
+		return pseudokey(ctx, user)
+	case "rekey":
+		return rekey(ctx, user, flag.Args()[1:])
+	case "readeradd":
+		return readeradd(ctx, user)
+	case "readerall":
+		return readerall(ctx, user)
+	case "reportgen":
+		return reportgen(ctx, user, flag.Arg(1))
+	case "reportread":
+		return reportread(ctx, user)
 	}
+	return nil
 }
 
-func storekey(contract *client.Contract, username string) {
-	src.SendPubkey(contract, username)
+func storekey(ctx context.Context, user *src.Client, username string) error {
+	err := user.SendPubkey(ctx, username)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("%vKey stored successfully for user %v%v\n", GREEN, username, NC)
+	return nil
 }
 
-func getkey(contract *client.Contract, username string) {
-	obscureName := src.ObscureName(username)
-	out := src.GetPubkey(contract, obscureName)
+func getkey(ctx context.Context, user *src.Client, username string) error {
+	obscureName, err := user.ObscureName(username)
+	if err != nil {
+		return err
+	}
+	out, err := user.GetPubkey(ctx, obscureName)
+	if err != nil {
+		return err
+	}
 	fmt.Print(out)
 	fmt.Printf("\n%vKey retrieved successfully for user %v%v\n", GREEN, username, NC)
+	return nil
 }
 
-func genkey(username string) {
-	src.GenerateUserKeyFiles(username)
+// the algorithm is optional, and defaults to that of the current key
+func rotatekey(ctx context.Context, user *src.Client, algorithm string) error {
+	err := user.RotateKey(ctx, algorithm)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vKey rotated successfully for user %v%v\n", GREEN, user.Identity().UserId, NC)
+	return nil
+}
+
+func rotatefinish(ctx context.Context, user *src.Client) error {
+	committed, err := user.FinishKeyRotation(ctx)
+	if err != nil {
+		return err
+	}
+	if committed {
+		fmt.Printf("%vKey rotated successfully for user %v%v\n", GREEN, user.Identity().UserId, NC)
+	} else {
+		fmt.Printf("%vKey rotation did not commit, current key of user %v kept%v\n", YELLOW, user.Identity().UserId, NC)
+	}
+	return nil
+}
+
+// the algorithm is optional, and defaults to RSA
+func genkey(user *src.Client, username string, algorithm string) error {
+	if algorithm == "" {
+		algorithm = src.ALGORITHM_RSA
+	}
+	err := user.GenerateUserKeyFiles(username, algorithm)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("%vKey generated successfully for user %v%v\n", GREEN, username, NC)
+	return nil
+}
+
+func exportkey(user *src.Client, username string, filename string) error {
+	err := user.ExportKey(username, filename)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vKey exported successfully for user %v%v\n", GREEN, username, NC)
+	return nil
+}
+
+func importkey(user *src.Client, username string, filename string) error {
+	err := user.ImportKey(username, filename)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vKey imported successfully for user %v%v\n", GREEN, username, NC)
+	return nil
+}
+
+func issuep(ctx context.Context, user *src.Client, args []string) error {
+	cmdInput, err := prescriptionFromArgs(args)
+	if err != nil {
+		return err
+	}
+	pid, err := user.IssuePrescription(ctx, args[1], cmdInput)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vIssue Prescription Successful. PID: %v%v\n", GREEN, pid, NC)
+	return nil
 }
 
-func createp(contract *client.Contract) {
-	pid := src.CreatePrescription(contract)
+func createp(ctx context.Context, user *src.Client, nonce string) error {
+	b64encrypted, err := user.PrepareCreatePrescription(ctx)
+	if err != nil {
+		return err
+	}
+	pid, err := user.SubmitCreatePrescription(ctx, b64encrypted, nonce)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("%vCreate Prescription Successful. PID: %v%v\n", GREEN, pid, NC)
+	return nil
 }
 
-func readp(contract *client.Contract, pid string) {
-	prescription := src.ReadPrescription(contract, pid)
+func readp(ctx context.Context, user *src.Client, pid string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	prescription, err := user.ReadPrescription(ctx, pid)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Prescription: %v\n", prescription)
+	signer := prescription.Signer
+	if signer == nil {
+		fmt.Printf("%vPrescription is not signed%v\n", YELLOW, NC)
+		return nil
+	}
+	fmt.Printf("Signed by: %v (%v)\n", signer.Name, signer.MSPID)
+	fmt.Printf("PRC number: %v\n", signer.PrescriberNo)
+	fmt.Printf("Certificate valid: %v to %v\n", signer.NotBefore.Format(time.RFC3339), signer.NotAfter.Format(time.RFC3339))
+	if signer.Valid {
+		fmt.Printf("%vSignature is valid%v\n", GREEN, NC)
+	} else {
+		fmt.Printf("%vSignature is NOT valid: %v%v\n", RED, signer.Problem, NC)
+	}
+	return nil
 }
 
-func sharep(contract *client.Contract, pid string, username string) {
-	src.SharePrescription(contract, pid, username)
+func sharep(ctx context.Context, user *src.Client, pid string, username string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	err = user.SharePrescription(ctx, pid, username)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("%vShare Prescription Successful%v\n", GREEN, NC)
+	return nil
+}
+
+func unsharep(ctx context.Context, user *src.Client, pid string, username string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	err = user.UnsharePrescription(ctx, pid, username)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vUnshare Prescription Successful%v\n", GREEN, NC)
+	return nil
 }
 
-func sharedto(contract *client.Contract, pid string) {
-	list := src.SharedToList(contract, pid)
+func sharedto(ctx context.Context, user *src.Client, pid string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	list, err := user.SharedToList(ctx, pid)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("list: %v\n", list)
+	return nil
 }
 
-func updatep(contract *client.Contract, args []string) {
-	cmdInput := src.PrescriptionFromCmdArgs(args[2], args[3], args[4], args[5], args[6], args[7], args[8])
-	src.UpdatePrescription(contract, args[1], cmdInput)
+func updatep(ctx context.Context, user *src.Client, args []string) error {
+	pid, err := src.NormalizePrescriptionId(args[1])
+	if err != nil {
+		return err
+	}
+	cmdInput, err := prescriptionFromArgs(args)
+	if err != nil {
+		return err
+	}
+	err = user.UpdatePrescription(ctx, pid, cmdInput)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("%vUpdate Prescription Successful%v\n", GREEN, NC)
+	return nil
+}
+
+func statusp(ctx context.Context, user *src.Client, pid string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	status, err := user.PrescriptionStatus(ctx, pid)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Status: %v\n", status)
+	return nil
 }
 
-func deletep(contract *client.Contract, pid string) {
-	src.DeletePrescription(contract, pid)
+func cancelp(ctx context.Context, user *src.Client, pid string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	err = user.CancelPrescription(ctx, pid)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vCancel Prescription Successful%v\n", GREEN, NC)
+	return nil
+}
+
+func expirep(ctx context.Context, user *src.Client, pid string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	err = user.ExpirePrescription(ctx, pid)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vExpire Prescription Successful%v\n", GREEN, NC)
+	return nil
+}
+
+func deletep(ctx context.Context, user *src.Client, pid string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	err = user.DeletePrescription(ctx, pid)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("%vDelete Prescription Successful%v\n", GREEN, NC)
+	return nil
 }
 
-func setfillp(contract *client.Contract, pid string, newfill string) {
-	newfillInt, err := strconv.Atoi(newfill)
+func migratep(ctx context.Context, user *src.Client, pid string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	err = user.MigratePrescription(ctx, pid)
 	if err != nil {
-		panic(fmt.Errorf("failed to parse newfill into integer: %v", err))
+		return err
 	}
-	src.SetfillPrescription(contract, pid, uint8(newfillInt))
-	fmt.Printf("%vSetfill Prescription Successful%v\n", GREEN, NC)
+	fmt.Printf("%vMigrate Prescription Successful%v\n", GREEN, NC)
+	return nil
 }
 
-func readeradd(contract *client.Contract) {
-	err := src.ChainReportAddReader(contract)
+func migrateid(ctx context.Context, user *src.Client, usernames []string) error {
+	for _, username := range usernames {
+		err := user.MigrateIdentity(ctx, username)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%vMigrated user %v%v\n", GREEN, username, NC)
+	}
+	return nil
+}
+
+func pseudokey(ctx context.Context, user *src.Client) error {
+	err := user.SetPseudonymKey(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vPseudonym Key Set Successfully%v\n", GREEN, NC)
+	return nil
+}
+
+func rekey(ctx context.Context, user *src.Client, usernames []string) error {
+	for _, username := range usernames {
+		err := user.RekeyPseudonym(ctx, username)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%vRekeyed user %v%v\n", GREEN, username, NC)
+	}
+	return nil
+}
+
+func dispensep(ctx context.Context, user *src.Client, pid string, quantity string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	quantityInt, err := strconv.ParseUint(quantity, 10, 8)
+	if err != nil {
+		return fmt.Errorf("%w: failed to parse quantity into integer: %v", src.ErrInvalidArgument, err)
+	}
+	err = user.DispensePrescription(ctx, pid, uint8(quantityInt))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vDispense Prescription Successful%v\n", GREEN, NC)
+	return nil
+}
+
+func fillsp(ctx context.Context, user *src.Client, pid string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	dispenses, err := user.PrescriptionDispenses(ctx, pid)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	var total uint64
+	for _, dispense := range dispenses {
+		fmt.Printf("%v: %v dispensed by %v\n", dispense.Timestamp, dispense.Quantity, dispense.Pharmacist)
+		total += dispense.Quantity
+	}
+	fmt.Printf("Total dispensed: %v\n", total)
+	return nil
+}
+
+func readeradd(ctx context.Context, user *src.Client) error {
+	err := user.ChainReportAddReader(ctx)
+	if err != nil {
+		return err
 	}
 	fmt.Printf("%vUser is now a report reader%v\n", GREEN, NC)
+	return nil
 }
 
-func reportgen(contract *client.Contract, pid string) {
-	src.ReportUpdate(contract, pid)
+func reportgen(ctx context.Context, user *src.Client, pid string) error {
+	pid, err := src.NormalizePrescriptionId(pid)
+	if err != nil {
+		return err
+	}
+	err = user.ReportUpdate(ctx, pid)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("%vReports generated successfully%v\n", GREEN, NC)
+	return nil
 }
 
-func reportread(contract *client.Contract) {
-	output := src.ReportView(contract)
+func reportread(ctx context.Context, user *src.Client) error {
+	output, err := user.ReportView(ctx)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("%v", output)
 	fmt.Printf("%vReports displayed successfully%v\n", GREEN, NC)
+	return nil
 }
 
-func readerall(contract *client.Contract) {
-	them, err := src.ChainReportGetReaders(contract)
+func readerall(ctx context.Context, user *src.Client) error {
+	them, err := user.ChainReportGetReaders(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	fmt.Printf("them: %v\n", *them)
+	return nil
 }
 
-func checkEnoughArgs(expected int) {
-	if len(flag.Args()) < expected {
-		panic(fmt.Errorf("%vmethod '%v' expected %v arguments, but was only given %v. Do './rsa help' for method options", RED, flag.Arg(0), expected-1, len(flag.Args())-1))
+// reads the prescription fields of issuep and updatep, along with the optional valid days
+func prescriptionFromArgs(args []string) (*src.Prescription, error) {
+	prescription, err := src.PrescriptionFromCmdArgs(args[2], args[3], args[4], args[5], args[6], args[7], args[8])
+	if err != nil {
+		return nil, err
+	}
+	err = setValidDays(prescription, args, 9)
+	if err != nil {
+		return nil, err
+	}
+	return prescription, nil
+}
+
+// sets the validity of the prescription from the optional argument at index, if given
+func setValidDays(prescription *src.Prescription, args []string, index int) error {
+	if len(args) <= index {
+		return nil
+	}
+	days, err := strconv.Atoi(args[index])
+	if err != nil || days <= 0 {
+		return fmt.Errorf("%w: failed to parse valid days into a positive integer: %v", src.ErrInvalidArgument, args[index])
 	}
+	prescription.SetValidDays(days)
+	return nil
 }
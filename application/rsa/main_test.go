@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"math/rand"
 	"testing"
@@ -24,26 +26,65 @@ there is an update or setfills
 
 */
 
+// Key algorithm of the users generated by benchmarks. Run with -args -keyalg=x25519 to compare with RSA
+var benchKeyAlgorithm = flag.String("keyalg", src.ALGORITHM_RSA, "key algorithm of generated users: rsa, x25519 or x25519-mlkem768")
+
+// Benchmarks are never cancelled
+var ctx = context.Background()
+
+// Keystore shared by the clients of every role
+var keystore = &src.EncryptedFileKeystore{}
+
+// Clients of each role in the benchmarks, which are connected at once
+type benchClients struct {
+	admin      *src.Client // stores pubkeys
+	doctor     *src.Client
+	patient    *src.Client // creates and shares prescriptions
+	pharmacist *src.Client
+	reader     *src.Client // reads reports
+}
+
+func connectClient(org string, user string, peerPort string) *src.Client {
+	c := src.NewClient(src.NewIdentity(org, user, peerPort), keystore)
+	err := c.Connect()
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func connectBenchClients() *benchClients {
+	return &benchClients{
+		admin:      connectClient("org1", "Admin", "localhost:7051"),
+		doctor:     connectClient("org1", "user0001", "localhost:7051"),
+		patient:    connectClient("org1", "user0002", "localhost:7051"),
+		pharmacist: connectClient("org2", "user0003", "localhost:9051"),
+		reader:     connectClient("org1", "user0004", "localhost:7051"),
+	}
+}
+
+func (clients *benchClients) Close() {
+	for _, c := range []*src.Client{clients.admin, clients.doctor, clients.patient, clients.pharmacist, clients.reader} {
+		c.Close()
+	}
+}
+
 // ======================================================================//
 // BENCHMARK STANDARD
 // Benchmarks all functions, non-split
 // ======================================================================//
 func BenchmarkStandard(b *testing.B) {
 	fmt.Println("BENCHMARK TEST -- STANDARD METHODS")
+	clients := connectBenchClients()
+	defer clients.Close()
 
 	b.Run("Connect", func(b *testing.B) {
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
+		user := src.NewClient(src.NewIdentity("org1", "user0002", "localhost:7051"), keystore)
+		err := user.Connect()
 		if err != nil {
 			panic(err)
 		}
-		defer gw.Close()
-		src.SmartContract(gw)
+		user.Close()
 	})
 
 	var keyname []string
@@ -53,159 +94,82 @@ func BenchmarkStandard(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			new_key := fmt.Sprintf("benchtest%v", i)
 			keyname = append(keyname, new_key)
-			src.GenerateUserKeyFiles(new_key)
+			err := clients.admin.GenerateUserKeyFiles(new_key, *benchKeyAlgorithm)
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 	b.Run("SendKey", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "Admin", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
-			src.SendPubkey(contract, keyname[i])
+			err := clients.admin.SendPubkey(ctx, keyname[i])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("GetKey", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
-			src.GetPubkey(contract, src.ObscureName(keyname[i]))
+			obscureName, err := clients.patient.ObscureName(keyname[i])
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = clients.patient.GetPubkey(ctx, obscureName)
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	var pids []string
 
 	b.Run("Create", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
-			pids = append(pids, src.CreatePrescription(contract))
+			pid, err := clients.patient.CreatePrescription(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			pids = append(pids, pid)
 		}
 	})
 
 	b.Run("Read", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
 			rand.Seed(time.Now().UnixNano())
 			randPIDNum := rand.Intn(len(pids) - 1)
-			src.ReadPrescription(contract, pids[randPIDNum])
+			_, err := clients.patient.ReadPrescription(ctx, pids[randPIDNum])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("SharetoDoctors", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.SharePrescription(contract, pids[pidsNum], "user0001")
+			err := clients.patient.SharePrescription(ctx, pids[pidsNum], "user0001")
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("SharetoPharmas", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.SharePrescription(contract, pids[pidsNum], "user0003")
+			err := clients.patient.SharePrescription(ctx, pids[pidsNum], "user0003")
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("Update", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0001", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
 		prescription := src.Prescription{
 			Brand:          "DRUG BRAND",
 			Dosage:         "DRUG DOSAGE",
@@ -220,120 +184,57 @@ func BenchmarkStandard(b *testing.B) {
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.UpdatePrescription(contract, pids[pidsNum], &prescription)
+			err := clients.doctor.UpdatePrescription(ctx, pids[pidsNum], &prescription)
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
-	b.Run("Setfill", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org2", "user0003", "localhost:9051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
-		// RANDOM PRESCRIPTION VARIABLES
+	b.Run("Dispense", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.SetfillPrescription(contract, pids[pidsNum], uint8(rand.Intn(100)))
+			err := clients.pharmacist.DispensePrescription(ctx, pids[pidsNum], 1)
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("ReportAddReader", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0004", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		for i := 0; i < b.N; i++ {
-			src.ChainReportAddReader(contract)
+			err := clients.reader.ChainReportAddReader(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("ReportUpdate", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0001", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.ReportUpdate(contract, pids[pidsNum])
+			err := clients.doctor.ReportUpdate(ctx, pids[pidsNum])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("ReportRead", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0004", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			src.ReportView(contract)
+			_, err := clients.reader.ReportView(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("Delete", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		for i := 0; i < b.N; i++ {
-			defer func() {
-				if r := recover(); r != nil {
-					fmt.Println("recovered from error")
-				}
-			}()
-			_ = src.DeletePrescription(contract, pids[i])
+			// filled prescriptions must be cancelled before they can be deleted,
+			// and failures are ignored so that the remaining prescriptions are still deleted
+			_ = clients.patient.CancelPrescription(ctx, pids[i])
+			_ = clients.patient.DeletePrescription(ctx, pids[i])
 		}
 	})
 }
@@ -350,6 +251,8 @@ func BenchmarkStandard(b *testing.B) {
 // ======================================================================//
 func BenchmarkSplit(b *testing.B) {
 	fmt.Println("BENCHMARK TEST -- SPLIT METHODS")
+	clients := connectBenchClients()
+	defer clients.Close()
 	var pids []string
 	var keyname []string
 
@@ -358,7 +261,10 @@ func BenchmarkSplit(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			new_key := fmt.Sprintf("benchtest%v", i)
 			keyname = append(keyname, new_key)
-			src.GenerateUserKeyFiles(new_key)
+			err := clients.admin.GenerateUserKeyFiles(new_key, *benchKeyAlgorithm)
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 		// remove "test run" benchmark result
 		b.StopTimer()
@@ -373,7 +279,10 @@ func BenchmarkSplit(b *testing.B) {
 	b.Run("SendKeyPrepare", func(b *testing.B) {
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
-			newobs, newkey := src.PrepareSendPubkey(keyname[i])
+			newobs, newkey, err := clients.admin.PrepareSendPubkey(keyname[i])
+			if err != nil {
+				b.Fatal(err)
+			}
 			keyobsname = append(keyobsname, newobs)
 			keys = append(keys, newkey)
 		}
@@ -386,45 +295,28 @@ func BenchmarkSplit(b *testing.B) {
 	})
 
 	b.Run("SendKeySubmit", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "Admin", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
-			src.SubmitSendPubkey(contract, keyobsname[i], keys[i])
+			err := clients.admin.SubmitSendPubkey(ctx, keyobsname[i], keys[i])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	var getkeyout []string
 	b.Run("GetKeyEvaluate", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
-			getkeyout = append(getkeyout, src.EvaluateGetPubkey(contract, src.ObscureName(keyname[i])))
+			obscureName, err := clients.patient.ObscureName(keyname[i])
+			if err != nil {
+				b.Fatal(err)
+			}
+			out, err := clients.patient.EvaluateGetPubkey(ctx, obscureName)
+			if err != nil {
+				b.Fatal(err)
+			}
+			getkeyout = append(getkeyout, out)
 		}
 		// remove "test run" benchmark result
 		b.StopTimer()
@@ -436,7 +328,14 @@ func BenchmarkSplit(b *testing.B) {
 	b.Run("GetKeyProcess", func(b *testing.B) {
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
-			src.ProcessGetPubkey(getkeyout[i])
+			obscureName, err := clients.patient.ObscureName(keyname[i])
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = clients.patient.ProcessGetPubkey(obscureName, getkeyout[i])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
@@ -445,7 +344,11 @@ func BenchmarkSplit(b *testing.B) {
 	b.Run("CreatePrepare", func(b *testing.B) {
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
-			b64prescriptions = append(b64prescriptions, src.PrepareCreatePrescription())
+			b64encrypted, err := clients.patient.PrepareCreatePrescription(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b64prescriptions = append(b64prescriptions, b64encrypted)
 		}
 		// remove "test run" benchmark result
 		b.StopTimer()
@@ -455,49 +358,27 @@ func BenchmarkSplit(b *testing.B) {
 	})
 
 	b.Run("CreateSubmit", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
-			pids = append(pids, src.SubmitCreatePrescription(contract, b64prescriptions[i]))
+			pid, err := clients.patient.SubmitCreatePrescription(ctx, b64prescriptions[i], "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			pids = append(pids, pid)
 		}
 	})
 	var pdata []string
 
 	b.Run("ReadEvaluate", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
 			rand.Seed(time.Now().UnixNano())
 			randPIDNum := rand.Intn(len(pids) - 1)
-			pdata = append(pdata, src.EvaluateReadPrescription(contract, pids[randPIDNum]))
+			newdata, err := clients.patient.EvaluateReadPrescription(ctx, pids[randPIDNum])
+			if err != nil {
+				b.Fatal(err)
+			}
+			pdata = append(pdata, newdata)
 		}
 		// remove "test run" benchmark result
 		b.StopTimer()
@@ -508,28 +389,20 @@ func BenchmarkSplit(b *testing.B) {
 
 	b.Run("ReadProcess", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			src.ProcessReadPrescription(pdata[i])
+			_, err := clients.patient.ProcessReadPrescription(pdata[i])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("(SharetoDoctors)", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.SharePrescription(contract, pids[pidsNum], "user0001")
+			err := clients.patient.SharePrescription(ctx, pids[pidsNum], "user0001")
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
@@ -537,23 +410,12 @@ func BenchmarkSplit(b *testing.B) {
 	var shareenc []string
 
 	b.Run("SharePrepare", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			newobs, newenc := src.PrepareSharePrescription(contract, pids[pidsNum], "user0003")
+			newobs, newenc, err := clients.patient.PrepareSharePrescription(ctx, pids[pidsNum], "user0003")
+			if err != nil {
+				b.Fatal(err)
+			}
 			shareobs = append(shareobs, newobs)
 			shareenc = append(shareenc, newenc)
 		}
@@ -566,28 +428,16 @@ func BenchmarkSplit(b *testing.B) {
 	})
 
 	b.Run("ShareSubmit", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.SubmitSharePrescription(contract, pids[pidsNum], shareobs[pidsNum], shareenc[pidsNum])
+			err := clients.patient.SubmitSharePrescription(ctx, pids[pidsNum], shareobs[pidsNum], shareenc[pidsNum])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
-	var updates []string
+	var updates []map[string][]byte
 	b.Run("UpdatePrepare", func(b *testing.B) {
 		prescription := src.Prescription{
 			Brand:          "DRUG BRAND",
@@ -599,24 +449,13 @@ func BenchmarkSplit(b *testing.B) {
 			PiecesTotal:    100,
 			PiecesFilled:   0,
 		}
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0001", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			updates = append(updates, src.PrepareUpdatePrescription(contract, pids[pidsNum], &prescription))
+			transient, err := clients.doctor.PrepareUpdatePrescription(ctx, pids[pidsNum], &prescription)
+			if err != nil {
+				b.Fatal(err)
+			}
+			updates = append(updates, transient)
 		}
 		// remove "test run" benchmark result
 		b.StopTimer()
@@ -626,119 +465,44 @@ func BenchmarkSplit(b *testing.B) {
 	})
 
 	b.Run("UpdateSubmit", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0001", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.SubmitUpdatePrescription(contract, pids[pidsNum], updates[pidsNum])
-		}
-	})
-
-	var setfills []string
-	b.Run("SetfillPrepare", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org2", "user0003", "localhost:9051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
-		// RANDOM PRESCRIPTION VARIABLES
-		for i := 0; i < b.N; i++ {
-			pidsNum := i % len(pids)
-			setfills = append(setfills, src.PrepareSetfillPrescription(contract, pids[pidsNum], uint8(rand.Intn(100))))
-		}
-		// remove "test run" benchmark result
-		b.StopTimer()
-		if b.N == 1 {
-			setfills = nil
+			err := clients.doctor.SubmitUpdatePrescription(ctx, pids[pidsNum], updates[pidsNum])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
-	b.Run("SetfillSubmit", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org2", "user0003", "localhost:9051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
 
-		b.ResetTimer()
-		// RANDOM PRESCRIPTION VARIABLES
+	b.Run("DispenseSubmit", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.SubmitSetfillPrescription(contract, pids[pidsNum], setfills[pidsNum])
+			err := clients.pharmacist.DispensePrescription(ctx, pids[pidsNum], 1)
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("ReportAddReader", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0004", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		for i := 0; i < b.N; i++ {
-			src.ChainReportAddReader(contract)
+			err := clients.reader.ChainReportAddReader(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	var reportupdate []string
 
 	b.Run("ReportUpdatePrepare", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0001", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			reportupdate = append(reportupdate, src.PrepareReportUpdate(contract, pids[pidsNum]))
+			b64reports, err := clients.doctor.PrepareReportUpdate(ctx, pids[pidsNum])
+			if err != nil {
+				b.Fatal(err)
+			}
+			reportupdate = append(reportupdate, b64reports)
 		}
 		// remove "test run" benchmark result
 		b.StopTimer()
@@ -747,46 +511,23 @@ func BenchmarkSplit(b *testing.B) {
 		}
 	})
 	b.Run("ReportUpdateSubmit", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0001", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.SubmitReportUpdate(contract, pids[pidsNum], reportupdate[pidsNum])
+			err := clients.doctor.SubmitReportUpdate(ctx, pids[pidsNum], reportupdate[pidsNum])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	var reports []string
 	b.Run("ReportReadEvaluate", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0004", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			reports = append(reports, src.EvaluateReportView(contract))
+			b64all, err := clients.reader.EvaluateReportView(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			reports = append(reports, b64all)
 		}
 		// remove "test run" benchmark result
 		b.StopTimer()
@@ -797,145 +538,80 @@ func BenchmarkSplit(b *testing.B) {
 
 	b.Run("ReportReadProcess", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			src.ProcessReportView(reports[i])
+			_, err := clients.reader.ProcessReportView(reports[i])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 	b.Run("Delete", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		for i := 0; i < b.N; i++ {
-			defer func() {
-				if r := recover(); r != nil {
-					fmt.Println("recovered from error")
-				}
-			}()
-			_ = src.DeletePrescription(contract, pids[i])
+			// filled prescriptions must be cancelled before they can be deleted,
+			// and failures are ignored so that the remaining prescriptions are still deleted
+			_ = clients.patient.CancelPrescription(ctx, pids[i])
+			_ = clients.patient.DeletePrescription(ctx, pids[i])
 		}
 	})
 }
 
 func BenchmarkPrescriptionAmountAndReportRead(b *testing.B) {
+	clients := connectBenchClients()
+	defer clients.Close()
 	var pids []string
 	b.Run("(Create)", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
 		//Runtime Phase
 		for i := 0; i < b.N; i++ {
-			pids = append(pids, src.CreatePrescription(contract))
+			pid, err := clients.patient.CreatePrescription(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			pids = append(pids, pid)
 		}
 	})
 
 	b.Run("(SharetoDoctors)", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0002", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.SharePrescription(contract, pids[pidsNum], "user0001")
+			err := clients.patient.SharePrescription(ctx, pids[pidsNum], "user0001")
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 
 	b.Run("(ReportAddReader)", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0004", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
+		err := clients.reader.ChainReportAddReader(ctx)
 		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
+			b.Fatal(err)
 		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-		src.ChainReportAddReader(contract)
 	})
 
 	b.Run("(ReportUpdate)", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0001", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-		b.ResetTimer()
-
 		for i := 0; i < b.N; i++ {
 			pidsNum := i % len(pids)
-			src.ReportUpdate(contract, pids[pidsNum])
+			err := clients.doctor.ReportUpdate(ctx, pids[pidsNum])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 	var reports []string
 	b.Run("ReportReadEvaluate", func(b *testing.B) {
-		// Connection Phase
-		src.SetConnectionVariables("org1", "user0004", "localhost:7051")
-		clientConnection, err := src.NewGrpcConnection()
-		if err != nil {
-			panic(err)
-		}
-		defer clientConnection.Close()
-		gw, err := src.DefaultGateway(clientConnection)
-		if err != nil {
-			panic(err)
-		}
-		defer gw.Close()
-		contract := src.SmartContract(gw)
-
-		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
-			reports = append(reports, src.EvaluateReportView(contract))
+			b64all, err := clients.reader.EvaluateReportView(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			reports = append(reports, b64all)
 		}
 	})
 
 	b.Run("ReportReadProcess", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			src.ProcessReportView(reports[i])
+			_, err := clients.reader.ProcessReportView(reports[i])
+			if err != nil {
+				b.Fatal(err)
+			}
 		}
 	})
 }
@@ -0,0 +1,131 @@
+package src
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"google.golang.org/grpc"
+)
+
+// ====================================================================//
+// Client
+// A client holds one user's identity, the keystore their private keys
+// are kept in, the folder their pubkeys are kept in, and their gateway
+// connection. Clients share no state, so clients of several users,
+// such as a doctor and a pharmacist, can run concurrently in one
+// process. Several clients may share one keystore. A client is safe
+// for concurrent use once connected.
+// ====================================================================//
+type Client struct {
+	identity     *Identity
+	keystore     Keystore
+	keyFolder    string
+	pseudonymKey []byte
+	connection   *grpc.ClientConn
+	gateway      *client.Gateway
+	contract     *client.Contract
+}
+
+// ClientOption configures a client when it is created
+type ClientOption func(*Client)
+
+// WithKeyFolder sets the folder that pubkeys and the pseudonym key are kept in,
+// which is rsakeys by default
+func WithKeyFolder(folder string) ClientOption {
+	return func(c *Client) {
+		c.keyFolder = folder
+	}
+}
+
+// WithPseudonymKey sets the channel secret that pseudonyms are derived with. By
+// default it is read from RSA_PSEUDONYM_KEY, or else the key folder, when needed
+func WithPseudonymKey(key []byte) ClientOption {
+	return func(c *Client) {
+		c.pseudonymKey = key
+	}
+}
+
+// NewClient returns a client which is not connected yet. Operations which only
+// use local keys, such as GenerateUserKeyFiles, may be called before Connect
+func NewClient(id *Identity, keystore Keystore, options ...ClientOption) *Client {
+	c := &Client{identity: id, keystore: keystore, keyFolder: keyfolder}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Connect connects to the gateway peer of the client's identity, signing with
+// the enrollment key in the client's keystore
+func (c *Client) Connect() error {
+	if c.contract != nil {
+		return nil
+	}
+	connection, err := newGrpcConnection(c.identity)
+	if err != nil {
+		return err
+	}
+	gw, err := newGateway(c.identity, c.keystore, connection)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+	c.connection = connection
+	c.gateway = gw
+	c.contract = smartContract(c.identity, gw)
+	return nil
+}
+
+// Close closes the gateway connection. The keystore is left open, as it may be shared
+func (c *Client) Close() error {
+	if c.contract == nil {
+		return nil
+	}
+	c.contract = nil
+	c.gateway.Close()
+	return c.connection.Close()
+}
+
+func (c *Client) Identity() *Identity {
+	return c.identity
+}
+
+func (c *Client) Keystore() Keystore {
+	return c.keystore
+}
+
+// returns the contract, or an error if the client is not connected
+func (c *Client) smartContract() (*client.Contract, error) {
+	if c.contract == nil {
+		return nil, fmt.Errorf("%w: client of %v", ErrNotConnected, c.identity.UserId)
+	}
+	return c.contract, nil
+}
+
+// QualifiedName accepts "username", "org/username", or "MSPID/username",
+// where a username without an org belongs to the client's org
+func (c *Client) QualifiedName(username string) string {
+	return qualifiedName(c.identity.MspId, username)
+}
+
+func (c *Client) obscureName(username string) (string, error) {
+	return c.hashName(c.QualifiedName(username))
+}
+func (c *Client) ObscureName(username string) (string, error) {
+	return c.obscureName(username)
+}
+
+func (c *Client) currentUserObscure() (string, error) {
+	return c.obscureName(c.identity.UserId)
+}
+
+// signs a message with the client user's enrollment key
+func (c *Client) signWithEnrollmentKey(message []byte) ([]byte, error) {
+	sign, err := c.keystore.EnrollmentSign(c.identity)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(message)
+	return sign(digest[:])
+}
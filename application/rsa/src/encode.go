@@ -0,0 +1,281 @@
+package src
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// ============================================================ //
+// Wire Format
+// Every payload between the application and the chaincode, and
+// every record the chaincode stores, starts with a header saying
+// how the rest is encoded:
+//
+// magic "CNE" (3) | version (1) | kind (1) | body
+//
+// Kinds are 'M' for a map of strings, such as a prescription set
+// or report set, 'S' for a list of strings, and 'P' for a
+// prescription. Decoders dispatch on the version byte, so data
+// written in any version can be read:
+//
+// Version 2 is written. The body is canonical JSON, as described
+// by the schemas in the schema folder: object keys are sorted,
+// there is no insignificant whitespace, strings must be valid
+// UTF-8, and HTML characters are not escaped. Lists are sorted.
+// Endorsing peers must produce identical bytes, so the same data
+// always encodes the same way.
+//
+// Version 1 is only read. The body is count (uvarint), then each
+// string as length (uvarint) + bytes. Map entries are written as
+// key then value, sorted by key.
+//
+// Payloads without the magic prefix are decoded as legacy gob.
+// Packaged payloads are then base64 encoded. Must be kept
+// identical to the encoders in chaincode/rsa/src/encode.go.
+// ============================================================ //
+
+var canonicalMagic = []byte("CNE")
+
+const (
+	canonicalVersion1   byte = 1
+	canonicalVersion2   byte = 2
+	canonicalKindMap    byte = 'M'
+	canonicalKindList   byte = 'S'
+	canonicalHeaderSize      = 5
+)
+
+// encodes v as canonical JSON, after a version 2 header of the given kind
+func encodeCanonicalJSON(kind byte, v interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.Write(canonicalMagic)
+	buf.WriteByte(canonicalVersion2)
+	buf.WriteByte(kind)
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	// Encode ends the value with a newline, which is not part of the canonical form
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// returns the version of canonically encoded data, and the body after its header
+func readCanonicalHeader(data []byte, kind byte) (byte, []byte, error) {
+	if !bytes.HasPrefix(data, canonicalMagic) {
+		return 0, nil, fmt.Errorf("data is not canonically encoded")
+	}
+	if len(data) < canonicalHeaderSize {
+		return 0, nil, fmt.Errorf("canonical header is truncated")
+	}
+	version, gotKind := data[len(canonicalMagic)], data[len(canonicalMagic)+1]
+	if version != canonicalVersion1 && version != canonicalVersion2 {
+		return 0, nil, fmt.Errorf("unsupported encoding version %v", version)
+	}
+	if gotKind != kind {
+		return 0, nil, fmt.Errorf("unexpected encoding kind %q", gotKind)
+	}
+	return version, data[canonicalHeaderSize:], nil
+}
+
+func checkUTF8(strs ...string) error {
+	for _, str := range strs {
+		if !utf8.ValidString(str) {
+			return fmt.Errorf("string %q is not valid UTF-8", str)
+		}
+	}
+	return nil
+}
+
+func encodeCanonicalMap(m map[string]string) ([]byte, error) {
+	for key, value := range m {
+		err := checkUTF8(key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// encoding/json writes map keys sorted
+	return encodeCanonicalJSON(canonicalKindMap, m)
+}
+
+func decodeCanonicalMap(data []byte) (map[string]string, error) {
+	version, body, err := readCanonicalHeader(data, canonicalKindMap)
+	if err != nil {
+		return nil, err
+	}
+	if version == canonicalVersion1 {
+		return decodeCanonicalMapV1(body)
+	}
+	var m map[string]string
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("encoded map is null")
+	}
+	return m, nil
+}
+
+func encodeCanonicalSlice(strs []string) ([]byte, error) {
+	err := checkUTF8(strs...)
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]string, len(strs))
+	copy(sorted, strs)
+	sort.Strings(sorted)
+	return encodeCanonicalJSON(canonicalKindList, sorted)
+}
+
+func decodeCanonicalSlice(data []byte) ([]string, error) {
+	version, body, err := readCanonicalHeader(data, canonicalKindList)
+	if err != nil {
+		return nil, err
+	}
+	if version == canonicalVersion1 {
+		return decodeCanonicalSliceV1(body)
+	}
+	var strs []string
+	err = json.Unmarshal(body, &strs)
+	if err != nil {
+		return nil, err
+	}
+	if strs == nil {
+		return nil, fmt.Errorf("encoded list is null")
+	}
+	return strs, nil
+}
+
+// ============================================================ //
+// Version 1
+// ============================================================ //
+
+func readCanonicalString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", fmt.Errorf("string length %v exceeds remaining data", n)
+	}
+	str := make([]byte, n)
+	_, err = io.ReadFull(r, str)
+	if err != nil {
+		return "", err
+	}
+	return string(str), nil
+}
+
+func decodeCanonicalMapV1(body []byte) (map[string]string, error) {
+	r := bytes.NewReader(body)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for i := uint64(0); i < count; i++ {
+		key, err := readCanonicalString(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readCanonicalString(r)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+func decodeCanonicalSliceV1(body []byte) ([]string, error) {
+	r := bytes.NewReader(body)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("list length %v exceeds remaining data", count)
+	}
+	strs := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		str, err := readCanonicalString(r)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
+}
+
+// ============================================================ //
+// Packaging
+// Canonical encoding, then base64
+// ============================================================ //
+
+func packageStringSlice(strings *[]string) (string, error) {
+	encoded, err := encodeCanonicalSlice(*strings)
+	if err != nil {
+		return "", fmt.Errorf("error encoding string slice : %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(encoded), nil
+}
+
+func unpackageStringSlice(packaged string) (*[]string, error) {
+	raw, err := base64.StdEncoding.DecodeString(packaged)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(raw, canonicalMagic) {
+		strings, err := decodeCanonicalSlice(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding string slice : %v", err)
+		}
+		return &strings, nil
+	}
+	// Legacy gob
+	var strings []string
+	enc := gob.NewDecoder(bytes.NewReader(raw))
+	err = enc.Decode(&strings)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding string slice : %v", err)
+	}
+	return &strings, nil
+}
+
+func packagePrescriptionSet(pset *map[string]string) (string, error) {
+	encoded, err := encodeCanonicalMap(*pset)
+	if err != nil {
+		return "", fmt.Errorf("error encoding data : %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(encoded), nil
+}
+
+func unpackagePrescriptionSet(packaged string) (*map[string]string, error) {
+	raw, err := base64.StdEncoding.DecodeString(packaged)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(raw, canonicalMagic) {
+		pset, err := decodeCanonicalMap(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding data : %v", err)
+		}
+		return &pset, nil
+	}
+	// Legacy gob
+	pset := make(map[string]string)
+	enc := gob.NewDecoder(bytes.NewReader(raw))
+	err = enc.Decode(&pset)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding data : %v", err)
+	}
+	return &pset, nil
+}
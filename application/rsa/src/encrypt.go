@@ -2,91 +2,228 @@ package src
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
-	"encoding/gob"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
-	keyfolder    = "rsakeys"
+	keyfolder    = "rsakeys" // default key folder
 	pubFilename  = "pubkey.pem"
 	privFilename = "privkey.pem"
 )
 
 const RSA_BYTES int = 4096
 
+// Key algorithms. Users hold an RSA, an X25519, or a hybrid X25519 + ML-KEM-768 key
+const (
+	ALGORITHM_RSA             = "rsa"
+	ALGORITHM_X25519          = "x25519"
+	ALGORITHM_X25519_MLKEM768 = "x25519-mlkem768"
+)
+
 // ===============================================
-// Encryption Read (rsa key type)
+// Encryption Read (any key type)
 // ===============================================
-func readLocalPubkey(obscureName string) (*rsa.PublicKey, error) {
-	pbytes, err := readLocalKey(obscureName, pubFilename)
-	if err != nil {
-		return nil, err
-	}
-	pubkey, err := parsePubkey(pbytes)
+// the private key is read from the keystore
+func readLocalPrivkey(keystore Keystore, obscureName string) (crypto.Decrypter, error) {
+	return keystore.Privkey(obscureName, privFilename)
+}
+
+// =====================================================
+// Envelope Encryption and Decryption
+// The message is encrypted once with a random AES-256-GCM
+// data key, and only the data key is wrapped for each
+// recipient, with their own key algorithm. Recipients
+// with different key algorithms can share one message.
+//
+// Envelope layout (versions 1 to 3):
+// magic (3) | version (1) | wrapped key length (2) |
+// wrapped key | nonce (12) | AES-GCM ciphertext
+//
+// Version 1 wraps the data key with RSA-OAEP, version 2
+// with X25519, as in x25519.go, and version 3 with
+// X25519 and ML-KEM-768, as in hybrid.go.
+//
+// Anything without the magic prefix is treated as the
+// legacy format, where the message was split into
+// OAEP-sized chunks that were each RSA-encrypted.
+// =====================================================
+
+var envelopeMagic = []byte("RXE")
+
+const (
+	envelopeVersion1   byte = 1
+	envelopeVersion2   byte = 2
+	envelopeVersion3   byte = 3
+	dataKeySize             = 32
+	envelopeHeaderSize      = 6
+)
+
+// encrypts msg for a single recipient
+func encryptBytes(msg []byte, pub crypto.PublicKey) ([]byte, error) {
+	envelopes, err := encryptBytesForAll(msg, []crypto.PublicKey{pub})
 	if err != nil {
 		return nil, err
 	}
-	return pubkey, nil
+	return envelopes[0], nil
 }
 
-func readLocalPrivkey(obscureName string) (*rsa.PrivateKey, error) {
-	pbytes, err := readLocalKey(obscureName, privFilename)
+// encrypts msg once, then returns one envelope per pubkey, in the same order
+func encryptBytesForAll(msg []byte, pubs []crypto.PublicKey) ([][]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error generating data key : %v", err)
 	}
-	privkey, err := parsePrivkey(pbytes)
+	gcm, err := newGCM(dataKey)
 	if err != nil {
 		return nil, err
 	}
-	return privkey, nil
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("error generating nonce : %v", err)
+	}
+	sealed := gcm.Seal(nil, nonce, msg, envelopeMagic)
+
+	envelopes := make([][]byte, len(pubs))
+	for i, pub := range pubs {
+		version, wrappedKey, err := wrapDataKey(dataKey, pub)
+		if err != nil {
+			return nil, err
+		}
+		envelope := make([]byte, 0, envelopeHeaderSize+len(wrappedKey)+len(nonce)+len(sealed))
+		envelope = append(envelope, envelopeMagic...)
+		envelope = append(envelope, version)
+		envelope = binary.BigEndian.AppendUint16(envelope, uint16(len(wrappedKey)))
+		envelope = append(envelope, wrappedKey...)
+		envelope = append(envelope, nonce...)
+		envelope = append(envelope, sealed...)
+		envelopes[i] = envelope
+	}
+	return envelopes, nil
 }
 
-// =====================================================
-// RSA Encryption and Decryption
-// =====================================================
+var oaepSHA256 = &rsa.OAEPOptions{Hash: crypto.SHA256}
 
-// from https://stackoverflow.com/questions/62348923/rs256-message-too-long-for-rsa-public-key-size-error-signing-jwt
-func encryptBytes(msg []byte, pub *rsa.PublicKey) ([]byte, error) {
-	msgLen := len(msg)
-	hash := sha256.New()
-	step := pub.Size() - 2*hash.Size() - 2
-	var encrypted []byte
-	for start := 0; start < msgLen; start += step {
-		finish := start + step
-		if finish > msgLen {
-			finish = msgLen
-		}
+// returns the envelope version and the data key wrapped for the pubkey
+func wrapDataKey(dataKey []byte, pub crypto.PublicKey) (byte, []byte, error) {
+	var version byte
+	var wrappedKey []byte
+	var err error
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		version = envelopeVersion1
+		wrappedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, key, dataKey, nil)
+	case *ecdh.PublicKey:
+		version = envelopeVersion2
+		wrappedKey, err = wrapX25519(dataKey, key)
+	case *hybridPublicKey:
+		version = envelopeVersion3
+		wrappedKey, err = wrapHybrid(dataKey, key)
+	default:
+		return 0, nil, fmt.Errorf("unsupported pubkey type %T", pub)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("error wrapping data key : %v", err)
+	}
+	return version, wrappedKey, nil
+}
 
-		encryptedBlock, err := rsa.EncryptOAEP(hash, rand.Reader, pub, msg[start:finish], nil)
-		if err != nil {
-			return nil, fmt.Errorf("error encrypting bytes : %v", err)
+func decryptBytes(ciphertext []byte, priv crypto.Decrypter) ([]byte, error) {
+	if !bytes.HasPrefix(ciphertext, envelopeMagic) || len(ciphertext) < envelopeHeaderSize {
+		return decryptChunkedBytes(ciphertext, priv)
+	}
+	version := ciphertext[len(envelopeMagic)]
+	var opts crypto.DecrypterOpts
+	switch version {
+	case envelopeVersion1:
+		if _, ok := priv.Public().(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("envelope is wrapped for an RSA key, not %T", priv.Public())
+		}
+		opts = oaepSHA256
+	case envelopeVersion2:
+		if _, ok := priv.Public().(*ecdh.PublicKey); !ok {
+			return nil, fmt.Errorf("envelope is wrapped for an X25519 key, not %T", priv.Public())
+		}
+	case envelopeVersion3:
+		if _, ok := priv.Public().(*hybridPublicKey); !ok {
+			return nil, fmt.Errorf("envelope is wrapped for a hybrid key, not %T", priv.Public())
 		}
-		encrypted = append(encrypted, encryptedBlock...)
+	default:
+		return nil, fmt.Errorf("unsupported envelope version %v", version)
 	}
+	wrappedLen := int(binary.BigEndian.Uint16(ciphertext[len(envelopeMagic)+1:]))
+	body := ciphertext[envelopeHeaderSize:]
+	if len(body) < wrappedLen {
+		return nil, fmt.Errorf("envelope is truncated")
+	}
+	dataKey, err := priv.Decrypt(rand.Reader, body[:wrappedLen], opts)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key : %v", err)
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	body = body[wrappedLen:]
+	if len(body) < gcm.NonceSize() {
+		return nil, fmt.Errorf("envelope is truncated")
+	}
+	decrypted, err := gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():], envelopeMagic)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting bytes : %v", err)
+	}
+	return decrypted, nil
+}
 
-	return encrypted, nil
+func newGCM(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("error creating AES cipher : %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GCM : %v", err)
+	}
+	return gcm, nil
 }
 
+// Legacy format, kept so that prescriptions encrypted before envelopes were introduced can still be read
 // from https://stackoverflow.com/questions/62348923/rs256-message-too-long-for-rsa-public-key-size-error-signing-jwt
-func decryptBytes(ciphertext []byte, priv *rsa.PrivateKey) ([]byte, error) {
+func decryptChunkedBytes(ciphertext []byte, priv crypto.Decrypter) ([]byte, error) {
 	msgLen := len(ciphertext)
-	hash := sha256.New()
-	step := priv.PublicKey.Size()
+	pub, ok := priv.Public().(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T is not an RSA key", priv)
+	}
+	step := pub.Size()
 	var decrypted []byte
 	for start := 0; start < msgLen; start += step {
 		finish := start + step
 		if finish > msgLen {
 			finish = msgLen
 		}
-		decryptedBlock, err := rsa.DecryptOAEP(hash, rand.Reader, priv, ciphertext[start:finish], nil)
+		decryptedBlock, err := priv.Decrypt(rand.Reader, ciphertext[start:finish], oaepSHA256)
 		if err != nil {
 			return nil, fmt.Errorf("error decrypting bytes : %v", err)
 		}
@@ -97,154 +234,482 @@ func decryptBytes(ciphertext []byte, priv *rsa.PrivateKey) ([]byte, error) {
 
 // ====================================================
 // Obscure Username
-// Hashes and hexes the username so no info is revealed
+// Qualifies the username with its org's MSP ID, then
+// hashes and hexes it so no info is revealed.
+// If a pseudonym key is available, the hash is a keyed
+// HMAC prefixed with its scheme version, so names can't
+// be recovered by hashing guesses. Without one, the
+// legacy bare SHA-256 is used. Must match obscureName
+// in the chaincode.
 // ====================================================
+const (
+	pseudonymKeyEnv  = "RSA_PSEUDONYM_KEY"
+	pseudonymKeyFile = "pseudonym.key"
+	pseudonymPrefix  = "p1."
+	pseudonymKeySize = 32
+)
 
-func obscureName(username string) string {
-	raw := sha256.Sum256([]byte(username))
-	return hex.EncodeToString(raw[:])
+func (c *Client) hashName(name string) (string, error) {
+	key, err := c.loadPseudonymKey()
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		return legacyHashName(name), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil)), nil
 }
-func ObscureName(username string) string {
-	raw := sha256.Sum256([]byte(username))
+
+func legacyHashName(name string) string {
+	raw := sha256.Sum256([]byte(name))
 	return hex.EncodeToString(raw[:])
 }
 
+// returns the client's pseudonym key if it was given, else reads the hex pseudonym
+// key from the environment, else from the key folder. returns nil if none is set.
+func (c *Client) loadPseudonymKey() ([]byte, error) {
+	if c.pseudonymKey != nil {
+		return c.pseudonymKey, nil
+	}
+	hexkey := os.Getenv(pseudonymKeyEnv)
+	if hexkey == "" {
+		data, err := os.ReadFile(filepath.Join(c.keyFolder, pseudonymKeyFile))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pseudonym key: %v", err)
+		}
+		hexkey = string(bytes.TrimSpace(data))
+	}
+	key, err := hex.DecodeString(hexkey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pseudonym key: %v", err)
+	}
+	if len(key) < pseudonymKeySize {
+		return nil, fmt.Errorf("pseudonym key must be at least %v bytes", pseudonymKeySize)
+	}
+	return key, nil
+}
+
+// generates a pseudonym key in the key folder, unless one is already available
+func (c *Client) generatePseudonymKey() ([]byte, error) {
+	key, err := c.loadPseudonymKey()
+	if err != nil || key != nil {
+		return key, err
+	}
+	key = make([]byte, pseudonymKeySize)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(c.keyFolder, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(c.keyFolder, pseudonymKeyFile), []byte(hex.EncodeToString(key)), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write pseudonym key: %v", err)
+	}
+	return key, nil
+}
+
 // ===============================================
 // Key Generation
 // Generates public & private keys
 // ===============================================
 
-// used to generate a new pair of keys and their PEM files
-func GenerateUserKeyFiles(username string) {
-	privkey, pubkey := generateKeyPair(RSA_BYTES)
-
-	obscureName := obscureName(username)
-
-	err := savePubkey(pubkey, obscureName)
+// used to generate a new pair of keys with the given algorithm. the private key is kept in the client's keystore
+func (c *Client) GenerateUserKeyFiles(username string, algorithm string) error {
+	obscureName, err := c.obscureName(username)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = savePrivKey(privkey, obscureName)
+	pubkey, err := c.keystore.GeneratePrivkey(obscureName, privFilename, algorithm)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return c.savePubkey(pubkey, obscureName, pubFilename)
 }
 
 // from https://gist.github.com/miguelmota/3ea9286bd1d3c2a985b67cac4ba2130a
-func generateKeyPair(bits int) (*rsa.PrivateKey, *rsa.PublicKey) {
+func generateKeyPair(bits int) (*rsa.PrivateKey, *rsa.PublicKey, error) {
 	privkey, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
-		panic(fmt.Errorf("failed to generate key pair: %v", err))
+		return nil, nil, fmt.Errorf("failed to generate key pair: %v", err)
 	}
-	return privkey, &privkey.PublicKey
+	return privkey, &privkey.PublicKey, nil
 }
 
-func savePubkey(pubkey *rsa.PublicKey, obscureName string) error {
-	data, err := x509.MarshalPKIXPublicKey(pubkey)
-	if err != nil {
-		return err
+// generates a private key with the given algorithm, returning it with its pubkey
+func generatePrivkey(algorithm string) (crypto.PrivateKey, crypto.PublicKey, error) {
+	switch algorithm {
+	case ALGORITHM_RSA:
+		privkey, pubkey, err := generateKeyPair(RSA_BYTES)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privkey, pubkey, nil
+	case ALGORITHM_X25519:
+		privkey, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate key pair: %v", err)
+		}
+		return privkey, privkey.PublicKey(), nil
+	case ALGORITHM_X25519_MLKEM768:
+		privkey, err := generateHybridKey()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate key pair: %v", err)
+		}
+		return privkey, privkey.Public(), nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown key algorithm '%v'", ErrInvalidArgument, algorithm)
 	}
-	saveLocalKey(data, obscureName, pubFilename)
-	return nil
 }
 
-func savePrivKey(privkey *rsa.PrivateKey, obscureName string) error {
-	data, err := x509.MarshalPKCS8PrivateKey(privkey)
+func (c *Client) savePubkey(pubkey crypto.PublicKey, obscureName string, filename string) error {
+	data, err := marshalPubkey(pubkey)
 	if err != nil {
 		return err
 	}
-	saveLocalKey(data, obscureName, privFilename)
-	return nil
+	return saveLocalKey(c.keyFolder, data, obscureName, filename)
 }
 
-func saveLocalKey(keyPem []byte, obscureName string, filename string) {
-	os.Mkdir(keyfolder, 0777)
-	os.Mkdir(filepath.Join(keyfolder, obscureName), 0777)
+// pubkeys are PKIX encoded, except for hybrid pubkeys which have no standard encoding
+func marshalPubkey(pubkey crypto.PublicKey) ([]byte, error) {
+	if hybrid, ok := pubkey.(*hybridPublicKey); ok {
+		return marshalHybridPubkey(hybrid), nil
+	}
+	return x509.MarshalPKIXPublicKey(pubkey)
+}
 
-	file, err := os.Create(filepath.Join(keyfolder, obscureName, filename))
+// private keys are PKCS#8 encoded, except for hybrid keys which have no standard encoding.
+// accepts keys as generated by generatePrivkey or parsed by parsePrivkey
+func marshalPrivkey(privkey crypto.PrivateKey) ([]byte, error) {
+	switch key := privkey.(type) {
+	case *hybridPrivkey:
+		return marshalHybridPrivkey(key), nil
+	case *x25519Privkey:
+		return x509.MarshalPKCS8PrivateKey(key.key)
+	default:
+		return x509.MarshalPKCS8PrivateKey(privkey)
+	}
+}
+
+// key files are only readable by their owner
+func saveLocalKey(folder string, keyPem []byte, obscureName string, filename string) error {
+	dir := filepath.Join(folder, obscureName)
+	err := os.MkdirAll(dir, 0700)
 	if err != nil {
-		fmt.Print(err)
+		return fmt.Errorf("failed to create key folder: %v", err)
 	}
-	defer file.Close()
-	_, err = file.Write(keyPem)
+	err = os.WriteFile(filepath.Join(dir, filename), keyPem, 0600)
 	if err != nil {
-		fmt.Print(err)
+		return fmt.Errorf("failed to save %v: %v", filename, err)
 	}
+	return nil
 }
 
 // ===============================================
-// Encoders/Decoders
-// For communication with the chaincode
+// Key Registration
+// Pubkeys are stored on chain as a record holding
+// the pubkey and its algorithm, the cert and MSP ID
+// of the identity that stored it, and that identity's
+// signature over the algorithm, username and pubkey.
+// Records without an algorithm hold RSA pubkeys. The
+// signed message must match keyRegistrationMessage in
+// the chaincode.
 // ===============================================
+const (
+	keyRecordPubkey    = "pubkey"
+	keyRecordAlgorithm = "algorithm"
+	keyRecordSignature = "signature"
+	keyRecordCert      = "cert"
+	keyRecordMSP       = "mspid"
+	keyRecordIdentity  = "identity"
+)
+
+// Fabric CA stores cert attributes as JSON in this extension
+var fabricAttrsOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
 
-func unpackageStringSlice(b64slice string) (*[]string, error) {
-	gobslice, err := base64.StdEncoding.DecodeString(b64slice)
+func keyRegistrationMessage(algorithm string, obscuredName string, pubkey []byte) []byte {
+	message := []byte(algorithm + "-pubkey-registration:" + obscuredName + ":")
+	return append(message, pubkey...)
+}
+
+func verifyKeyRegistration(cert *x509.Certificate, algorithm string, obscuredName string, pubkey []byte, signature []byte) error {
+	err := checkEnrollmentSignature(cert, keyRegistrationMessage(algorithm, obscuredName, pubkey), signature)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("pubkey registration signature is invalid: %v", err)
 	}
-	var strings []string
-	enc := gob.NewDecoder(bytes.NewReader(gobslice))
-	err = enc.Decode(&strings)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding string slice : %v", err)
+	return nil
+}
+
+// checks a signature made by signWithEnrollmentKey
+func checkEnrollmentSignature(cert *x509.Certificate, message []byte, signature []byte) error {
+	var algorithm x509.SignatureAlgorithm
+	switch cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		algorithm = x509.ECDSAWithSHA256
+	case *rsa.PublicKey:
+		algorithm = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("unsupported enrollment key type %T", cert.PublicKey)
 	}
-	return &strings, nil
+	return cert.CheckSignature(algorithm, message, signature)
 }
 
-func packagePrescriptionSet(pset *map[string]string) (string, error) {
-	// STEP 1: Gob-Encode
-	buf := bytes.Buffer{}
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(*pset)
+// signs the pubkey with the client user's enrollment key, and packages both for the chaincode,
+// along with the identity of the user the pubkey belongs to
+func (c *Client) packageKeyRegistration(identity string, obscuredName string, pubkey []byte) (string, error) {
+	parsed, err := parsePubkey(pubkey)
 	if err != nil {
-		return "", fmt.Errorf("failed to gob the prescription set: %v", err)
+		return "", err
 	}
-
-	// STEP 2: Base-64 it
-	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+	algorithm := pubkeyAlgorithm(parsed)
+	signature, err := c.signWithEnrollmentKey(keyRegistrationMessage(algorithm, obscuredName, pubkey))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign pubkey registration: %v", err)
+	}
+	registration := map[string]string{
+		keyRecordPubkey:    base64.StdEncoding.EncodeToString(pubkey),
+		keyRecordAlgorithm: algorithm,
+		keyRecordSignature: base64.StdEncoding.EncodeToString(signature),
+		keyRecordIdentity:  identity,
+	}
+	return packagePrescriptionSet(&registration)
 }
 
-func unpackagePrescriptionSet(packaged string) (*map[string]string, error) {
-	rawgob, err := base64.StdEncoding.DecodeString(packaged)
+// checks that the pubkey record was signed by the user it belongs to, or by an admin of the user's own MSP
+func (c *Client) unpackageKeyRecord(obscuredName string, record []byte) (crypto.PublicKey, error) {
+	if !bytes.HasPrefix(record, canonicalMagic) {
+		return nil, fmt.Errorf("pubkey for user '%v' is not signed, and must be stored again", obscuredName)
+	}
+	fields, err := decodeCanonicalMap(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pubkey record: %v", err)
+	}
+	pubkey, err := base64.StdEncoding.DecodeString(fields[keyRecordPubkey])
+	if err != nil {
+		return nil, fmt.Errorf("base64 decoding failed on retrieved pubkey: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(fields[keyRecordSignature])
+	if err != nil {
+		return nil, fmt.Errorf("base64 decoding failed on pubkey signature: %v", err)
+	}
+	block, _ := pem.Decode([]byte(fields[keyRecordCert]))
+	if block == nil {
+		return nil, fmt.Errorf("pubkey record has no signer certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signer certificate: %v", err)
+	}
+	signerName, err := c.hashName(identityName(fields[keyRecordMSP], cert.Subject.CommonName))
 	if err != nil {
 		return nil, err
 	}
-	pset := make(map[string]string)
-	enc := gob.NewDecoder(bytes.NewReader(rawgob))
-	err = enc.Decode(&pset)
+	if signerName != obscuredName {
+		err = c.checkAdminKeyRecord(obscuredName, cert, fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	algorithm := fields[keyRecordAlgorithm]
+	if algorithm == "" {
+		algorithm = ALGORITHM_RSA
+	}
+	err = verifyKeyRegistration(cert, algorithm, obscuredName, pubkey, signature)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding data : %v", err)
+		return nil, err
+	}
+	parsed, err := parsePubkey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	if pubkeyAlgorithm(parsed) != algorithm {
+		return nil, fmt.Errorf("pubkey for user '%v' is not an %v key", obscuredName, algorithm)
+	}
+	return parsed, nil
+}
+
+// checks that a pubkey record stored by someone other than the user was stored by an
+// admin of the user's MSP, for the identity the record belongs to
+func (c *Client) checkAdminKeyRecord(obscuredName string, cert *x509.Certificate, fields map[string]string) error {
+	if !isAdminCert(cert) {
+		return fmt.Errorf("pubkey for user '%v' was stored by another user '%v'", obscuredName, cert.Subject.CommonName)
+	}
+	identity := fields[keyRecordIdentity]
+	mspID, _, _ := strings.Cut(identity, "/")
+	if mspID == "" || mspID != fields[keyRecordMSP] {
+		return fmt.Errorf("pubkey for user '%v' was stored by admin '%v' of another MSP", obscuredName, cert.Subject.CommonName)
+	}
+	identityName, err := c.hashName(identity)
+	if err != nil {
+		return err
+	}
+	if identityName != obscuredName {
+		return fmt.Errorf("pubkey for user '%v' was stored for another user '%v'", obscuredName, identity)
+	}
+	return nil
+}
+
+func isAdminCert(cert *x509.Certificate) bool {
+	return certAttribute(cert, "hf.Type") == "admin"
+}
+
+// returns the value of a Fabric CA attribute in the cert, or "" if it has none
+func certAttribute(cert *x509.Certificate, name string) string {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(fabricAttrsOID) {
+			continue
+		}
+		var attrs struct {
+			Attrs map[string]string `json:"attrs"`
+		}
+		if json.Unmarshal(ext.Value, &attrs) != nil {
+			return ""
+		}
+		return attrs.Attrs[name]
 	}
-	return &pset, nil
+	return ""
 }
 
 // ===============================================
 // Encryption Read Parse
 // ===============================================
 
-func parsePubkey(arr []byte) (*rsa.PublicKey, error) {
+// returns an RSA, X25519 or hybrid pubkey
+func parsePubkey(arr []byte) (crypto.PublicKey, error) {
+	if isHybridPubkey(arr) {
+		return parseHybridPubkey(arr)
+	}
 	parseOut, _ := x509.ParsePKIXPublicKey(arr)
 	if parseOut == nil {
 		return nil, fmt.Errorf("failed to parse bytes as x509 PKIX Public Key")
 	}
-	key := parseOut.(*rsa.PublicKey)
-	return key, nil
+	if pubkeyAlgorithm(parseOut) == "" {
+		return nil, fmt.Errorf("unsupported pubkey type %T", parseOut)
+	}
+	return parseOut, nil
 }
 
-func parsePrivkey(arr []byte) (*rsa.PrivateKey, error) {
+// returns an RSA, X25519 or hybrid private key, as a crypto.Decrypter that unwraps envelope data keys
+func parsePrivkey(arr []byte) (crypto.Decrypter, error) {
+	if isHybridPrivkey(arr) {
+		return parseHybridPrivkey(arr)
+	}
 	parseOut, _ := x509.ParsePKCS8PrivateKey(arr)
 	if parseOut == nil {
-		return nil, fmt.Errorf("failed to parse bytes as x509 PKIX Public Key")
+		return nil, fmt.Errorf("failed to parse bytes as x509 PKCS#8 Private Key")
 	}
-	key := parseOut.(*rsa.PrivateKey)
-	return key, nil
+	switch key := parseOut.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdh.PrivateKey:
+		if key.Curve() == ecdh.X25519() {
+			return &x25519Privkey{key: key}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", parseOut)
+}
+
+// returns the algorithm of an RSA, X25519 or hybrid pubkey, or "" for any other key
+func pubkeyAlgorithm(pubkey crypto.PublicKey) string {
+	switch key := pubkey.(type) {
+	case *rsa.PublicKey:
+		return ALGORITHM_RSA
+	case *hybridPublicKey:
+		return ALGORITHM_X25519_MLKEM768
+	case *ecdh.PublicKey:
+		if key.Curve() == ecdh.X25519() {
+			return ALGORITHM_X25519
+		}
+	}
+	return ""
+}
+
+// ===============================================
+// Key Rotation
+// A new key pair is saved beside the current one
+// until the rotation is committed, so that the old
+// private key is kept if the rotation fails.
+// ===============================================
+const pendingSuffix = ".new"
+
+// generates a new key pair for the user with the given algorithm, saved as pending. returns the new pubkey
+func (c *Client) generatePendingKeyFiles(obscureName string, algorithm string) (crypto.PublicKey, error) {
+	pubkey, err := c.keystore.GeneratePrivkey(obscureName, privFilename+pendingSuffix, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	err = c.savePubkey(pubkey, obscureName, pubFilename+pendingSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return pubkey, nil
+}
+
+// replaces the user's key pair with the pending one
+func (c *Client) commitPendingKeyFiles(obscureName string) error {
+	err := c.keystore.MovePrivkey(obscureName, privFilename+pendingSuffix, obscureName, privFilename)
+	if err != nil {
+		return fmt.Errorf("failed to replace %v with the rotated key: %v", privFilename, err)
+	}
+	path := filepath.Join(c.keyFolder, obscureName, pubFilename)
+	err = os.Rename(path+pendingSuffix, path)
+	if err != nil {
+		return fmt.Errorf("failed to replace %v with the rotated key: %v", pubFilename, err)
+	}
+	return nil
+}
+
+// whether the user has a pending key pair from a rotation that has not finished
+func (c *Client) hasPendingKeyFiles(obscureName string) bool {
+	_, err := os.Stat(filepath.Join(c.keyFolder, obscureName, pubFilename+pendingSuffix))
+	return err == nil
+}
+
+// removes the user's pending key pair, keeping the current one
+func (c *Client) discardPendingKeyFiles(obscureName string) {
+	c.keystore.DeletePrivkey(obscureName, privFilename+pendingSuffix)
+	os.Remove(filepath.Join(c.keyFolder, obscureName, pubFilename+pendingSuffix))
+}
+
+// moves a user's keys to their new obscured name, if they have not been moved yet.
+// the pubkey is moved last, so it marks the keys as moved
+func (c *Client) migrateLocalKeys(oldObscureName string, newObscureName string) error {
+	newPubkeyPath := filepath.Join(c.keyFolder, newObscureName, pubFilename)
+	if _, err := os.Stat(newPubkeyPath); err == nil {
+		return nil
+	}
+	err := c.keystore.MovePrivkey(oldObscureName, privFilename, newObscureName, privFilename)
+	if err != nil {
+		return fmt.Errorf("failed to move local keys: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(newPubkeyPath), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to move local keys: %v", err)
+	}
+	err = os.Rename(filepath.Join(c.keyFolder, oldObscureName, pubFilename), newPubkeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to move local keys: %v", err)
+	}
+	// the old folder is only removed once it is empty
+	os.Remove(filepath.Join(c.keyFolder, oldObscureName))
+	return nil
 }
 
 // ===============================================
 // Encryption Read (bytes)
 // ===============================================
-func readLocalKey(username, filename string) ([]byte, error) {
-	data, err := os.ReadFile(filepath.Join(keyfolder, username, filename))
+func readLocalKey(folder string, username string, filename string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(folder, username, filename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: file %v of user %v does not exist", ErrKeyNotFound, filename, username)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file %v : %v", filename, err)
 	}
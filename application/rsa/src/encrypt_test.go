@@ -0,0 +1,242 @@
+package src
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/pem"
+	"testing"
+)
+
+// bits of the RSA keys used in tests, smaller than RSA_BYTES to keep them fast
+const testRSABits = 2048
+
+// returns a fresh private key of the algorithm, read back the way keystores read it
+func testPrivkey(t *testing.T, algorithm string) crypto.Decrypter {
+	t.Helper()
+	var privkey crypto.PrivateKey
+	var err error
+	if algorithm == ALGORITHM_RSA {
+		privkey, _, err = generateKeyPair(testRSABits)
+	} else {
+		privkey, _, err = generatePrivkey(algorithm)
+	}
+	if err != nil {
+		t.Fatalf("generating %v key: %v", algorithm, err)
+	}
+	data, err := marshalPrivkey(privkey)
+	if err != nil {
+		t.Fatalf("marshalling %v key: %v", algorithm, err)
+	}
+	decrypter, err := parsePrivkey(data)
+	if err != nil {
+		t.Fatalf("parsing %v key: %v", algorithm, err)
+	}
+	return decrypter
+}
+
+var envelopeTests = []struct {
+	algorithm string
+	version   byte
+}{
+	{ALGORITHM_RSA, envelopeVersion1},
+	{ALGORITHM_X25519, envelopeVersion2},
+	{ALGORITHM_X25519_MLKEM768, envelopeVersion3},
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	msgs := [][]byte{
+		{},
+		[]byte("short"),
+		bytes.Repeat([]byte("a prescription longer than one RSA block "), 64),
+	}
+	for _, tt := range envelopeTests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			priv := testPrivkey(t, tt.algorithm)
+			for _, msg := range msgs {
+				envelope, err := encryptBytes(msg, priv.Public())
+				if err != nil {
+					t.Fatalf("encryptBytes: %v", err)
+				}
+				if !bytes.HasPrefix(envelope, envelopeMagic) || envelope[len(envelopeMagic)] != tt.version {
+					t.Fatalf("envelope header = %x, want magic and version %v", envelope[:envelopeHeaderSize], tt.version)
+				}
+				decrypted, err := decryptBytes(envelope, priv)
+				if err != nil {
+					t.Fatalf("decryptBytes: %v", err)
+				}
+				if !bytes.Equal(decrypted, msg) {
+					t.Fatalf("decrypted %q, want %q", decrypted, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvelopeForAll(t *testing.T) {
+	msg := []byte("shared between recipients")
+	privs := make([]crypto.Decrypter, len(envelopeTests))
+	pubs := make([]crypto.PublicKey, len(envelopeTests))
+	for i, tt := range envelopeTests {
+		privs[i] = testPrivkey(t, tt.algorithm)
+		pubs[i] = privs[i].Public()
+	}
+	envelopes, err := encryptBytesForAll(msg, pubs)
+	if err != nil {
+		t.Fatalf("encryptBytesForAll: %v", err)
+	}
+	if len(envelopes) != len(pubs) {
+		t.Fatalf("got %v envelopes, want %v", len(envelopes), len(pubs))
+	}
+	for i, envelope := range envelopes {
+		decrypted, err := decryptBytes(envelope, privs[i])
+		if err != nil {
+			t.Fatalf("%v: decryptBytes: %v", envelopeTests[i].algorithm, err)
+		}
+		if !bytes.Equal(decrypted, msg) {
+			t.Fatalf("%v: decrypted %q, want %q", envelopeTests[i].algorithm, decrypted, msg)
+		}
+		for j, other := range privs {
+			if j != i {
+				if _, err := decryptBytes(envelope, other); err == nil {
+					t.Fatalf("%v envelope decrypted with %v key", envelopeTests[i].algorithm, envelopeTests[j].algorithm)
+				}
+			}
+		}
+	}
+}
+
+func TestEnvelopeTampered(t *testing.T) {
+	for _, tt := range envelopeTests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			priv := testPrivkey(t, tt.algorithm)
+			envelope, err := encryptBytes([]byte("do not change"), priv.Public())
+			if err != nil {
+				t.Fatalf("encryptBytes: %v", err)
+			}
+			for _, i := range []int{envelopeHeaderSize, len(envelope) - 1} {
+				tampered := bytes.Clone(envelope)
+				tampered[i] ^= 1
+				if _, err := decryptBytes(tampered, priv); err == nil {
+					t.Fatalf("envelope with byte %v changed was decrypted", i)
+				}
+			}
+			if _, err := decryptBytes(envelope[:len(envelope)-1], priv); err == nil {
+				t.Fatalf("truncated envelope was decrypted")
+			}
+		})
+	}
+}
+
+// encrypts msg the way prescriptions were encrypted before envelopes, in OAEP-sized chunks
+func encryptChunkedBytes(t *testing.T, msg []byte, pub *rsa.PublicKey) []byte {
+	t.Helper()
+	step := pub.Size() - 2*sha256.Size - 2
+	var encrypted []byte
+	for start := 0; start < len(msg); start += step {
+		finish := start + step
+		if finish > len(msg) {
+			finish = len(msg)
+		}
+		block, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, msg[start:finish], nil)
+		if err != nil {
+			t.Fatalf("encrypting chunk: %v", err)
+		}
+		encrypted = append(encrypted, block...)
+	}
+	return encrypted
+}
+
+func TestDecryptLegacyChunked(t *testing.T) {
+	priv := testPrivkey(t, ALGORITHM_RSA)
+	pub := priv.Public().(*rsa.PublicKey)
+	step := pub.Size() - 2*sha256.Size - 2
+	for _, size := range []int{1, step, step + 1, 3*step + 7} {
+		msg := bytes.Repeat([]byte{'x'}, size)
+		decrypted, err := decryptBytes(encryptChunkedBytes(t, msg, pub), priv)
+		if err != nil {
+			t.Fatalf("%v bytes: decryptBytes: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, msg) {
+			t.Fatalf("%v bytes: decrypted message differs", size)
+		}
+	}
+
+	x25519 := testPrivkey(t, ALGORITHM_X25519)
+	if _, err := decryptBytes(encryptChunkedBytes(t, []byte("legacy"), pub), x25519); err == nil {
+		t.Fatalf("legacy ciphertext decrypted with an X25519 key")
+	}
+}
+
+// returns the pubkey record the chaincode stores when c registers pubkey for identity
+func testKeyRecord(t *testing.T, c *Client, identity string, obscuredName string, pubkey []byte) []byte {
+	t.Helper()
+	b64registration, err := c.packageKeyRegistration(identity, obscuredName, pubkey)
+	if err != nil {
+		t.Fatalf("packageKeyRegistration: %v", err)
+	}
+	registration, err := unpackagePrescriptionSet(b64registration)
+	if err != nil {
+		t.Fatalf("unpackagePrescriptionSet: %v", err)
+	}
+	cert, err := loadCertificate(c.identity.CertPath)
+	if err != nil {
+		t.Fatalf("loadCertificate: %v", err)
+	}
+	record := *registration
+	record[keyRecordCert] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	record[keyRecordMSP] = c.identity.MspId
+	encoded, err := encodeCanonicalMap(record)
+	if err != nil {
+		t.Fatalf("encodeCanonicalMap: %v", err)
+	}
+	return encoded
+}
+
+func TestUnpackageAdminKeyRecord(t *testing.T) {
+	ca := newTestCA(t, "ca.org1.example.com")
+	root := newTestNetwork(t, ca)
+	admin := enrollTestIdentity(t, root, ca, "admin", map[string]string{"hf.EnrollmentID": "admin", "hf.Type": "admin"})
+	doctor := enrollTestUser(t, root, ca, "doctor", USER_DOCTOR)
+	pharmacist := enrollTestUser(t, root, ca, "pharmacist", USER_PHARMACIST)
+	_, pub, err := generatePrivkey(ALGORITHM_X25519)
+	if err != nil {
+		t.Fatalf("generating pubkey: %v", err)
+	}
+	pubkey, err := marshalPubkey(pub)
+	if err != nil {
+		t.Fatalf("marshalPubkey: %v", err)
+	}
+	patientName, err := doctor.obscureName("patient")
+	if err != nil {
+		t.Fatalf("obscureName: %v", err)
+	}
+	outsiderName, err := doctor.obscureName("org2/patient")
+	if err != nil {
+		t.Fatalf("obscureName: %v", err)
+	}
+
+	record := testKeyRecord(t, admin, "Org1MSP/patient", patientName, pubkey)
+	if _, err := doctor.unpackageKeyRecord(patientName, record); err != nil {
+		t.Fatalf("unpackageKeyRecord of a pubkey stored by an admin of the user's MSP: %v", err)
+	}
+	rejected := []struct {
+		name         string
+		signer       *Client
+		identity     string
+		obscuredName string
+	}{
+		{"admin of another MSP", admin, "Org2MSP/patient", outsiderName},
+		{"identity of another user", admin, "Org1MSP/pharmacist", patientName},
+		{"no identity", admin, "", patientName},
+		{"not an admin", pharmacist, "Org1MSP/patient", patientName},
+	}
+	for _, tt := range rejected {
+		record := testKeyRecord(t, tt.signer, tt.identity, tt.obscuredName, pubkey)
+		if _, err := doctor.unpackageKeyRecord(tt.obscuredName, record); err == nil {
+			t.Fatalf("unpackageKeyRecord of a pubkey stored with %v succeeded, want an error", tt.name)
+		}
+	}
+}
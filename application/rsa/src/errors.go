@@ -0,0 +1,98 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ====================================================================//
+// Errors
+// Operations never panic. Their errors wrap one of the errors below,
+// or are a *ChaincodeError, so that callers can tell failures apart
+// with errors.Is and errors.As.
+// ====================================================================//
+
+var (
+	// ErrInvalidArgument is wrapped when an argument, such as a pid,
+	// quantity, key algorithm or prescription field, is malformed
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrKeyNotFound is wrapped when a key of the user is not in the local keystore
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrInvalidSignature is wrapped when a prescription is not signed by its
+	// prescriber, or its signature is not valid
+	ErrInvalidSignature = errors.New("invalid prescriber signature")
+
+	// ErrNotConnected is wrapped when a client calls the network before Connect
+	ErrNotConnected = errors.New("client is not connected")
+
+	// ErrRotationPending is wrapped when a key rotation may have committed, but its
+	// new key was not put in place. FinishKeyRotation settles the rotation
+	ErrRotationPending = errors.New("key rotation pending")
+)
+
+// ChaincodeError is returned when the gateway, a peer or the orderer rejects a
+// transaction, or the transaction fails to commit. It matches context.Canceled
+// and context.DeadlineExceeded if the context of the operation ended first.
+type ChaincodeError struct {
+	Transaction   string     // name of the chaincode function
+	TransactionID string     // empty if the transaction was only evaluated
+	Code          codes.Code // gRPC status, which is codes.Unknown if the transaction failed to commit
+	Details       []string   // messages of the peers and orderers that rejected the transaction
+	Err           error      // error returned by the gateway client
+}
+
+func (e *ChaincodeError) Error() string {
+	message := fmt.Sprintf("%v failed", e.Transaction)
+	if e.TransactionID != "" {
+		message += fmt.Sprintf(" for transaction %v", e.TransactionID)
+	}
+	message += fmt.Sprintf(" with gRPC status %v: %v", e.Code, e.Err)
+	for _, detail := range e.Details {
+		message += "\n- " + detail
+	}
+	return message
+}
+
+func (e *ChaincodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ChaincodeError) Is(target error) bool {
+	switch target {
+	case context.Canceled:
+		return e.Code == codes.Canceled
+	case context.DeadlineExceeded:
+		return e.Code == codes.DeadlineExceeded
+	}
+	return false
+}
+
+// wraps an error of the gateway client for the given chaincode function
+func chaincodeError(transaction string, err error) error {
+	ccErr := &ChaincodeError{Transaction: transaction, Code: status.Code(err), Err: err}
+	switch err := err.(type) {
+	case *client.EndorseError:
+		ccErr.TransactionID = err.TransactionID
+	case *client.SubmitError:
+		ccErr.TransactionID = err.TransactionID
+	case *client.CommitStatusError:
+		ccErr.TransactionID = err.TransactionID
+	case *client.CommitError:
+		ccErr.TransactionID = err.TransactionID
+	}
+	// Errors from peers or orderers behind the gateway are embedded in the gRPC status details
+	for _, detail := range status.Convert(err).Details() {
+		if detail, ok := detail.(*gateway.ErrorDetail); ok {
+			ccErr.Details = append(ccErr.Details, fmt.Sprintf("%v (%v): %v", detail.Address, detail.MspId, detail.Message))
+		}
+	}
+	return ccErr
+}
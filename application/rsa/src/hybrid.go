@@ -0,0 +1,215 @@
+package src
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// =====================================================
+// Hybrid X25519 + ML-KEM-768 Key Wrapping
+// Wraps the data key of an envelope under both X25519
+// and ML-KEM-768, so that it stays safe if either one
+// is broken. Prescriptions stay on the ledger for years,
+// so this guards against ciphertexts being recorded now
+// and decrypted once quantum computers can break X25519.
+//
+// The wrapping key is derived with HKDF-SHA256 from the
+// ML-KEM and X25519 shared secrets, bound to the
+// ephemeral X25519 pubkey, the recipient X25519 pubkey
+// and the ML-KEM ciphertext.
+//
+// Wrapped key layout:
+// ephemeral pubkey (32) | ML-KEM ciphertext (1088) |
+// nonce (12) | AES-GCM ciphertext
+//
+// The ephemeral pubkey and ML-KEM ciphertext are
+// authenticated as additional data.
+//
+// There is no standard PKIX or PKCS#8 encoding for
+// hybrid keys yet, so they are saved as:
+// pubkey:  magic "RXP" | version (1) | X25519 pubkey (32) |
+//          ML-KEM-768 encapsulation key (1184)
+// privkey: magic "RXS" | version (1) | X25519 privkey (32) |
+//          ML-KEM-768 seed (64)
+// Hybrid pubkeys must match the checks in the chaincode.
+// =====================================================
+
+var (
+	hybridPubkeyMagic  = []byte("RXP")
+	hybridPrivkeyMagic = []byte("RXS")
+)
+
+const (
+	hybridKeyVersion1 byte = 1
+	x25519KeySize          = 32
+	hybridPubkeySize       = 4 + x25519KeySize + mlkem.EncapsulationKeySize768
+	hybridPrivkeySize      = 4 + x25519KeySize + mlkem.SeedSize
+	hybridWrapInfo         = "rsa-envelope-x25519-mlkem768-v1"
+)
+
+type hybridPublicKey struct {
+	x25519 *ecdh.PublicKey
+	mlkem  *mlkem.EncapsulationKey768
+}
+
+// hybridPrivkey unwraps data keys wrapped by wrapHybrid, so that hybrid keys
+// can be used wherever an RSA crypto.Decrypter is
+type hybridPrivkey struct {
+	x25519 *ecdh.PrivateKey
+	mlkem  *mlkem.DecapsulationKey768
+}
+
+func generateHybridKey() (*hybridPrivkey, error) {
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	mlkemKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	return &hybridPrivkey{x25519: x25519Key, mlkem: mlkemKey}, nil
+}
+
+func (priv *hybridPrivkey) Public() crypto.PublicKey {
+	return &hybridPublicKey{x25519: priv.x25519.PublicKey(), mlkem: priv.mlkem.EncapsulationKey()}
+}
+
+func isHybridPubkey(data []byte) bool {
+	return bytes.HasPrefix(data, hybridPubkeyMagic)
+}
+
+func isHybridPrivkey(data []byte) bool {
+	return bytes.HasPrefix(data, hybridPrivkeyMagic)
+}
+
+func marshalHybridPubkey(pub *hybridPublicKey) []byte {
+	data := append([]byte{}, hybridPubkeyMagic...)
+	data = append(data, hybridKeyVersion1)
+	data = append(data, pub.x25519.Bytes()...)
+	return append(data, pub.mlkem.Bytes()...)
+}
+
+func parseHybridPubkey(data []byte) (*hybridPublicKey, error) {
+	if len(data) != hybridPubkeySize || !isHybridPubkey(data) || data[len(hybridPubkeyMagic)] != hybridKeyVersion1 {
+		return nil, fmt.Errorf("failed to parse hybrid pubkey")
+	}
+	data = data[len(hybridPubkeyMagic)+1:]
+	x25519Key, err := ecdh.X25519().NewPublicKey(data[:x25519KeySize])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hybrid pubkey: %v", err)
+	}
+	mlkemKey, err := mlkem.NewEncapsulationKey768(data[x25519KeySize:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hybrid pubkey: %v", err)
+	}
+	return &hybridPublicKey{x25519: x25519Key, mlkem: mlkemKey}, nil
+}
+
+func marshalHybridPrivkey(priv *hybridPrivkey) []byte {
+	data := append([]byte{}, hybridPrivkeyMagic...)
+	data = append(data, hybridKeyVersion1)
+	data = append(data, priv.x25519.Bytes()...)
+	return append(data, priv.mlkem.Bytes()...)
+}
+
+func parseHybridPrivkey(data []byte) (*hybridPrivkey, error) {
+	if len(data) != hybridPrivkeySize || !isHybridPrivkey(data) || data[len(hybridPrivkeyMagic)] != hybridKeyVersion1 {
+		return nil, fmt.Errorf("failed to parse hybrid private key")
+	}
+	data = data[len(hybridPrivkeyMagic)+1:]
+	x25519Key, err := ecdh.X25519().NewPrivateKey(data[:x25519KeySize])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hybrid private key: %v", err)
+	}
+	mlkemKey, err := mlkem.NewDecapsulationKey768(data[x25519KeySize:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hybrid private key: %v", err)
+	}
+	return &hybridPrivkey{x25519: x25519Key, mlkem: mlkemKey}, nil
+}
+
+func hybridWrapKey(mlkemShared []byte, x25519Shared []byte, ephemeral []byte, recipient []byte, mlkemCiphertext []byte) ([]byte, error) {
+	secret := append(append([]byte{}, mlkemShared...), x25519Shared...)
+	info := append([]byte(hybridWrapInfo), ephemeral...)
+	info = append(info, recipient...)
+	info = append(info, mlkemCiphertext...)
+	key := make([]byte, dataKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving wrapping key : %v", err)
+	}
+	return key, nil
+}
+
+func wrapHybrid(dataKey []byte, pub *hybridPublicKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating ephemeral key : %v", err)
+	}
+	x25519Shared, err := ephemeral.ECDH(pub.x25519)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping data key : %v", err)
+	}
+	mlkemShared, mlkemCiphertext := pub.mlkem.Encapsulate()
+	ephemeralBytes := ephemeral.PublicKey().Bytes()
+	key, err := hybridWrapKey(mlkemShared, x25519Shared, ephemeralBytes, pub.x25519.Bytes(), mlkemCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("error generating nonce : %v", err)
+	}
+	header := append(append([]byte{}, ephemeralBytes...), mlkemCiphertext...)
+	wrapped := append(append([]byte{}, header...), nonce...)
+	return gcm.Seal(wrapped, nonce, dataKey, header), nil
+}
+
+func (priv *hybridPrivkey) Decrypt(_ io.Reader, wrapped []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	headerSize := x25519KeySize + mlkem.CiphertextSize768
+	if len(wrapped) < headerSize {
+		return nil, fmt.Errorf("wrapped key is truncated")
+	}
+	header := wrapped[:headerSize]
+	ephemeralBytes := header[:x25519KeySize]
+	mlkemCiphertext := header[x25519KeySize:]
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key : %v", err)
+	}
+	x25519Shared, err := priv.x25519.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key : %v", err)
+	}
+	mlkemShared, err := priv.mlkem.Decapsulate(mlkemCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key : %v", err)
+	}
+	key, err := hybridWrapKey(mlkemShared, x25519Shared, ephemeralBytes, priv.x25519.PublicKey().Bytes(), mlkemCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	body := wrapped[headerSize:]
+	if len(body) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is truncated")
+	}
+	return gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():], header)
+}
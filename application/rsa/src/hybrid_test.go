@@ -0,0 +1,60 @@
+package src
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHybridPubkeyRoundTrip(t *testing.T) {
+	priv, err := generateHybridKey()
+	if err != nil {
+		t.Fatalf("generateHybridKey: %v", err)
+	}
+	data, err := marshalPubkey(priv.Public())
+	if err != nil {
+		t.Fatalf("marshalPubkey: %v", err)
+	}
+	pub, err := parsePubkey(data)
+	if err != nil {
+		t.Fatalf("parsePubkey: %v", err)
+	}
+	if pubkeyAlgorithm(pub) != ALGORITHM_X25519_MLKEM768 {
+		t.Fatalf("parsed pubkey algorithm = %q", pubkeyAlgorithm(pub))
+	}
+	envelope, err := encryptBytes([]byte("hybrid"), pub)
+	if err != nil {
+		t.Fatalf("encryptBytes: %v", err)
+	}
+	decrypted, err := decryptBytes(envelope, priv)
+	if err != nil {
+		t.Fatalf("decryptBytes: %v", err)
+	}
+	if !bytes.Equal(decrypted, []byte("hybrid")) {
+		t.Fatalf("decrypted %q", decrypted)
+	}
+}
+
+// a data key wrapped for a hybrid key must need both its X25519 and its ML-KEM-768 halves
+func TestHybridNeedsBothKeys(t *testing.T) {
+	priv, err := generateHybridKey()
+	if err != nil {
+		t.Fatalf("generateHybridKey: %v", err)
+	}
+	other, err := generateHybridKey()
+	if err != nil {
+		t.Fatalf("generateHybridKey: %v", err)
+	}
+	envelope, err := encryptBytes([]byte("hybrid"), priv.Public())
+	if err != nil {
+		t.Fatalf("encryptBytes: %v", err)
+	}
+	halves := map[string]*hybridPrivkey{
+		"wrong X25519 key": {x25519: other.x25519, mlkem: priv.mlkem},
+		"wrong ML-KEM key": {x25519: priv.x25519, mlkem: other.mlkem},
+	}
+	for name, key := range halves {
+		if _, err := decryptBytes(envelope, key); err == nil {
+			t.Fatalf("envelope decrypted with %v", name)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package src
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// =====================================================
+// Keystores
+// A keystore holds the private keys of a machine's users:
+// the Fabric enrollment keys that transactions are signed
+// with, and the RSA keys that prescriptions are
+// decrypted with, which are RSA, X25519 or hybrid keys. These
+// are named by the obscured name of their user and a
+// key name, such as privFilename. Pubkeys are not secret, and are always
+// saved as files in the key folder.
+// =====================================================
+
+type Keystore interface {
+	// returns a sign function for the enrollment key of the identity
+	EnrollmentSign(id *Identity) (identity.Sign, error)
+	// returns a private key, which unwraps envelope data keys
+	Privkey(obscureName string, keyName string) (crypto.Decrypter, error)
+	// generates and stores a new private key with the given algorithm, returning its pubkey
+	GeneratePrivkey(obscureName string, keyName string, algorithm string) (crypto.PublicKey, error)
+	// stores an existing private key, replacing any key with the same name
+	StorePrivkey(obscureName string, keyName string, privkey crypto.PrivateKey) error
+	// renames a private key, replacing any key with the new name
+	MovePrivkey(oldObscureName string, oldKeyName string, newObscureName string, newKeyName string) error
+	DeletePrivkey(obscureName string, keyName string) error
+}
+
+// keystores which lock private keys with a passphrase, and can export them still locked
+type keyExporter interface {
+	ExportPrivkey(obscureName string, keyName string) ([]byte, error)
+	unlockKeyBytes(locked []byte) ([]byte, error)
+}
+
+const (
+	KEYSTORE_FILE      = "file"
+	KEYSTORE_ENCRYPTED = "encrypted"
+	KEYSTORE_PKCS11    = "pkcs11"
+)
+
+// opens a keystore by its kind. PKCS#11 keystores are configured from the environment
+func OpenKeystore(kind string) (Keystore, error) {
+	switch kind {
+	case KEYSTORE_FILE:
+		return &FileKeystore{}, nil
+	case KEYSTORE_ENCRYPTED:
+		return &EncryptedFileKeystore{}, nil
+	case KEYSTORE_PKCS11:
+		return openPKCS11Keystore()
+	default:
+		return nil, fmt.Errorf("unknown keystore '%v'", kind)
+	}
+}
+
+// FileKeystore keeps private keys as unencrypted files in the key folder,
+// and reads the enrollment key from the user's MSP keystore folder. Locked keys are
+// still read, with the keystore passphrase. The zero value is ready to use.
+type FileKeystore struct {
+	// Folder holds the key files, which is rsakeys by default
+	Folder string
+	// Passphrase unlocks locked keys. If nil, it is read from RSA_KEY_PASSPHRASE,
+	// or prompted for, when first needed
+	Passphrase []byte
+
+	mutex    sync.Mutex
+	unlocked map[string]crypto.Decrypter // keys unlocked so far, by path
+}
+
+func (ks *FileKeystore) folder() string {
+	if ks.Folder == "" {
+		return keyfolder
+	}
+	return ks.Folder
+}
+
+func (ks *FileKeystore) EnrollmentSign(id *Identity) (identity.Sign, error) {
+	privateKey, err := loadSignature(id.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := privateKey.(*ecdsa.PrivateKey); ok {
+		return identity.NewPrivateKeySign(privateKey)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("enrollment key of type %T cannot sign", privateKey)
+	}
+	return func(digest []byte) ([]byte, error) {
+		return signer.Sign(rand.Reader, digest, crypto.SHA256)
+	}, nil
+}
+
+func (ks *FileKeystore) Privkey(obscureName string, keyName string) (crypto.Decrypter, error) {
+	pbytes, err := readLocalKey(ks.folder(), obscureName, keyName)
+	if err != nil {
+		return nil, err
+	}
+	var privkey crypto.Decrypter
+	if isLockedKey(pbytes) {
+		privkey, err = ks.unlockPrivkey(filepath.Join(ks.folder(), obscureName, keyName), pbytes)
+	} else {
+		privkey, err = parsePrivkey(pbytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return privkey, nil
+}
+
+func (ks *FileKeystore) GeneratePrivkey(obscureName string, keyName string, algorithm string) (crypto.PublicKey, error) {
+	privkey, pubkey, err := generatePrivkey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	err = ks.StorePrivkey(obscureName, keyName, privkey)
+	if err != nil {
+		return nil, err
+	}
+	return pubkey, nil
+}
+
+func (ks *FileKeystore) StorePrivkey(obscureName string, keyName string, privkey crypto.PrivateKey) error {
+	data, err := marshalPrivkey(privkey)
+	if err != nil {
+		return err
+	}
+	return ks.saveLocalPrivkey(data, obscureName, keyName)
+}
+
+func (ks *FileKeystore) MovePrivkey(oldObscureName string, oldKeyName string, newObscureName string, newKeyName string) error {
+	newPath := filepath.Join(ks.folder(), newObscureName, newKeyName)
+	err := os.MkdirAll(filepath.Dir(newPath), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create key folder: %v", err)
+	}
+	oldPath := filepath.Join(ks.folder(), oldObscureName, oldKeyName)
+	err = os.Rename(oldPath, newPath)
+	if err != nil {
+		return fmt.Errorf("failed to move private key: %v", err)
+	}
+	ks.forgetUnlockedKey(oldPath)
+	ks.forgetUnlockedKey(newPath)
+	return nil
+}
+
+func (ks *FileKeystore) DeletePrivkey(obscureName string, keyName string) error {
+	path := filepath.Join(ks.folder(), obscureName, keyName)
+	ks.forgetUnlockedKey(path)
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete private key: %v", err)
+	}
+	return nil
+}
+
+func (ks *FileKeystore) ExportPrivkey(obscureName string, keyName string) ([]byte, error) {
+	data, err := readLocalKey(ks.folder(), obscureName, keyName)
+	if err != nil {
+		return nil, err
+	}
+	if !isLockedKey(data) {
+		return ks.lockPrivkey(data)
+	}
+	// Check that the key can be unlocked, so that it is not exported with a wrong passphrase
+	_, err = ks.unlockKeyBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// EncryptedFileKeystore is a FileKeystore which locks RSA private keys with the
+// keystore passphrase before they are saved
+type EncryptedFileKeystore struct {
+	FileKeystore
+}
+
+func (ks *EncryptedFileKeystore) GeneratePrivkey(obscureName string, keyName string, algorithm string) (crypto.PublicKey, error) {
+	privkey, pubkey, err := generatePrivkey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	err = ks.StorePrivkey(obscureName, keyName, privkey)
+	if err != nil {
+		return nil, err
+	}
+	return pubkey, nil
+}
+
+func (ks *EncryptedFileKeystore) StorePrivkey(obscureName string, keyName string, privkey crypto.PrivateKey) error {
+	data, err := marshalPrivkey(privkey)
+	if err != nil {
+		return err
+	}
+	locked, err := ks.lockPrivkey(data)
+	if err != nil {
+		return err
+	}
+	return ks.saveLocalPrivkey(locked, obscureName, keyName)
+}
+
+// saves a private key file, dropping any unlocked copy of the key it replaces
+func (ks *FileKeystore) saveLocalPrivkey(data []byte, obscureName string, keyName string) error {
+	ks.forgetUnlockedKey(filepath.Join(ks.folder(), obscureName, keyName))
+	return saveLocalKey(ks.folder(), data, obscureName, keyName)
+}
+
+// =====================================================
+// Key Locking
+// Private keys are saved locked with a key derived from
+// the keystore passphrase with scrypt, and encrypted
+// with AES-256-GCM. Unless the keystore was given a
+// passphrase, it is read from RSA_KEY_PASSPHRASE, or
+// prompted for once per keystore.
+//
+// Locked key layout (version 1):
+// magic (3) | version (1) | log2 N (1) | r (1) | p (1) |
+// salt (16) | nonce (12) | AES-GCM ciphertext
+//
+// The header is authenticated as additional data.
+// Key files without the magic prefix are read as
+// unencrypted PKCS#8, as saved by earlier versions.
+// =====================================================
+
+var lockedKeyMagic = []byte("RXK")
+
+const (
+	lockedKeyVersion1    byte = 1
+	lockedKeyHeaderSize       = 7
+	lockedKeySaltSize         = 16
+	scryptLogN           byte = 15
+	scryptR              byte = 8
+	scryptP              byte = 1
+	passphraseEnv             = "RSA_KEY_PASSPHRASE"
+	minPassphraseLength       = 8
+	exportedKeyBlockType      = "RSA KEYSTORE KEY"
+)
+
+func isLockedKey(data []byte) bool {
+	return bytes.HasPrefix(data, lockedKeyMagic)
+}
+
+// returns the keystore passphrase, prompting for it if it is not in the environment.
+// must be called with the mutex held
+func (ks *FileKeystore) getPassphrase() ([]byte, error) {
+	if ks.Passphrase != nil {
+		return ks.Passphrase, nil
+	}
+	passphrase := []byte(os.Getenv(passphraseEnv))
+	if len(passphrase) == 0 {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, fmt.Errorf("no keystore passphrase: set %v, or run from a terminal", passphraseEnv)
+		}
+		fmt.Fprint(os.Stderr, "Keystore passphrase: ")
+		var err error
+		passphrase, err = term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keystore passphrase: %v", err)
+		}
+	}
+	if len(passphrase) < minPassphraseLength {
+		return nil, fmt.Errorf("keystore passphrase must be at least %v characters", minPassphraseLength)
+	}
+	ks.Passphrase = passphrase
+	return passphrase, nil
+}
+
+func deriveKeystoreKey(passphrase []byte, header []byte) ([]byte, error) {
+	logN, r, p := header[len(lockedKeyMagic)+1], header[len(lockedKeyMagic)+2], header[len(lockedKeyMagic)+3]
+	if logN > 20 {
+		return nil, fmt.Errorf("keystore key derivation cost is too high")
+	}
+	if r == 0 || p == 0 {
+		return nil, fmt.Errorf("keystore key derivation parameters are invalid")
+	}
+	salt := header[lockedKeyHeaderSize:]
+	return scrypt.Key(passphrase, salt, 1<<logN, int(r), int(p), dataKeySize)
+}
+
+// encrypts a PKCS#8 private key with the keystore passphrase
+func (ks *FileKeystore) lockPrivkey(pkcs8 []byte) ([]byte, error) {
+	ks.mutex.Lock()
+	passphrase, err := ks.getPassphrase()
+	ks.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte{}, lockedKeyMagic...)
+	header = append(header, lockedKeyVersion1, scryptLogN, scryptR, scryptP)
+	salt := make([]byte, lockedKeySaltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+	key, err := deriveKeystoreKey(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	locked := append(header, nonce...)
+	return gcm.Seal(locked, nonce, pkcs8, header), nil
+}
+
+// decrypts a locked key with the keystore passphrase, returning the PKCS#8 private key
+func (ks *FileKeystore) unlockKeyBytes(locked []byte) ([]byte, error) {
+	headerSize := lockedKeyHeaderSize + lockedKeySaltSize
+	if len(locked) < headerSize || !isLockedKey(locked) {
+		return nil, fmt.Errorf("key is not a locked keystore key")
+	}
+	if locked[len(lockedKeyMagic)] != lockedKeyVersion1 {
+		return nil, fmt.Errorf("unsupported keystore version %v", locked[len(lockedKeyMagic)])
+	}
+	ks.mutex.Lock()
+	passphrase, err := ks.getPassphrase()
+	ks.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	header := locked[:headerSize]
+	key, err := deriveKeystoreKey(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(locked) < headerSize+gcm.NonceSize() {
+		return nil, fmt.Errorf("locked key is truncated")
+	}
+	nonce := locked[headerSize : headerSize+gcm.NonceSize()]
+	pkcs8, err := gcm.Open(nil, nonce, locked[headerSize+gcm.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock key, the passphrase may be wrong")
+	}
+	return pkcs8, nil
+}
+
+// unlocks the key saved at path. unlocked keys are kept in memory for the life of the keystore
+func (ks *FileKeystore) unlockPrivkey(path string, locked []byte) (crypto.Decrypter, error) {
+	ks.mutex.Lock()
+	privkey, exists := ks.unlocked[path]
+	ks.mutex.Unlock()
+	if exists {
+		return privkey, nil
+	}
+	pkcs8, err := ks.unlockKeyBytes(locked)
+	if err != nil {
+		return nil, err
+	}
+	privkey, err = parsePrivkey(pkcs8)
+	if err != nil {
+		return nil, err
+	}
+	ks.mutex.Lock()
+	if ks.unlocked == nil {
+		ks.unlocked = make(map[string]crypto.Decrypter)
+	}
+	ks.unlocked[path] = privkey
+	ks.mutex.Unlock()
+	return privkey, nil
+}
+
+func (ks *FileKeystore) forgetUnlockedKey(path string) {
+	ks.mutex.Lock()
+	delete(ks.unlocked, path)
+	ks.mutex.Unlock()
+}
+
+// ===============================================
+// Import & Export Key
+// Keys are exported still locked, as PEM, so they
+// can be moved between machines that share the
+// passphrase. Imports also accept unencrypted
+// PKCS#8 keys, in PEM or DER. Imported keys are
+// stored in the client's keystore. Keys cannot be
+// exported from keystores that keep them in
+// hardware.
+// ===============================================
+
+func (c *Client) ExportKey(username string, filename string) error {
+	exporter, ok := c.keystore.(keyExporter)
+	if !ok {
+		return fmt.Errorf("keys cannot be exported from a %T", c.keystore)
+	}
+	obscureName, err := c.obscureName(username)
+	if err != nil {
+		return err
+	}
+	data, err := exporter.ExportPrivkey(obscureName, privFilename)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: exportedKeyBlockType, Bytes: data}), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write exported key: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) ImportKey(username string, filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %v", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	var pkcs8 []byte
+	if isLockedKey(data) {
+		// Keystores without a passphrase of their own unlock with the default passphrase
+		unlocker, ok := c.keystore.(keyExporter)
+		if !ok {
+			unlocker = &FileKeystore{}
+		}
+		pkcs8, err = unlocker.unlockKeyBytes(data)
+		if err != nil {
+			return err
+		}
+	} else {
+		pkcs8 = data
+	}
+	privkey, err := parsePrivkey(pkcs8)
+	if err != nil {
+		return err
+	}
+	obscureName, err := c.obscureName(username)
+	if err != nil {
+		return err
+	}
+	err = c.keystore.StorePrivkey(obscureName, privFilename, privkey)
+	if err != nil {
+		return err
+	}
+	return c.savePubkey(privkey.Public(), obscureName, pubFilename)
+}
@@ -0,0 +1,11 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package src
+
+import "fmt"
+
+// PKCS#11 support needs cgo, so it is only built with the pkcs11 build tag
+func openPKCS11Keystore() (Keystore, error) {
+	return nil, fmt.Errorf("PKCS#11 keystores are not supported by this build, rebuild with -tags pkcs11")
+}
@@ -0,0 +1,414 @@
+//go:build pkcs11
+// +build pkcs11
+
+package src
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"github.com/miekg/pkcs11"
+)
+
+// =====================================================
+// PKCS#11 Keystore
+// Keeps private keys in an HSM, or in SoftHSM for
+// development. Keys are generated in the token and never
+// leave it: RSA keys are sensitive and unextractable,
+// and decryption and signing are done by the token.
+//
+// RSA keys are labelled "<obscured name>/<key name>".
+// The enrollment key is found by its CKA_ID, which is
+// the SKI of the enrollment cert's pubkey, as set by
+// the Fabric CA client and peers using PKCS#11.
+//
+// The token is configured from the environment:
+// PKCS11_LIB is the path to the PKCS#11 library,
+// PKCS11_TOKEN is the token label, and PKCS11_PIN is
+// the user PIN.
+// =====================================================
+
+const (
+	pkcs11LibEnv   = "PKCS11_LIB"
+	pkcs11TokenEnv = "PKCS11_TOKEN"
+	pkcs11PinEnv   = "PKCS11_PIN"
+)
+
+type PKCS11Keystore struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	// PKCS#11 operations on a session must not be interleaved
+	mutex sync.Mutex
+}
+
+func openPKCS11Keystore() (Keystore, error) {
+	library, token, pin := os.Getenv(pkcs11LibEnv), os.Getenv(pkcs11TokenEnv), os.Getenv(pkcs11PinEnv)
+	if library == "" || token == "" || pin == "" {
+		return nil, fmt.Errorf("PKCS#11 keystores need %v, %v and %v to be set", pkcs11LibEnv, pkcs11TokenEnv, pkcs11PinEnv)
+	}
+	return NewPKCS11Keystore(library, token, pin)
+}
+
+// logs in to the token with the given label. the keystore must be closed when no longer needed
+func NewPKCS11Keystore(library string, tokenLabel string, pin string) (*PKCS11Keystore, error) {
+	ctx := pkcs11.New(library)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 library %v", library)
+	}
+	err := ctx.Initialize()
+	if err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 library: %v", err)
+	}
+	ks := &PKCS11Keystore{ctx: ctx}
+	slot, err := ks.findSlot(tokenLabel)
+	if err != nil {
+		ks.finalize()
+		return nil, err
+	}
+	ks.session, err = ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		ks.finalize()
+		return nil, fmt.Errorf("failed to open PKCS#11 session: %v", err)
+	}
+	err = ctx.Login(ks.session, pkcs11.CKU_USER, pin)
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		ctx.CloseSession(ks.session)
+		ks.finalize()
+		return nil, fmt.Errorf("failed to log in to PKCS#11 token: %v", err)
+	}
+	return ks, nil
+}
+
+func (ks *PKCS11Keystore) Close() error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	ks.ctx.Logout(ks.session)
+	err := ks.ctx.CloseSession(ks.session)
+	ks.finalize()
+	return err
+}
+
+func (ks *PKCS11Keystore) finalize() {
+	ks.ctx.Finalize()
+	ks.ctx.Destroy()
+}
+
+func (ks *PKCS11Keystore) findSlot(tokenLabel string) (uint, error) {
+	slots, err := ks.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PKCS#11 slots: %v", err)
+	}
+	for _, slot := range slots {
+		info, err := ks.ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if info.Label == tokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("PKCS#11 token '%v' not found", tokenLabel)
+}
+
+// returns the handles of every object matching the template. must be called with the mutex held
+func (ks *PKCS11Keystore) findObjects(template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	err := ks.ctx.FindObjectsInit(ks.session, template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search PKCS#11 token: %v", err)
+	}
+	defer ks.ctx.FindObjectsFinal(ks.session)
+	var handles []pkcs11.ObjectHandle
+	for {
+		found, _, err := ks.ctx.FindObjects(ks.session, 16)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search PKCS#11 token: %v", err)
+		}
+		if len(found) == 0 {
+			return handles, nil
+		}
+		handles = append(handles, found...)
+	}
+}
+
+func pkcs11KeyLabel(obscureName string, keyName string) string {
+	return obscureName + "/" + keyName
+}
+
+func privkeyTemplate(label string) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+}
+
+// must be called with the mutex held
+func (ks *PKCS11Keystore) findPrivkey(obscureName string, keyName string) (pkcs11.ObjectHandle, error) {
+	handles, err := ks.findObjects(privkeyTemplate(pkcs11KeyLabel(obscureName, keyName)))
+	if err != nil {
+		return 0, err
+	}
+	if len(handles) == 0 {
+		return 0, fmt.Errorf("%w: private key %v of user %v not found in PKCS#11 token", ErrKeyNotFound, keyName, obscureName)
+	}
+	return handles[0], nil
+}
+
+// must be called with the mutex held
+func (ks *PKCS11Keystore) destroyPrivkeys(label string) error {
+	handles, err := ks.findObjects(privkeyTemplate(label))
+	if err != nil {
+		return err
+	}
+	for _, handle := range handles {
+		err = ks.ctx.DestroyObject(ks.session, handle)
+		if err != nil {
+			return fmt.Errorf("failed to delete private key from PKCS#11 token: %v", err)
+		}
+	}
+	return nil
+}
+
+// reads the pubkey of an RSA private key. must be called with the mutex held
+func (ks *PKCS11Keystore) rsaPubkey(handle pkcs11.ObjectHandle) (*rsa.PublicKey, error) {
+	attributes, err := ks.ctx.GetAttributeValue(ks.session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RSA pubkey from PKCS#11 token: %v", err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attributes[0].Value),
+		E: int(new(big.Int).SetBytes(attributes[1].Value).Int64()),
+	}, nil
+}
+
+func (ks *PKCS11Keystore) Privkey(obscureName string, keyName string) (crypto.Decrypter, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	handle, err := ks.findPrivkey(obscureName, keyName)
+	if err != nil {
+		return nil, err
+	}
+	pubkey, err := ks.rsaPubkey(handle)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Privkey{ks: ks, handle: handle, pubkey: pubkey}, nil
+}
+
+// only RSA keys are supported, as X25519 needs PKCS#11 3.0
+func (ks *PKCS11Keystore) GeneratePrivkey(obscureName string, keyName string, algorithm string) (crypto.PublicKey, error) {
+	if algorithm != ALGORITHM_RSA {
+		return nil, fmt.Errorf("PKCS#11 keystores only support %v keys", ALGORITHM_RSA)
+	}
+	label := pkcs11KeyLabel(obscureName, keyName)
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	old, err := ks.findObjects(privkeyTemplate(label))
+	if err != nil {
+		return nil, err
+	}
+	// The public key object is only kept for the session, as pubkeys are saved as files
+	public := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, RSA_BYTES),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+	}
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	pubHandle, privHandle, err := ks.ctx.GenerateKeyPair(ks.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}, public, private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key pair in PKCS#11 token: %v", err)
+	}
+	defer ks.ctx.DestroyObject(ks.session, pubHandle)
+	pubkey, err := ks.rsaPubkey(privHandle)
+	if err != nil {
+		return nil, err
+	}
+	// Keys with the same label are only deleted once the new key exists
+	for _, handle := range old {
+		ks.ctx.DestroyObject(ks.session, handle)
+	}
+	return pubkey, nil
+}
+
+func (ks *PKCS11Keystore) StorePrivkey(obscureName string, keyName string, key crypto.PrivateKey) error {
+	privkey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("PKCS#11 keystores only support %v keys", ALGORITHM_RSA)
+	}
+	if len(privkey.Primes) != 2 {
+		return fmt.Errorf("only two-prime RSA keys can be stored in a PKCS#11 token")
+	}
+	privkey.Precompute()
+	label := pkcs11KeyLabel(obscureName, keyName)
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	old, err := ks.findObjects(privkeyTemplate(label))
+	if err != nil {
+		return err
+	}
+	_, err = ks.ctx.CreateObject(ks.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, privkey.N.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(privkey.E)).Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, privkey.D.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, privkey.Primes[0].Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, privkey.Primes[1].Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, privkey.Precomputed.Dp.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, privkey.Precomputed.Dq.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, privkey.Precomputed.Qinv.Bytes()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store private key in PKCS#11 token: %v", err)
+	}
+	for _, handle := range old {
+		ks.ctx.DestroyObject(ks.session, handle)
+	}
+	return nil
+}
+
+func (ks *PKCS11Keystore) MovePrivkey(oldObscureName string, oldKeyName string, newObscureName string, newKeyName string) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	handle, err := ks.findPrivkey(oldObscureName, oldKeyName)
+	if err != nil {
+		return err
+	}
+	newLabel := pkcs11KeyLabel(newObscureName, newKeyName)
+	err = ks.destroyPrivkeys(newLabel)
+	if err != nil {
+		return err
+	}
+	err = ks.ctx.SetAttributeValue(ks.session, handle, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, newLabel)})
+	if err != nil {
+		return fmt.Errorf("failed to rename private key in PKCS#11 token: %v", err)
+	}
+	return nil
+}
+
+func (ks *PKCS11Keystore) DeletePrivkey(obscureName string, keyName string) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	return ks.destroyPrivkeys(pkcs11KeyLabel(obscureName, keyName))
+}
+
+// =====================================================
+// PKCS#11 Decryption
+// Only RSA-OAEP with SHA-256 is supported, as used by
+// envelope encryption.
+// =====================================================
+
+type pkcs11Privkey struct {
+	ks     *PKCS11Keystore
+	handle pkcs11.ObjectHandle
+	pubkey *rsa.PublicKey
+}
+
+func (key *pkcs11Privkey) Public() crypto.PublicKey {
+	return key.pubkey
+}
+
+func (key *pkcs11Privkey) Decrypt(_ io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	oaep, ok := opts.(*rsa.OAEPOptions)
+	if !ok || oaep.Hash != crypto.SHA256 || len(oaep.Label) != 0 {
+		return nil, fmt.Errorf("PKCS#11 keys only decrypt RSA-OAEP with SHA-256")
+	}
+	params := pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, nil)
+	key.ks.mutex.Lock()
+	defer key.ks.mutex.Unlock()
+	err := key.ks.ctx.DecryptInit(key.ks.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)}, key.handle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start PKCS#11 decryption: %v", err)
+	}
+	plaintext, err := key.ks.ctx.Decrypt(key.ks.session, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 decryption failed: %v", err)
+	}
+	return plaintext, nil
+}
+
+// =====================================================
+// PKCS#11 Enrollment Signing
+// The token signs digests with CKM_ECDSA, which returns
+// r and s concatenated. Fabric needs ASN.1 signatures
+// with low S values.
+// =====================================================
+
+func (ks *PKCS11Keystore) EnrollmentSign(id *Identity) (identity.Sign, error) {
+	cert, err := loadCertificate(id.CertPath)
+	if err != nil {
+		return nil, err
+	}
+	pubkey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("PKCS#11 enrollment keys must be ECDSA keys, not %T", cert.PublicKey)
+	}
+	ski := sha256.Sum256(elliptic.Marshal(pubkey.Curve, pubkey.X, pubkey.Y))
+	ks.mutex.Lock()
+	handles, err := ks.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, ski[:]),
+	})
+	ks.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(handles) == 0 {
+		return nil, fmt.Errorf("%w: enrollment key of %v not found in PKCS#11 token", ErrKeyNotFound, id.UserId)
+	}
+	handle := handles[0]
+	order := pubkey.Curve.Params().N
+	return func(digest []byte) ([]byte, error) {
+		ks.mutex.Lock()
+		defer ks.mutex.Unlock()
+		err := ks.ctx.SignInit(ks.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, handle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start PKCS#11 signing: %v", err)
+		}
+		signature, err := ks.ctx.Sign(ks.session, digest)
+		if err != nil {
+			return nil, fmt.Errorf("PKCS#11 signing failed: %v", err)
+		}
+		return lowSSignature(signature, order)
+	}, nil
+}
+
+// converts a concatenated r and s signature to ASN.1, with s in the lower half of the curve order
+func lowSSignature(signature []byte, order *big.Int) ([]byte, error) {
+	half := len(signature) / 2
+	r := new(big.Int).SetBytes(signature[:half])
+	s := new(big.Int).SetBytes(signature[half:])
+	if s.Cmp(new(big.Int).Rsh(order, 1)) > 0 {
+		s.Sub(order, s)
+	}
+	return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+}
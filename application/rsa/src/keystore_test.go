@@ -0,0 +1,75 @@
+package src
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLockUnlockRoundTrip(t *testing.T) {
+	ks := &FileKeystore{Passphrase: []byte("correct horse battery")}
+	pkcs8 := []byte("not really a PKCS#8 key, but any bytes can be locked")
+	locked, err := ks.lockPrivkey(pkcs8)
+	if err != nil {
+		t.Fatalf("lockPrivkey: %v", err)
+	}
+	if !isLockedKey(locked) || bytes.Contains(locked, pkcs8) {
+		t.Fatalf("lockPrivkey = %x, want a locked key without the plaintext", locked)
+	}
+	again, err := ks.lockPrivkey(pkcs8)
+	if err != nil {
+		t.Fatalf("lockPrivkey: %v", err)
+	}
+	if bytes.Equal(locked, again) {
+		t.Fatalf("locking the same key twice gave the same bytes, want a fresh salt and nonce")
+	}
+	unlocked, err := ks.unlockKeyBytes(locked)
+	if err != nil {
+		t.Fatalf("unlockKeyBytes: %v", err)
+	}
+	if !bytes.Equal(unlocked, pkcs8) {
+		t.Fatalf("unlockKeyBytes = %q, want %q", unlocked, pkcs8)
+	}
+}
+
+func TestUnlockWrongPassphrase(t *testing.T) {
+	ks := &FileKeystore{Passphrase: []byte("correct horse battery")}
+	locked, err := ks.lockPrivkey([]byte("secret key"))
+	if err != nil {
+		t.Fatalf("lockPrivkey: %v", err)
+	}
+	other := &FileKeystore{Passphrase: []byte("incorrect horse battery")}
+	if unlocked, err := other.unlockKeyBytes(locked); err == nil {
+		t.Fatalf("unlockKeyBytes with the wrong passphrase = %q, want an error", unlocked)
+	}
+}
+
+func TestUnlockCorrupted(t *testing.T) {
+	ks := &FileKeystore{Passphrase: []byte("correct horse battery")}
+	locked, err := ks.lockPrivkey([]byte("secret key"))
+	if err != nil {
+		t.Fatalf("lockPrivkey: %v", err)
+	}
+	// every byte of the header is either checked or authenticated, as are the nonce and ciphertext
+	headerSize := lockedKeyHeaderSize + lockedKeySaltSize
+	positions := []int{headerSize, len(locked) - 1}
+	for i := 0; i < headerSize; i++ {
+		positions = append(positions, i)
+	}
+	for _, i := range positions {
+		corrupted := append([]byte{}, locked...)
+		corrupted[i] ^= 0x01
+		if unlocked, err := ks.unlockKeyBytes(corrupted); err == nil {
+			t.Fatalf("unlockKeyBytes with byte %v changed = %q, want an error", i, unlocked)
+		}
+	}
+	expensive := append([]byte{}, locked...)
+	expensive[len(lockedKeyMagic)+1] = 40
+	if _, err := ks.unlockKeyBytes(expensive); err == nil {
+		t.Fatalf("unlockKeyBytes accepted a key derivation cost of 2^40")
+	}
+	for _, size := range []int{0, len(lockedKeyMagic), headerSize, len(locked) - 1} {
+		if _, err := ks.unlockKeyBytes(locked[:size]); err == nil {
+			t.Fatalf("unlockKeyBytes accepted a key truncated to %v bytes", size)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric-gateway/pkg/client"
@@ -16,67 +17,65 @@ import (
 	"google.golang.org/grpc/credentials"
 )
 
-var (
-	orgName      string
-	userId       string
-	mspId        string
-	orgUrl       string
-	userUrl      string
-	cryptoPath   string
-	certPath     string
-	keyPath      string
-	tlsCertPath  string
-	peerEndpoint string
-	gatewayPeer  string
-	channelName  string
-)
-
 const chaincodeName = "rsa"
 
-func SetConnectionVariables(newOrg string, newUserId string, peerPort string) {
-	orgName = newOrg
-	userId = newUserId
-	mspId = cases.Title(language.Und).String(orgName) + "MSP"
-	orgUrl = orgName + ".example.com"
-	userUrl = userId + "@" + orgUrl
-	cryptoPath = "../../test-network/organizations/peerOrganizations/" + orgUrl
-	certPath = cryptoPath + "/users/" + userUrl + "/msp/signcerts/cert.pem"
-	keyPath = cryptoPath + "/users/" + userUrl + "/msp/keystore/"
-	tlsCertPath = cryptoPath + "/peers/peer0." + orgUrl + "/tls/ca.crt"
-	peerEndpoint = peerPort
-	gatewayPeer = "peer0." + orgUrl
-	channelName = "mychannel"
+// Identity is a Fabric user, and the peer whose gateway they connect through.
+// Paths are those of the test network.
+type Identity struct {
+	OrgName      string
+	UserId       string
+	MspId        string
+	CertPath     string
+	KeyPath      string
+	TLSCertPath  string
+	PeerEndpoint string
+	GatewayPeer  string
+	ChannelName  string
+}
+
+func NewIdentity(org string, userId string, peerPort string) *Identity {
+	orgUrl := org + ".example.com"
+	userUrl := userId + "@" + orgUrl
+	cryptoPath := "../../test-network/organizations/peerOrganizations/" + orgUrl
+	return &Identity{
+		OrgName:      org,
+		UserId:       userId,
+		MspId:        mspIdOf(org),
+		CertPath:     cryptoPath + "/users/" + userUrl + "/msp/signcerts/cert.pem",
+		KeyPath:      cryptoPath + "/users/" + userUrl + "/msp/keystore/",
+		TLSCertPath:  cryptoPath + "/peers/peer0." + orgUrl + "/tls/ca.crt",
+		PeerEndpoint: peerPort,
+		GatewayPeer:  "peer0." + orgUrl,
+		ChannelName:  "mychannel",
+	}
 }
 
-func PrintConnectionVariables() {
+func (id *Identity) Print() {
 	fmt.Println("==========================")
-	fmt.Printf("orgName: %v\n", orgName)
-	fmt.Printf("userId: %v\n", userId)
-	fmt.Printf("mspId: %v\n", mspId)
-	fmt.Printf("orgUrl: %v\n", orgUrl)
-	fmt.Printf("userUrl: %v\n", userUrl)
-	fmt.Printf("cryptoPath: %v\n", cryptoPath)
-	fmt.Printf("certPath: %v\n", certPath)
-	fmt.Printf("keyPath: %v\n", keyPath)
-	fmt.Printf("tlsCertPath: %v\n", tlsCertPath)
-	fmt.Printf("peerEndpoint: %v\n", peerEndpoint)
-	fmt.Printf("gatewayPeer: %v\n", gatewayPeer)
-	fmt.Printf("channelName: %v\n", channelName)
+	fmt.Printf("orgName: %v\n", id.OrgName)
+	fmt.Printf("userId: %v\n", id.UserId)
+	fmt.Printf("mspId: %v\n", id.MspId)
+	fmt.Printf("certPath: %v\n", id.CertPath)
+	fmt.Printf("keyPath: %v\n", id.KeyPath)
+	fmt.Printf("tlsCertPath: %v\n", id.TLSCertPath)
+	fmt.Printf("peerEndpoint: %v\n", id.PeerEndpoint)
+	fmt.Printf("gatewayPeer: %v\n", id.GatewayPeer)
+	fmt.Printf("channelName: %v\n", id.ChannelName)
 	fmt.Println("==========================")
 }
 
 // newGrpcConnection creates a gRPC connection to the Gateway server.
-func NewGrpcConnection() (*grpc.ClientConn, error) {
-	certificate, err := loadCertificate(tlsCertPath)
+func newGrpcConnection(id *Identity) (*grpc.ClientConn, error) {
+	certificate, err := loadCertificate(id.TLSCertPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load certificate:%v", err)
 	}
 
 	certPool := x509.NewCertPool()
 	certPool.AddCert(certificate)
-	transportCredentials := credentials.NewClientTLSFromCert(certPool, gatewayPeer)
+	transportCredentials := credentials.NewClientTLSFromCert(certPool, id.GatewayPeer)
 
-	connection, err := grpc.Dial(peerEndpoint, grpc.WithTransportCredentials(transportCredentials))
+	connection, err := grpc.Dial(id.PeerEndpoint, grpc.WithTransportCredentials(transportCredentials))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gRPC connection: %w", err)
 	}
@@ -85,18 +84,12 @@ func NewGrpcConnection() (*grpc.ClientConn, error) {
 }
 
 // newIdentity creates a client identity for this Gateway connection using an X.509 certificate.
-func newIdentity() *identity.X509Identity {
-	certificate, err := loadCertificate(certPath)
-	if err != nil {
-		panic(err)
-	}
-
-	id, err := identity.NewX509Identity(mspId, certificate)
+func newIdentity(id *Identity) (*identity.X509Identity, error) {
+	certificate, err := loadCertificate(id.CertPath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	return id
+	return identity.NewX509Identity(id.MspId, certificate)
 }
 
 func loadCertificate(filename string) (*x509.Certificate, error) {
@@ -114,6 +107,9 @@ func loadSignature(filepath string) (crypto.PrivateKey, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read private key directory: %w", err)
 	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w: no enrollment key in %v", ErrKeyNotFound, filepath)
+	}
 	privateKeyPEM, err := os.ReadFile(path.Join(filepath, files[0].Name()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read private key file: %w", err)
@@ -125,25 +121,24 @@ func loadSignature(filepath string) (crypto.PrivateKey, error) {
 	return privateKey, nil
 }
 
-func newSign() identity.Sign {
-	privateKey, err := loadSignature(keyPath)
+// the enrollment key is read from the keystore
+func newSign(id *Identity, keystore Keystore) (identity.Sign, error) {
+	return keystore.EnrollmentSign(id)
+}
+
+func newGateway(id *Identity, keystore Keystore, clientConnection *grpc.ClientConn) (*client.Gateway, error) {
+	x509Identity, err := newIdentity(id)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	sign, err := identity.NewPrivateKeySign(privateKey)
+	sign, err := newSign(id, keystore)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return sign
-}
-
-func DefaultGateway(clientConnection *grpc.ClientConn) (*client.Gateway, error) {
-	id := newIdentity()
-	sign := newSign()
 
 	// Create a Gateway connection for a specific client identity
 	return client.Connect(
-		id,
+		x509Identity,
 		client.WithSign(sign),
 		client.WithClientConnection(clientConnection),
 		// Default timeouts for different gRPC calls
@@ -155,11 +150,57 @@ func DefaultGateway(clientConnection *grpc.ClientConn) (*client.Gateway, error)
 
 }
 
-func SmartContract(gw *client.Gateway) *client.Contract {
-	network := gw.GetNetwork(channelName)
+func smartContract(id *Identity, gw *client.Gateway) *client.Contract {
+	network := gw.GetNetwork(id.ChannelName)
 	return network.GetContract(chaincodeName)
 }
 
-func currentUserObscure() string {
-	return obscureName(userId)
+// ====================================================
+// User Identity
+// Users are identified by MSP ID and enrollment ID, so
+// that users with the same name in different orgs are
+// kept apart. Must match identityName in the chaincode.
+// ====================================================
+
+func identityName(mspID string, enrollmentID string) string {
+	return mspID + "/" + enrollmentID
+}
+
+func mspIdOf(org string) string {
+	if strings.HasSuffix(org, "MSP") {
+		return org
+	}
+	return cases.Title(language.Und).String(org) + "MSP"
+}
+
+func orgOf(mspID string) string {
+	return strings.ToLower(strings.TrimSuffix(mspID, "MSP"))
+}
+
+// returns the CA certs of the given org, which its users' enrollment certs are issued by
+func caCertPoolOf(mspID string) (*x509.CertPool, error) {
+	dir := "../../test-network/organizations/peerOrganizations/" + orgOf(mspID) + ".example.com/msp/cacerts"
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certs of %v: %v", mspID, err)
+	}
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		pemCert, err := os.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA cert: %v", err)
+		}
+		pool.AppendCertsFromPEM(pemCert)
+	}
+	return pool, nil
+}
+
+// accepts "username", "org/username", or "MSPID/username",
+// where a username without an org belongs to the org of defaultMSP
+func qualifiedName(defaultMSP string, username string) string {
+	org, name, found := strings.Cut(username, "/")
+	if !found {
+		return identityName(defaultMSP, username)
+	}
+	return identityName(mspIdOf(org), name)
 }
@@ -2,51 +2,505 @@ package src
 
 import (
 	"bytes"
-	"crypto/rsa"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+)
+
+// User roles, which must match the chaincode
+const (
+	USER_DOCTOR     = "DOCTOR"
+	USER_PATIENT    = "PATIENT"
+	USER_PHARMACIST = "PHARMA"
+	USER_READER     = "READER"
+)
+
+// Prescription statuses, which must match the chaincode
+const (
+	STATUS_DRAFT            = "DRAFT"
+	STATUS_ISSUED           = "ISSUED"
+	STATUS_PARTIALLY_FILLED = "PARTIALLY_FILLED"
+	STATUS_FILLED           = "FILLED"
+	STATUS_CANCELLED        = "CANCELLED"
+	STATUS_EXPIRED          = "EXPIRED"
 )
 
 type Prescription struct {
-	Brand          string `json:"Brand"`
-	Dosage         string `json:"Dosage"`
-	PatientName    string `json:"PatientName"`
-	PatientAddress string `json:"PatientAddress"`
-	PrescriberName string `json:"PrescriberName"`
-	PrescriberNo   uint32 `json:"PrescriberNo"`
-	PiecesTotal    uint8  `json:"AmountTotal"`
-	PiecesFilled   uint8  `json:"AmountFilled"` // in terms of percentage
+	Brand          string    `json:"Brand"`
+	Dosage         string    `json:"Dosage"`
+	PatientName    string    `json:"PatientName"`
+	PatientAddress string    `json:"PatientAddress"`
+	PrescriberName string    `json:"PrescriberName"`
+	PrescriberNo   uint32    `json:"PrescriberNo"`
+	PiecesTotal    uint8     `json:"AmountTotal"`
+	PiecesFilled   uint8     `json:"AmountFilled"` // legacy, fills are now kept on chain as dispense records
+	IssueDate      time.Time `json:"IssueDate"`
+	ValidFrom      time.Time `json:"ValidFrom"`
+	ValidUntil     time.Time `json:"ValidUntil"`
+
+	// Set by ReadPrescription if the prescription is signed. Not encoded.
+	Signer *PrescriptionSigner `json:"-"`
+
+	signature *prescriptionSignature
+}
+
+// prints the content fields only, leaving out the signature
+func (p Prescription) String() string {
+	return fmt.Sprintf("{%v %v %v %v %v %v %v %v issued:%v valid:%v to %v}", p.Brand, p.Dosage, p.PatientName, p.PatientAddress,
+		p.PrescriberName, p.PrescriberNo, p.PiecesTotal, p.PiecesFilled,
+		formatDate(p.IssueDate), formatDate(p.ValidFrom), formatDate(p.ValidUntil))
+}
+
+// ===============================================
+// Prescription Validity
+// A prescription is valid from its valid-from date
+// until its valid-until date. Either may be left
+// unset, in which case the prescription is valid
+// from when it is issued, or never expires. The
+// chaincode keeps a plaintext copy of the
+// validity, and refuses dispenses outside of it.
+// ===============================================
+
+// sets the issue date to now
+func stampPrescription(prescription *Prescription) {
+	prescription.IssueDate = time.Now().UTC().Truncate(time.Second)
+}
+
+// SetValidDays makes the prescription valid for the given number of days from now
+func (p *Prescription) SetValidDays(days int) {
+	p.ValidFrom = time.Now().UTC().Truncate(time.Second)
+	p.ValidUntil = p.ValidFrom.AddDate(0, 0, days)
+}
+
+func formatDate(date time.Time) string {
+	if date.IsZero() {
+		return "-"
+	}
+	return date.Format(time.RFC3339)
+}
+
+func parseDate(date string) (time.Time, error) {
+	if date == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, date)
+}
+
+// ===============================================
+// Dispense Records
+// A quantity dispensed by a pharmacist, as recorded
+// by the chaincode. Fields must match the chaincode.
+// ===============================================
+const (
+	dispensePharmacist = "pharmacist"
+	dispenseQuantity   = "quantity"
+	dispenseTimestamp  = "timestamp"
+)
+
+type Dispense struct {
+	Pharmacist string // obscured name of the pharmacist
+	Quantity   uint64
+	Timestamp  string // RFC 3339, from the dispensing transaction
+}
+
+func decodeDispense(record []byte) (*Dispense, error) {
+	fields, err := decodeCanonicalMap(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode dispense record: %v", err)
+	}
+	quantity, err := strconv.ParseUint(fields[dispenseQuantity], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dispensed quantity: %v", err)
+	}
+	return &Dispense{
+		Pharmacist: fields[dispensePharmacist],
+		Quantity:   quantity,
+		Timestamp:  fields[dispenseTimestamp],
+	}, nil
+}
+
+// ===============================================
+// Prescription Encoding
+// A prescription is encoded as a canonical JSON
+// record of its content fields, along with the
+// prescriber's signature if it is signed, as
+// described by schema/prescription.schema.json.
+// Prescriptions encoded as a canonical map, or
+// without the canonical magic prefix as legacy gob,
+// can still be decoded.
+// ===============================================
+const (
+	prescriptionBrand          = "brand"
+	prescriptionDosage         = "dosage"
+	prescriptionPatientName    = "patientname"
+	prescriptionPatientAddress = "patientaddress"
+	prescriptionPrescriberName = "prescribername"
+	prescriptionPrescriberNo   = "prescriberno"
+	prescriptionPiecesTotal    = "piecestotal"
+	prescriptionPiecesFilled   = "piecesfilled"
+	prescriptionIssueDate      = "issuedate"
+	prescriptionValidFrom      = "validfrom"
+	prescriptionValidUntil     = "validuntil"
+	prescriptionSignatureField = "signature"
+	prescriptionCert           = "cert"
+	prescriptionMSP            = "mspid"
+)
+
+// the content fields of the prescription, which are what the prescriber signs
+func prescriptionContent(prescription *Prescription) map[string]string {
+	return map[string]string{
+		prescriptionBrand:          prescription.Brand,
+		prescriptionDosage:         prescription.Dosage,
+		prescriptionPatientName:    prescription.PatientName,
+		prescriptionPatientAddress: prescription.PatientAddress,
+		prescriptionPrescriberName: prescription.PrescriberName,
+		prescriptionPrescriberNo:   strconv.FormatUint(uint64(prescription.PrescriberNo), 10),
+		prescriptionPiecesTotal:    strconv.FormatUint(uint64(prescription.PiecesTotal), 10),
+		prescriptionPiecesFilled:   strconv.FormatUint(uint64(prescription.PiecesFilled), 10),
+		prescriptionIssueDate:      encodeDate(prescription.IssueDate),
+		prescriptionValidFrom:      encodeDate(prescription.ValidFrom),
+		prescriptionValidUntil:     encodeDate(prescription.ValidUntil),
+	}
+}
+
+func encodeDate(date time.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.UTC().Format(time.RFC3339)
+}
+
+const canonicalKindPrescription byte = 'P'
+
+// field tags must stay in sorted order, so that the record is canonical JSON
+type prescriptionRecord struct {
+	Brand          string                       `json:"brand"`
+	Dosage         string                       `json:"dosage"`
+	IssueDate      string                       `json:"issuedate,omitempty"`
+	PatientAddress string                       `json:"patientaddress"`
+	PatientName    string                       `json:"patientname"`
+	PiecesFilled   uint8                        `json:"piecesfilled"`
+	PiecesTotal    uint8                        `json:"piecestotal"`
+	PrescriberName string                       `json:"prescribername"`
+	PrescriberNo   uint32                       `json:"prescriberno"`
+	Signature      *prescriptionSignatureRecord `json:"signature,omitempty"`
+	ValidFrom      string                       `json:"validfrom,omitempty"`
+	ValidUntil     string                       `json:"validuntil,omitempty"`
+}
+
+type prescriptionSignatureRecord struct {
+	Cert      string `json:"cert"`
+	MSPID     string `json:"mspid"`
+	Signature []byte `json:"signature"` // base64 in JSON
 }
 
 func encodePrescription(prescription *Prescription) ([]byte, error) {
-	buf := bytes.Buffer{}
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(*prescription)
+	record := prescriptionRecord{
+		Brand:          prescription.Brand,
+		Dosage:         prescription.Dosage,
+		IssueDate:      encodeDate(prescription.IssueDate),
+		PatientAddress: prescription.PatientAddress,
+		PatientName:    prescription.PatientName,
+		PiecesFilled:   prescription.PiecesFilled,
+		PiecesTotal:    prescription.PiecesTotal,
+		PrescriberName: prescription.PrescriberName,
+		PrescriberNo:   prescription.PrescriberNo,
+		ValidFrom:      encodeDate(prescription.ValidFrom),
+		ValidUntil:     encodeDate(prescription.ValidUntil),
+	}
+	if prescription.signature != nil {
+		record.Signature = &prescriptionSignatureRecord{
+			Cert:      string(prescription.signature.cert),
+			MSPID:     prescription.signature.mspID,
+			Signature: prescription.signature.signature,
+		}
+	}
+	err := checkUTF8(record.Brand, record.Dosage, record.PatientAddress, record.PatientName, record.PrescriberName)
+	if err == nil && record.Signature != nil {
+		err = checkUTF8(record.Signature.Cert, record.Signature.MSPID)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error encoding data: %v", err)
+		return nil, fmt.Errorf("error encoding prescription : %v", err)
 	}
-	return buf.Bytes(), nil
+	return encodeCanonicalJSON(canonicalKindPrescription, record)
 }
 
 func decodePrescription(encoded []byte) (*Prescription, error) {
-	pres := Prescription{}
-	enc := gob.NewDecoder(bytes.NewReader(encoded))
-	err := enc.Decode(&pres)
+	if !bytes.HasPrefix(encoded, canonicalMagic) {
+		// Legacy gob
+		pres := Prescription{}
+		enc := gob.NewDecoder(bytes.NewReader(encoded))
+		err := enc.Decode(&pres)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding data : %v", err)
+		}
+		return &pres, nil
+	}
+	if len(encoded) >= canonicalHeaderSize && encoded[canonicalHeaderSize-1] == canonicalKindMap {
+		return decodePrescriptionMap(encoded)
+	}
+	_, body, err := readCanonicalHeader(encoded, canonicalKindPrescription)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding data : %v", err)
+	}
+	var record prescriptionRecord
+	err = json.Unmarshal(body, &record)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding data : %v", err)
+	}
+	var dates [3]time.Time
+	for i, date := range []string{record.IssueDate, record.ValidFrom, record.ValidUntil} {
+		dates[i], err = parseDate(date)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding date: %v", err)
+		}
+	}
+	pres := Prescription{
+		Brand:          record.Brand,
+		Dosage:         record.Dosage,
+		PatientName:    record.PatientName,
+		PatientAddress: record.PatientAddress,
+		PrescriberName: record.PrescriberName,
+		PrescriberNo:   record.PrescriberNo,
+		PiecesTotal:    record.PiecesTotal,
+		PiecesFilled:   record.PiecesFilled,
+		IssueDate:      dates[0],
+		ValidFrom:      dates[1],
+		ValidUntil:     dates[2],
+	}
+	if record.Signature != nil {
+		pres.signature = &prescriptionSignature{
+			signature: record.Signature.Signature,
+			cert:      []byte(record.Signature.Cert),
+			mspID:     record.Signature.MSPID,
+		}
+	}
+	return &pres, nil
+}
+
+// decodes prescriptions encoded as a canonical map of their fields
+func decodePrescriptionMap(encoded []byte) (*Prescription, error) {
+	fields, err := decodeCanonicalMap(encoded)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding data : %v", err)
 	}
+	prescriberNo, err := strconv.ParseUint(fields[prescriptionPrescriberNo], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding prescriber number: %v", err)
+	}
+	piecesTotal, err := strconv.ParseUint(fields[prescriptionPiecesTotal], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding pieces total: %v", err)
+	}
+	piecesFilled, err := strconv.ParseUint(fields[prescriptionPiecesFilled], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding pieces filled: %v", err)
+	}
+	var dates [3]time.Time
+	for i, field := range []string{prescriptionIssueDate, prescriptionValidFrom, prescriptionValidUntil} {
+		dates[i], err = parseDate(fields[field])
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %v: %v", field, err)
+		}
+	}
+	pres := Prescription{
+		Brand:          fields[prescriptionBrand],
+		Dosage:         fields[prescriptionDosage],
+		PatientName:    fields[prescriptionPatientName],
+		PatientAddress: fields[prescriptionPatientAddress],
+		PrescriberName: fields[prescriptionPrescriberName],
+		PrescriberNo:   uint32(prescriberNo),
+		PiecesTotal:    uint8(piecesTotal),
+		PiecesFilled:   uint8(piecesFilled),
+		IssueDate:      dates[0],
+		ValidFrom:      dates[1],
+		ValidUntil:     dates[2],
+	}
+	if fields[prescriptionSignatureField] != "" {
+		signature, err := base64.StdEncoding.DecodeString(fields[prescriptionSignatureField])
+		if err != nil {
+			return nil, fmt.Errorf("base64 decoding of prescriber signature failed: %v", err)
+		}
+		pres.signature = &prescriptionSignature{
+			signature: signature,
+			cert:      []byte(fields[prescriptionCert]),
+			mspID:     fields[prescriptionMSP],
+		}
+	}
 	return &pres, nil
 }
 
+// ===============================================
+// Prescriber Signature
+// The doctor signs the pid and content of the
+// prescription with their enrollment key. The
+// signature and cert travel inside the encrypted
+// envelope, so every recipient can check who
+// authored the prescription.
+// ===============================================
+type prescriptionSignature struct {
+	signature []byte
+	cert      []byte // PEM
+	mspID     string
+}
+
+// the result of verifying a prescriber signature
+type PrescriptionSigner struct {
+	Name         string // common name of the signer's certificate
+	MSPID        string
+	PrescriberNo uint32 // PRC number, as written in the signed prescription
+	NotBefore    time.Time
+	NotAfter     time.Time
+	Valid        bool
+	Problem      string // why the signature is not valid
+}
+
+// the prescriber signs "prescription-signature:" + pid + ":", then the
+// version 2 canonical map of the content fields, header included
+func prescriptionSignatureMessage(pid string, prescription *Prescription) ([]byte, error) {
+	content, err := encodeCanonicalMap(prescriptionContent(prescription))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("prescription-signature:"+pid+":"), content...), nil
+}
+
+// signatures made before version 2 was written are over the version 1 canonical map
+func legacyPrescriptionSignatureMessage(pid string, prescription *Prescription) []byte {
+	message := []byte("prescription-signature:" + pid + ":")
+	return append(message, encodeCanonicalMapV1(prescriptionContent(prescription))...)
+}
+
+// version 1 of the canonical map, which is no longer written except to
+// verify old signatures. See the wire format in encode.go
+func encodeCanonicalMapV1(m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf := bytes.Buffer{}
+	buf.Write(canonicalMagic)
+	buf.WriteByte(canonicalVersion1)
+	buf.WriteByte(canonicalKindMap)
+	writeCanonicalUvarint(&buf, uint64(len(keys)))
+	for _, key := range keys {
+		writeCanonicalString(&buf, key)
+		writeCanonicalString(&buf, m[key])
+	}
+	return buf.Bytes()
+}
+
+func writeCanonicalUvarint(buf *bytes.Buffer, n uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], n)])
+}
+
+func writeCanonicalString(buf *bytes.Buffer, str string) {
+	writeCanonicalUvarint(buf, uint64(len(str)))
+	buf.WriteString(str)
+}
+
+// checks the signature over the version 2 message, or failing that, the version 1 message
+func checkPrescriptionSignature(cert *x509.Certificate, pid string, prescription *Prescription) error {
+	signature := prescription.signature.signature
+	message, err := prescriptionSignatureMessage(pid, prescription)
+	if err == nil {
+		err = checkEnrollmentSignature(cert, message, signature)
+	}
+	if err != nil && checkEnrollmentSignature(cert, legacyPrescriptionSignatureMessage(pid, prescription), signature) == nil {
+		return nil
+	}
+	return err
+}
+
+// signs the prescription with the client user's enrollment key
+func (c *Client) signPrescription(pid string, prescription *Prescription) error {
+	message, err := prescriptionSignatureMessage(pid, prescription)
+	if err != nil {
+		return fmt.Errorf("%w: failed to encode prescription: %v", ErrInvalidArgument, err)
+	}
+	signature, err := c.signWithEnrollmentKey(message)
+	if err != nil {
+		return fmt.Errorf("failed to sign prescription: %v", err)
+	}
+	cert, err := loadCertificate(c.identity.CertPath)
+	if err != nil {
+		return err
+	}
+	prescription.signature = &prescriptionSignature{
+		signature: signature,
+		cert:      pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		mspID:     c.identity.MspId,
+	}
+	return nil
+}
+
+// checks the prescriber signature of the prescription. returns nil if it is not signed.
+// the signature is valid if it verifies, and was made with an unexpired doctor's
+// certificate issued by the CA of the signer's org
+func verifyPrescription(pid string, prescription *Prescription) *PrescriptionSigner {
+	if prescription.signature == nil {
+		return nil
+	}
+	signer := &PrescriptionSigner{
+		MSPID:        prescription.signature.mspID,
+		PrescriberNo: prescription.PrescriberNo,
+	}
+	block, _ := pem.Decode(prescription.signature.cert)
+	if block == nil {
+		signer.Problem = "prescription has no signer certificate"
+		return signer
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		signer.Problem = fmt.Sprintf("failed to parse signer certificate: %v", err)
+		return signer
+	}
+	signer.Name = cert.Subject.CommonName
+	signer.NotBefore = cert.NotBefore
+	signer.NotAfter = cert.NotAfter
+
+	err = checkPrescriptionSignature(cert, pid, prescription)
+	if err != nil {
+		signer.Problem = fmt.Sprintf("prescriber signature is invalid: %v", err)
+		return signer
+	}
+	if certAttribute(cert, "role") != USER_DOCTOR {
+		signer.Problem = "signer is not a doctor"
+		return signer
+	}
+	roots, err := caCertPoolOf(signer.MSPID)
+	if err != nil {
+		signer.Problem = err.Error()
+		return signer
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		signer.Problem = fmt.Sprintf("signer certificate is not trusted: %v", err)
+		return signer
+	}
+	signer.Valid = true
+	return signer
+}
+
 // ===============================================
 // Package Prescription
-// gob-encodes, encrypts, and base-64s
+// encodes, encrypts, and base-64s
 // a prescription so that it's ready to be saved
 // ===============================================
 
-func packagePrescription(pubkey *rsa.PublicKey, prescription *Prescription) (string, error) {
+func packagePrescription(pubkey crypto.PublicKey, prescription *Prescription) (string, error) {
 	// Encode Prescription to Bytes
 	encoded, err := encodePrescription(prescription)
 	if err != nil {
@@ -62,19 +516,55 @@ func packagePrescription(pubkey *rsa.PublicKey, prescription *Prescription) (str
 }
 
 // ===============================================
-// Package Prescription
+// Package Prescription For All
+// same as package prescription, but the prescription
+// is only encrypted once, and its data key is wrapped
+// for every given user. Output keys match pubkeys.
+// ===============================================
+
+func packagePrescriptionForAll(pubkeys map[string]crypto.PublicKey, prescription *Prescription) (map[string]string, error) {
+	// Encode Prescription to Bytes
+	encoded, err := encodePrescription(prescription)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode prescription: %v", err)
+	}
+	names := make([]string, 0, len(pubkeys))
+	keys := make([]crypto.PublicKey, 0, len(pubkeys))
+	for name, pubkey := range pubkeys {
+		names = append(names, name)
+		keys = append(keys, pubkey)
+	}
+	//Encrypt data once, wrapping the data key for each user
+	encrypted, err := encryptBytesForAll(encoded, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt prescription: %v", err)
+	}
+	//Encode each envelope as base64
+	pset := make(map[string]string, len(names))
+	for i, name := range names {
+		pset[name] = base64.StdEncoding.EncodeToString(encrypted[i])
+	}
+	return pset, nil
+}
+
+// ===============================================
+// Unpackage Prescription
 // reverse of package prescription
 // ===============================================
-func unpackagePrescription(pdata string) (*Prescription, error) {
+func (c *Client) unpackagePrescription(pdata string) (*Prescription, error) {
 	decoded, err := base64.StdEncoding.DecodeString(pdata)
 	if err != nil {
 		return nil, fmt.Errorf("base64 failed to decrypt prescription: %v", err)
 	}
 
 	// read user privkey
-	privkey, err := readLocalPrivkey(currentUserObscure())
+	me, err := c.currentUserObscure()
+	if err != nil {
+		return nil, err
+	}
+	privkey, err := readLocalPrivkey(c.keystore, me)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieved user private key: %v", err)
+		return nil, fmt.Errorf("failed to retrieved user private key: %w", err)
 	}
 
 	// Decrypt data with current user's public key
@@ -92,15 +582,18 @@ func unpackagePrescription(pdata string) (*Prescription, error) {
 }
 
 func PrescriptionFromCmdArgs(brand string, dosage string, patientName string, patientAddress string,
-	prescriberName string, prescriberNo string, piecesTotal string) *Prescription {
+	prescriberName string, prescriberNo string, piecesTotal string) (*Prescription, error) {
 
-	prescriberNoConv, err := strconv.Atoi(prescriberNo)
+	prescriberNoConv, err := strconv.ParseUint(prescriberNo, 10, 32)
 	if err != nil {
-		panic(fmt.Errorf("failed to parse prescriber number into integer: %v", err))
+		return nil, fmt.Errorf("%w: failed to parse prescriber number into integer: %v", ErrInvalidArgument, err)
 	}
-	piecesTotalConv, err := strconv.Atoi(piecesTotal)
+	piecesTotalConv, err := strconv.ParseUint(piecesTotal, 10, 8)
 	if err != nil {
-		panic(fmt.Errorf("failed to parse pieces total into integer: %v", err))
+		return nil, fmt.Errorf("%w: failed to parse pieces total into integer: %v", ErrInvalidArgument, err)
+	}
+	if piecesTotalConv == 0 {
+		return nil, fmt.Errorf("%w: pieces total must be greater than zero", ErrInvalidArgument)
 	}
 
 	prescription := Prescription{
@@ -113,5 +606,70 @@ func PrescriptionFromCmdArgs(brand string, dosage string, patientName string, pa
 		PiecesTotal:    uint8(piecesTotalConv),
 		PiecesFilled:   0,
 	}
-	return &prescription
+	return &prescription, nil
+}
+
+// ===============================================
+// Prescription ID
+// pids are XXXX-XXXX-C in the Crockford base32
+// alphabet, where C is a Luhn mod 32 check character.
+// Must match genPrescriptionId in the chaincode.
+// ===============================================
+const (
+	pidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	pidLength   = 8
+)
+
+// generates a random pid, for prescriptions whose pid is chosen by the client
+func newPrescriptionId() (string, error) {
+	body := make([]byte, pidLength)
+	_, err := rand.Read(body)
+	if err != nil {
+		return "", err
+	}
+	for i := range body {
+		body[i] = pidAlphabet[body[i]%byte(len(pidAlphabet))]
+	}
+	return fmt.Sprintf("%s-%s-%c", body[:pidLength/2], body[pidLength/2:], pidCheckChar(body)), nil
+}
+
+// NormalizePrescriptionId accepts a typed pid in any case, with or without dashes,
+// and returns it in canonical form if its check character is valid.
+// Legacy numeric pids are returned unchanged.
+func NormalizePrescriptionId(pid string) (string, error) {
+	if _, err := strconv.ParseUint(pid, 10, 64); err == nil && len(pid) > pidLength+1 {
+		return pid, nil
+	}
+	typed := strings.ToUpper(strings.ReplaceAll(pid, "-", ""))
+	typed = strings.NewReplacer("O", "0", "I", "1", "L", "1").Replace(typed)
+	if len(typed) != pidLength+1 {
+		return "", fmt.Errorf("%w: prescription id '%v' should have %v characters", ErrInvalidArgument, pid, pidLength+1)
+	}
+	for i := 0; i < len(typed); i++ {
+		if strings.IndexByte(pidAlphabet, typed[i]) < 0 {
+			return "", fmt.Errorf("%w: prescription id '%v' has invalid character '%c'", ErrInvalidArgument, pid, typed[i])
+		}
+	}
+	body := []byte(typed[:pidLength])
+	if pidCheckChar(body) != typed[pidLength] {
+		return "", fmt.Errorf("%w: prescription id '%v' failed its check character, it may have been mistyped", ErrInvalidArgument, pid)
+	}
+	return fmt.Sprintf("%s-%s-%c", body[:pidLength/2], body[pidLength/2:], typed[pidLength]), nil
+}
+
+// Luhn mod N check character over the pid alphabet
+func pidCheckChar(body []byte) byte {
+	n := len(pidAlphabet)
+	factor := 2
+	sum := 0
+	for i := len(body) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(pidAlphabet, body[i])
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+		sum += addend/n + addend%n
+	}
+	return pidAlphabet[(n-sum%n)%n]
 }
@@ -0,0 +1,412 @@
+package src
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a test CA, which issues enrollment certs the way Fabric CA does
+type testCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating CA cert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing CA cert: %v", err)
+	}
+	return &testCA{key: key, cert: cert}
+}
+
+// issues an enrollment cert with the given Fabric CA attributes
+func (ca *testCA) issue(t *testing.T, name string, attrs map[string]string) (*ecdsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating enrollment key: %v", err)
+	}
+	attrsJSON, err := json.Marshal(map[string]map[string]string{"attrs": attrs})
+	if err != nil {
+		t.Fatalf("encoding cert attributes: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: name},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: fabricAttrsOID, Value: attrsJSON}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("creating enrollment cert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing enrollment cert: %v", err)
+	}
+	return key, cert
+}
+
+func writeTestPEM(t *testing.T, filename string, blockType string, der []byte) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		t.Fatalf("creating %v: %v", filepath.Dir(filename), err)
+	}
+	err = os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("writing %v: %v", filename, err)
+	}
+}
+
+// lays out the crypto material of org1 the way the test network does, with ca as its CA,
+// and runs the test from where the application is run, so that relative paths resolve
+func newTestNetwork(t *testing.T, ca *testCA) string {
+	t.Helper()
+	root := t.TempDir()
+	appDir := filepath.Join(root, "application", "rsa")
+	err := os.MkdirAll(appDir, 0700)
+	if err != nil {
+		t.Fatalf("creating %v: %v", appDir, err)
+	}
+	writeTestPEM(t, filepath.Join(root, "test-network/organizations/peerOrganizations/org1.example.com/msp/cacerts/ca.pem"),
+		"CERTIFICATE", ca.cert.Raw)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getting working directory: %v", err)
+	}
+	err = os.Chdir(appDir)
+	if err != nil {
+		t.Fatalf("changing to %v: %v", appDir, err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return root
+}
+
+// enrolls user in org1 with a cert issued by ca, and returns a client of them
+func enrollTestUser(t *testing.T, root string, ca *testCA, user string, role string) *Client {
+	t.Helper()
+	return enrollTestIdentity(t, root, ca, user, map[string]string{"role": role, "hf.EnrollmentID": user, "hf.Type": "client"})
+}
+
+// enrolls user in org1 with a cert issued by ca with the given attributes
+func enrollTestIdentity(t *testing.T, root string, ca *testCA, user string, attrs map[string]string) *Client {
+	t.Helper()
+	key, cert := ca.issue(t, user, attrs)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("encoding enrollment key: %v", err)
+	}
+	userDir := filepath.Join(root, "test-network/organizations/peerOrganizations/org1.example.com/users", user+"@org1.example.com", "msp")
+	writeTestPEM(t, filepath.Join(userDir, "signcerts", "cert.pem"), "CERTIFICATE", cert.Raw)
+	writeTestPEM(t, filepath.Join(userDir, "keystore", "priv_sk"), "PRIVATE KEY", keyDER)
+	return NewClient(NewIdentity("org1", user, "localhost:7051"), &FileKeystore{})
+}
+
+func testSignedPrescription() *Prescription {
+	return &Prescription{
+		Brand:          "Biogesic",
+		Dosage:         "500mg",
+		PatientName:    "Juan dela Cruz",
+		PatientAddress: "Manila",
+		PrescriberName: "Dr. Santos",
+		PrescriberNo:   1234567,
+		PiecesTotal:    20,
+	}
+}
+
+func TestSignPrescription(t *testing.T) {
+	ca := newTestCA(t, "ca.org1.example.com")
+	root := newTestNetwork(t, ca)
+	c := enrollTestUser(t, root, ca, "doctor", USER_DOCTOR)
+
+	pres := testSignedPrescription()
+	err := c.signPrescription("0123-4567-M", pres)
+	if err != nil {
+		t.Fatalf("signPrescription: %v", err)
+	}
+	// the signature must survive encoding, as it travels inside the envelope
+	encoded, err := encodePrescription(pres)
+	if err != nil {
+		t.Fatalf("encodePrescription: %v", err)
+	}
+	decoded, err := decodePrescription(encoded)
+	if err != nil {
+		t.Fatalf("decodePrescription: %v", err)
+	}
+	signer := verifyPrescription("0123-4567-M", decoded)
+	if signer == nil || !signer.Valid {
+		t.Fatalf("verifyPrescription = %+v, want a valid signer", signer)
+	}
+	if signer.Name != "doctor" || signer.MSPID != "Org1MSP" || signer.PrescriberNo != pres.PrescriberNo {
+		t.Fatalf("verifyPrescription = %+v, want doctor of Org1MSP", signer)
+	}
+
+	if signer := verifyPrescription("0123-4567-M", testSignedPrescription()); signer != nil {
+		t.Fatalf("verifyPrescription of an unsigned prescription = %+v, want nil", signer)
+	}
+}
+
+func TestVerifyPrescriptionTampered(t *testing.T) {
+	ca := newTestCA(t, "ca.org1.example.com")
+	root := newTestNetwork(t, ca)
+	c := enrollTestUser(t, root, ca, "doctor", USER_DOCTOR)
+
+	pres := testSignedPrescription()
+	err := c.signPrescription("0123-4567-M", pres)
+	if err != nil {
+		t.Fatalf("signPrescription: %v", err)
+	}
+	tampered := []struct {
+		name   string
+		pid    string
+		tamper func(p *Prescription)
+	}{
+		{"dosage", "0123-4567-M", func(p *Prescription) { p.Dosage = "5000mg" }},
+		{"pieces total", "0123-4567-M", func(p *Prescription) { p.PiecesTotal++ }},
+		{"pid", "0123-4568-K", func(p *Prescription) {}},
+		{"signature", "0123-4567-M", func(p *Prescription) { p.signature.signature[0] ^= 1 }},
+	}
+	for _, tt := range tampered {
+		copied := *pres
+		signature := *pres.signature
+		signature.signature = append([]byte{}, pres.signature.signature...)
+		copied.signature = &signature
+		tt.tamper(&copied)
+		signer := verifyPrescription(tt.pid, &copied)
+		if signer == nil || signer.Valid || signer.Problem == "" {
+			t.Fatalf("verifyPrescription with tampered %v = %+v, want a problem", tt.name, signer)
+		}
+	}
+}
+
+func TestVerifyPrescriptionNotDoctor(t *testing.T) {
+	ca := newTestCA(t, "ca.org1.example.com")
+	root := newTestNetwork(t, ca)
+	c := enrollTestUser(t, root, ca, "pharmacist", USER_PHARMACIST)
+
+	pres := testSignedPrescription()
+	err := c.signPrescription("0123-4567-M", pres)
+	if err != nil {
+		t.Fatalf("signPrescription: %v", err)
+	}
+	signer := verifyPrescription("0123-4567-M", pres)
+	if signer == nil || signer.Valid || signer.Problem != "signer is not a doctor" {
+		t.Fatalf("verifyPrescription = %+v, want a signer who is not a doctor", signer)
+	}
+}
+
+func TestVerifyPrescriptionUntrustedCA(t *testing.T) {
+	ca := newTestCA(t, "ca.org1.example.com")
+	root := newTestNetwork(t, ca)
+	// the doctor's cert is issued by a CA with the same name, which org1 does not trust
+	rogue := newTestCA(t, "ca.org1.example.com")
+	c := enrollTestUser(t, root, rogue, "doctor", USER_DOCTOR)
+
+	pres := testSignedPrescription()
+	err := c.signPrescription("0123-4567-M", pres)
+	if err != nil {
+		t.Fatalf("signPrescription: %v", err)
+	}
+	signer := verifyPrescription("0123-4567-M", pres)
+	if signer == nil || signer.Valid || !strings.HasPrefix(signer.Problem, "signer certificate is not trusted") {
+		t.Fatalf("verifyPrescription = %+v, want an untrusted signer", signer)
+	}
+}
+
+func testPrescription() *Prescription {
+	return &Prescription{
+		Brand:          "Biogesic",
+		Dosage:         "500mg <twice> & daily",
+		PatientName:    "Juan dela Cruz",
+		PatientAddress: "Ñ Street, Manila",
+		PrescriberName: "Dr. Santos",
+		PrescriberNo:   1234567,
+		PiecesTotal:    20,
+		IssueDate:      time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC),
+		ValidFrom:      time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC),
+		ValidUntil:     time.Date(2024, 3, 31, 8, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestEncodePrescription(t *testing.T) {
+	pres := testPrescription()
+	encoded, err := encodePrescription(pres)
+	if err != nil {
+		t.Fatalf("encodePrescription: %v", err)
+	}
+	want := "CNE\x02P" + `{"brand":"Biogesic","dosage":"500mg <twice> & daily","issuedate":"2024-03-01T08:00:00Z",` +
+		`"patientaddress":"Ñ Street, Manila","patientname":"Juan dela Cruz","piecesfilled":0,"piecestotal":20,` +
+		`"prescribername":"Dr. Santos","prescriberno":1234567,"validfrom":"2024-03-01T08:00:00Z","validuntil":"2024-03-31T08:00:00Z"}`
+	if string(encoded) != want {
+		t.Fatalf("encodePrescription = %q, want %q", encoded, want)
+	}
+
+	pres.signature = &prescriptionSignature{signature: []byte{1, 2, 3}, cert: []byte("cert"), mspID: "Org1MSP"}
+	encoded, err = encodePrescription(pres)
+	if err != nil {
+		t.Fatalf("encodePrescription: %v", err)
+	}
+	decoded, err := decodePrescription(encoded)
+	if err != nil {
+		t.Fatalf("decodePrescription: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, pres) {
+		t.Fatalf("decodePrescription = %+v, want %+v", decoded, pres)
+	}
+}
+
+func TestEncodePrescriptionRejectsInvalidUTF8(t *testing.T) {
+	pres := testPrescription()
+	pres.PatientName = "\xff"
+	if _, err := encodePrescription(pres); err == nil {
+		t.Fatalf("encodePrescription accepted an invalid UTF-8 name")
+	}
+}
+
+// prescriptions written as a canonical map, in version 1 or 2, or as gob, must still be read
+func TestDecodeLegacyPrescription(t *testing.T) {
+	pres := testPrescription()
+	mapV2, err := encodeCanonicalMap(prescriptionContent(pres))
+	if err != nil {
+		t.Fatalf("encodeCanonicalMap: %v", err)
+	}
+	gobbed := bytes.Buffer{}
+	err = gob.NewEncoder(&gobbed).Encode(pres)
+	if err != nil {
+		t.Fatalf("gob encoding: %v", err)
+	}
+	legacy := map[string][]byte{
+		"map version 1": encodeCanonicalMapV1(prescriptionContent(pres)),
+		"map version 2": mapV2,
+		"gob":           gobbed.Bytes(),
+	}
+	for name, encoded := range legacy {
+		decoded, err := decodePrescription(encoded)
+		if err != nil {
+			t.Fatalf("%v: decodePrescription: %v", name, err)
+		}
+		if !reflect.DeepEqual(decoded, pres) {
+			t.Fatalf("%v: decodePrescription = %+v, want %+v", name, decoded, pres)
+		}
+	}
+}
+
+// returns every pid one mistype away from pid: each character of the body or check
+// character replaced by another, and each adjacent pair swapped. Luhn mod 32 cannot
+// catch a swap of '0' and 'Z', as doubling either gives the same digit sum, so those
+// are left out.
+func pidTypos(pid string) []string {
+	typed := []byte(strings.ReplaceAll(pid, "-", ""))
+	format := func(chars []byte) string {
+		return fmt.Sprintf("%s-%s-%s", chars[:pidLength/2], chars[pidLength/2:pidLength], chars[pidLength:])
+	}
+	var typos []string
+	for i := range typed {
+		for j := 0; j < len(pidAlphabet); j++ {
+			if pidAlphabet[j] != typed[i] {
+				typo := bytes.Clone(typed)
+				typo[i] = pidAlphabet[j]
+				typos = append(typos, format(typo))
+			}
+		}
+	}
+	for i := 0; i+1 < len(typed); i++ {
+		a, b := typed[i], typed[i+1]
+		if a == b || (a == '0' && b == 'Z') || (a == 'Z' && b == '0') {
+			continue
+		}
+		typo := bytes.Clone(typed)
+		typo[i], typo[i+1] = b, a
+		typos = append(typos, format(typo))
+	}
+	return typos
+}
+
+func TestNewPrescriptionIdRejectsTypos(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		pid, err := newPrescriptionId()
+		if err != nil {
+			t.Fatalf("newPrescriptionId: %v", err)
+		}
+		normalized, err := NormalizePrescriptionId(pid)
+		if err != nil || normalized != pid {
+			t.Fatalf("NormalizePrescriptionId(%v) = %v, %v", pid, normalized, err)
+		}
+		for _, typo := range pidTypos(pid) {
+			if _, err := NormalizePrescriptionId(typo); !errors.Is(err, ErrInvalidArgument) {
+				t.Fatalf("NormalizePrescriptionId accepted %v, a mistype of %v", typo, pid)
+			}
+		}
+	}
+}
+
+func TestNormalizePrescriptionId(t *testing.T) {
+	// the same pid is checked in the chaincode tests, so that both sides agree
+	pid := "0123-4567-M"
+	typed := []string{pid, "01234567M", "0123-4567-m", "o123-4567-m", "0I23-4567-M", "0l234567M"}
+	for _, typedPid := range typed {
+		normalized, err := NormalizePrescriptionId(typedPid)
+		if err != nil || normalized != pid {
+			t.Fatalf("NormalizePrescriptionId(%v) = %v, %v, want %v", typedPid, normalized, err, pid)
+		}
+	}
+
+	legacy := "12345678901234"
+	if normalized, err := NormalizePrescriptionId(legacy); err != nil || normalized != legacy {
+		t.Fatalf("NormalizePrescriptionId(%v) = %v, %v, want it unchanged", legacy, normalized, err)
+	}
+
+	for _, invalid := range []string{"", "0123-4567", "0123-4567-MM", "0U23-4567-M", "0123-4567-R"} {
+		if _, err := NormalizePrescriptionId(invalid); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("NormalizePrescriptionId(%q) = %v, want ErrInvalidArgument", invalid, err)
+		}
+	}
+}
+
+func TestPrescriptionFromCmdArgsRejectsZeroTotal(t *testing.T) {
+	_, err := PrescriptionFromCmdArgs("Biogesic", "500mg", "Juan dela Cruz", "Manila", "Dr. Santos", "1234567", "0")
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("PrescriptionFromCmdArgs with a pieces total of 0 = %v, want ErrInvalidArgument", err)
+	}
+	prescription, err := PrescriptionFromCmdArgs("Biogesic", "500mg", "Juan dela Cruz", "Manila", "Dr. Santos", "1234567", "1")
+	if err != nil || prescription.PiecesTotal != 1 {
+		t.Fatalf("PrescriptionFromCmdArgs with a pieces total of 1 = %+v, %v", prescription, err)
+	}
+}
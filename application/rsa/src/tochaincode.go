@@ -1,75 +1,141 @@
+// Package src is the client of the RSA prescription chaincode. Operations
+// are methods of a Client, as in client.go. Those which call the network
+// take a context, and no operation panics. Errors wrap the errors in
+// errors.go, or are a *ChaincodeError.
 package src
 
 import (
+	"bytes"
 	"context"
-	"crypto/rsa"
+	"crypto"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric-gateway/pkg/client"
-	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
-	"google.golang.org/grpc/status"
 )
 
+// Transient map fields, which must match the chaincode.
+// Prescription data and pubkeys are sent through the transient map
+// so that they are never written into blocks.
+const (
+	transientPrescription = "prescription"
+	transientPset         = "pset"
+	transientReports      = "reports"
+	transientPubkey       = "pubkey"
+	transientPseudonymKey = "pseudonymkey"
+	transientQuantity     = "quantity"
+	transientValidFrom    = "validfrom"
+	transientValidUntil   = "validuntil"
+	transientIdentity     = "identity"
+)
+
+// evaluates the chaincode function, wrapping failures in a *ChaincodeError
+func (c *Client) evaluate(ctx context.Context, transaction string, options ...client.ProposalOption) ([]byte, error) {
+	contract, err := c.smartContract()
+	if err != nil {
+		return nil, err
+	}
+	result, err := contract.EvaluateWithContext(ctx, transaction, options...)
+	if err != nil {
+		return nil, chaincodeError(transaction, err)
+	}
+	return result, nil
+}
+
+// submits the chaincode function and waits for it to commit, wrapping failures in a *ChaincodeError
+func (c *Client) submit(ctx context.Context, transaction string, options ...client.ProposalOption) ([]byte, error) {
+	contract, err := c.smartContract()
+	if err != nil {
+		return nil, err
+	}
+	result, err := contract.SubmitWithContext(ctx, transaction, options...)
+	if err != nil {
+		return nil, chaincodeError(transaction, err)
+	}
+	return result, nil
+}
+
 // ====================================================================//
 // Send Pubkey
 // ====================================================================//
-func SendPubkey(contract *client.Contract, username string) {
-	obscureName, b64pubkey := PrepareSendPubkey(username)
-	SubmitSendPubkey(contract, obscureName, b64pubkey)
-}
-func PrepareSendPubkey(username string) (string, string) {
-	obscureName := obscureName(username)
-	pubkey, err := readLocalKey(obscureName, pubFilename)
+func (c *Client) SendPubkey(ctx context.Context, username string) error {
+	obscureName, b64pubkey, err := c.PrepareSendPubkey(username)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return obscureName, base64.StdEncoding.EncodeToString(pubkey)
-
+	return c.SubmitSendPubkey(ctx, obscureName, b64pubkey)
 }
-func SubmitSendPubkey(contract *client.Contract, obscureName string, b64pubkey string) {
-	_, err := contract.SubmitTransaction("StoreUserRSAPubkey", obscureName, b64pubkey)
+func (c *Client) PrepareSendPubkey(username string) (string, string, error) {
+	obscureName, err := c.obscureName(username)
+	if err != nil {
+		return "", "", err
+	}
+	pubkey, err := readLocalKey(c.keyFolder, obscureName, pubFilename)
+	if err != nil {
+		return "", "", err
+	}
+	b64registration, err := c.packageKeyRegistration(c.QualifiedName(username), obscureName, pubkey)
 	if err != nil {
-		panic(ChaincodeParseError(err))
+		return "", "", err
 	}
+	return obscureName, b64registration, nil
+
+}
+func (c *Client) SubmitSendPubkey(ctx context.Context, obscureName string, b64registration string) error {
+	_, err := c.submit(ctx, "StoreUserRSAPubkey",
+		client.WithArguments(obscureName),
+		client.WithTransient(map[string][]byte{transientPubkey: []byte(b64registration)}))
+	return err
 }
 
 // ====================================================================//
 // Get Pubkey
 // ====================================================================//
-func GetPubkey(contract *client.Contract, obscureName string) *rsa.PublicKey {
-	return ProcessGetPubkey(EvaluateGetPubkey(contract, obscureName))
+func (c *Client) GetPubkey(ctx context.Context, obscureName string) (crypto.PublicKey, error) {
+	evaluateResult, err := c.EvaluateGetPubkey(ctx, obscureName)
+	if err != nil {
+		return nil, err
+	}
+	return c.ProcessGetPubkey(obscureName, evaluateResult)
 }
-func EvaluateGetPubkey(contract *client.Contract, obscureName string) string {
-	evaluateResult, err := contract.EvaluateTransaction("RetrieveUserRSAPubkey", obscureName)
+func (c *Client) EvaluateGetPubkey(ctx context.Context, obscureName string) (string, error) {
+	evaluateResult, err := c.evaluate(ctx, "RetrieveUserRSAPubkey", client.WithArguments(obscureName))
 	if err != nil {
-		panic(ChaincodeParseError(err))
+		return "", err
 	}
 	if evaluateResult == nil {
-		panic(fmt.Errorf("error: pubkey retrieved for user '%v' is nil", obscureName))
+		return "", fmt.Errorf("%w: pubkey retrieved for user '%v' is nil", ErrKeyNotFound, obscureName)
 	}
-	return string(evaluateResult)
+	return string(evaluateResult), nil
 }
-func ProcessGetPubkey(evaluateResult string) *rsa.PublicKey {
+
+// verifies the pubkey's registration signature before returning it
+func (c *Client) ProcessGetPubkey(obscureName string, evaluateResult string) (crypto.PublicKey, error) {
 	decoded, err := base64.StdEncoding.DecodeString(string(evaluateResult))
 	if err != nil {
-		panic(fmt.Errorf("base64 decoding failed on retrieved pubkey: %v", err))
+		return nil, fmt.Errorf("base64 decoding failed on retrieved pubkey: %v", err)
 	}
-	pubkey, err := parsePubkey(decoded)
-	if err != nil {
-		panic(err)
-	}
-	return pubkey
+	return c.unpackageKeyRecord(obscureName, decoded)
 }
 
 // ====================================================================//
 // Create Prescription
 // ====================================================================//
-func CreatePrescription(contract *client.Contract) string {
-	return SubmitCreatePrescription(contract, PrepareCreatePrescription())
+func (c *Client) CreatePrescription(ctx context.Context) (string, error) {
+	b64encrypted, err := c.PrepareCreatePrescription(ctx)
+	if err != nil {
+		return "", err
+	}
+	return c.SubmitCreatePrescription(ctx, b64encrypted, "")
 }
-func PrepareCreatePrescription() string {
+func (c *Client) PrepareCreatePrescription(ctx context.Context) (string, error) {
 	prescription := Prescription{
 		Brand:          "NULL",
 		Dosage:         "NULL",
@@ -80,108 +146,234 @@ func PrepareCreatePrescription() string {
 		PiecesFilled:   0,
 		PiecesTotal:    0,
 	}
-	pubkey, err := readLocalPubkey(currentUserObscure())
+	me, err := c.currentUserObscure()
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	b64encrypted, err := packagePrescription(pubkey, &prescription)
+	pubkey, err := c.GetPubkey(ctx, me)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return b64encrypted
+	return packagePrescription(pubkey, &prescription)
 }
-func SubmitCreatePrescription(contract *client.Contract, b64encrypted string) string {
-	pid, err := contract.SubmitTransaction("CreatePrescription", b64encrypted)
+
+// nonce is optional, and is mixed into the pid generated by the chaincode
+func (c *Client) SubmitCreatePrescription(ctx context.Context, b64encrypted string, nonce string) (string, error) {
+	pid, err := c.submit(ctx, "CreatePrescription",
+		client.WithArguments(nonce),
+		client.WithTransient(map[string][]byte{transientPrescription: []byte(b64encrypted)}))
 	if err != nil {
-		panic(ChaincodeParseError(err))
+		return "", err
 	}
-	return string(pid)
+	return string(pid), nil
+}
+
+// ====================================================================//
+// Issue Prescription
+// A doctor creates a signed prescription for a patient, encrypted
+// for the doctor and the patient. Returns the pid.
+// ====================================================================//
+func (c *Client) IssuePrescription(ctx context.Context, patient string, prescription *Prescription) (string, error) {
+	pid, obscurePatient, transient, err := c.PrepareIssuePrescription(ctx, patient, prescription)
+	if err != nil {
+		return "", err
+	}
+	err = c.SubmitIssuePrescription(ctx, pid, obscurePatient, transient)
+	if err != nil {
+		return "", err
+	}
+	return pid, nil
+}
+
+// returns the pid, the patient's obscured name, and the transient map to submit
+func (c *Client) PrepareIssuePrescription(ctx context.Context, patient string, prescription *Prescription) (string, string, map[string][]byte, error) {
+	pid, err := newPrescriptionId()
+	if err != nil {
+		return "", "", nil, err
+	}
+	stampPrescription(prescription)
+	err = c.signPrescription(pid, prescription)
+	if err != nil {
+		return "", "", nil, err
+	}
+	obscurePatient, err := c.obscureName(patient)
+	if err != nil {
+		return "", "", nil, err
+	}
+	me, err := c.currentUserObscure()
+	if err != nil {
+		return "", "", nil, err
+	}
+	doctorPubkey, err := c.GetPubkey(ctx, me)
+	if err != nil {
+		return "", "", nil, err
+	}
+	patientPubkey, err := c.GetPubkey(ctx, obscurePatient)
+	if err != nil {
+		return "", "", nil, err
+	}
+	pubkeys := map[string]crypto.PublicKey{
+		me:             doctorPubkey,
+		obscurePatient: patientPubkey,
+	}
+	pset, err := packagePrescriptionForAll(pubkeys, prescription)
+	if err != nil {
+		return "", "", nil, err
+	}
+	b64pset, err := packagePrescriptionSet(&pset)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return pid, obscurePatient, prescriptionTransient(b64pset, prescription), nil
+}
+func (c *Client) SubmitIssuePrescription(ctx context.Context, pid string, obscurePatient string, transient map[string][]byte) error {
+	_, err := c.submit(ctx, "IssuePrescription",
+		client.WithArguments(pid, obscurePatient),
+		client.WithTransient(transient))
+	return err
+}
+
+// the prescription set, along with the plaintext record the chaincode keeps of the
+// prescription: its prescribed quantity, which dispenses are checked against, and its validity
+func prescriptionTransient(b64pset string, prescription *Prescription) map[string][]byte {
+	transient := map[string][]byte{
+		transientPset:     []byte(b64pset),
+		transientQuantity: []byte(strconv.Itoa(int(prescription.PiecesTotal))),
+	}
+	if !prescription.ValidFrom.IsZero() {
+		transient[transientValidFrom] = []byte(prescription.ValidFrom.UTC().Format(time.RFC3339))
+	}
+	if !prescription.ValidUntil.IsZero() {
+		transient[transientValidUntil] = []byte(prescription.ValidUntil.UTC().Format(time.RFC3339))
+	}
+	return transient
 }
 
 // ====================================================================//
 // Read Prescription
 // ====================================================================//
-func ReadPrescription(contract *client.Contract, pid string) *Prescription {
-	return ProcessReadPrescription(EvaluateReadPrescription(contract, pid))
+// the prescriber signature is verified, and its result set in Signer
+func (c *Client) ReadPrescription(ctx context.Context, pid string) (*Prescription, error) {
+	pdata, err := c.EvaluateReadPrescription(ctx, pid)
+	if err != nil {
+		return nil, err
+	}
+	prescription, err := c.ProcessReadPrescription(pdata)
+	if err != nil {
+		return nil, err
+	}
+	prescription.Signer = verifyPrescription(pid, prescription)
+	return prescription, nil
 }
-func EvaluateReadPrescription(contract *client.Contract, pid string) string {
+func (c *Client) EvaluateReadPrescription(ctx context.Context, pid string) (string, error) {
 	// Retrieve from smart contract
-	pdata, err := contract.EvaluateTransaction("ReadPrescription", pid)
+	pdata, err := c.evaluate(ctx, "ReadPrescription", client.WithArguments(pid))
 	if err != nil {
-		panic(ChaincodeParseError(err))
+		return "", err
 	}
-	return string(pdata)
+	return string(pdata), nil
 }
-func ProcessReadPrescription(pdata string) *Prescription {
+func (c *Client) ProcessReadPrescription(pdata string) (*Prescription, error) {
 	// Unpackage and return the prescription
-	out, err := unpackagePrescription(string(pdata))
-	if err != nil {
-		panic(err)
-	}
-	return out
+	return c.unpackagePrescription(string(pdata))
 }
 
 // ====================================================================//
 // Share Prescription
 // ====================================================================//
-func SharePrescription(contract *client.Contract, pid string, username string) {
-	obscureName, b64encrypted := PrepareSharePrescription(contract, pid, username)
-	SubmitSharePrescription(contract, pid, obscureName, b64encrypted)
+func (c *Client) SharePrescription(ctx context.Context, pid string, username string) error {
+	obscureName, b64encrypted, err := c.PrepareSharePrescription(ctx, pid, username)
+	if err != nil {
+		return err
+	}
+	return c.SubmitSharePrescription(ctx, pid, obscureName, b64encrypted)
 }
 
-func PrepareSharePrescription(contract *client.Contract, pid string, username string) (string, string) {
-	obscureName := obscureName(username)
+func (c *Client) PrepareSharePrescription(ctx context.Context, pid string, username string) (string, string, error) {
+	obscureName, err := c.obscureName(username)
+	if err != nil {
+		return "", "", err
+	}
 	//Retrieve prescription with current user credentials
-	prescription := ReadPrescription(contract, pid)
+	prescription, err := c.ReadPrescription(ctx, pid)
+	if err != nil {
+		return "", "", err
+	}
 	//Request pubkey from username to share to
-	otherPubkey := GetPubkey(contract, obscureName)
+	otherPubkey, err := c.GetPubkey(ctx, obscureName)
+	if err != nil {
+		return "", "", err
+	}
 
 	//Re-encrypt the prescription with the new user credentials
 	b64encrypted, err := packagePrescription(otherPubkey, prescription)
 	if err != nil {
-		panic(err)
+		return "", "", err
 	}
-	return obscureName, b64encrypted
+	return obscureName, b64encrypted, nil
 }
-func SubmitSharePrescription(contract *client.Contract, pid string, obscureName string, b64encrypted string) {
+func (c *Client) SubmitSharePrescription(ctx context.Context, pid string, obscureName string, b64encrypted string) error {
 	//Save prescription with tag
-	_, err := contract.SubmitTransaction("SharePrescription", pid, obscureName, b64encrypted)
+	_, err := c.submit(ctx, "SharePrescription",
+		client.WithArguments(pid, obscureName),
+		client.WithTransient(map[string][]byte{transientPrescription: []byte(b64encrypted)}))
+	return err
+}
+
+// ====================================================================//
+// Unshare Prescription
+// ====================================================================//
+func (c *Client) UnsharePrescription(ctx context.Context, pid string, username string) error {
+	obscureName, err := c.obscureName(username)
 	if err != nil {
-		panic(ChaincodeParseError(err))
+		return err
 	}
+	_, err = c.submit(ctx, "UnsharePrescription", client.WithArguments(pid, obscureName))
+	return err
 }
 
-func SharedToList(contract *client.Contract, pid string) *[]string {
+func (c *Client) SharedToList(ctx context.Context, pid string) (*[]string, error) {
 	// Get list of all users that the prescription was shared to
-	b64strings, err := contract.EvaluateTransaction("PrescriptionSharedTo", pid)
+	b64strings, err := c.evaluate(ctx, "PrescriptionSharedTo", client.WithArguments(pid))
 	if err != nil {
-		panic(ChaincodeParseError(err))
+		return nil, err
 	}
 	// base64 decode
-	sharedto, err := unpackageStringSlice(string(b64strings))
+	return unpackageStringSlice(string(b64strings))
+}
+
+func (c *Client) UpdateRecipientsList(ctx context.Context, pid string) (*[]string, error) {
+	// Get list of all users whose copies are re-encrypted on update
+	b64strings, err := c.evaluate(ctx, "PrescriptionUpdateRecipients", client.WithArguments(pid))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return sharedto
+	// base64 decode
+	return unpackageStringSlice(string(b64strings))
 }
 
 // ====================================================================//
 // Re-encrypt Prescription Set
 // ====================================================================//
-func reencryptPrescriptionSet(contract *client.Contract, pid string, update *Prescription) (string, error) {
-	usernames := SharedToList(contract, pid)
-	pset := make(map[string]string)
-	//Encrypt for each username
+func (c *Client) reencryptPrescriptionSet(ctx context.Context, pid string, update *Prescription) (string, error) {
+	// Report readers' copies are only updated through ReportUpdate, so they are not included
+	usernames, err := c.UpdateRecipientsList(ctx, pid)
+	if err != nil {
+		return "", err
+	}
+	// Pubkeys are read from the chain, so that their registrations are verified
+	pubkeys := make(map[string]crypto.PublicKey)
 	for _, username := range *usernames {
-		pubkey, err := readLocalPubkey(username)
-		if err != nil {
-			return "", err
-		}
-		b64encrypted, err := packagePrescription(pubkey, update)
+		pubkey, err := c.GetPubkey(ctx, username)
 		if err != nil {
 			return "", err
 		}
-		pset[username] = b64encrypted
+		pubkeys[username] = pubkey
+	}
+	//Encrypt once, for each username
+	pset, err := packagePrescriptionForAll(pubkeys, update)
+	if err != nil {
+		return "", err
 	}
 	b64gob, err := packagePrescriptionSet(&pset)
 	if err != nil {
@@ -193,186 +385,466 @@ func reencryptPrescriptionSet(contract *client.Contract, pid string, update *Pre
 // ====================================================================//
 // Update Prescription
 // ====================================================================//
-func UpdatePrescription(contract *client.Contract, pid string, update *Prescription) {
-	SubmitUpdatePrescription(contract, pid, PrepareUpdatePrescription(contract, pid, update))
-}
-func PrepareUpdatePrescription(contract *client.Contract, pid string, update *Prescription) string {
-	b64gob, err := reencryptPrescriptionSet(contract, pid, update)
+func (c *Client) UpdatePrescription(ctx context.Context, pid string, update *Prescription) error {
+	transient, err := c.PrepareUpdatePrescription(ctx, pid, update)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return b64gob
+	return c.SubmitUpdatePrescription(ctx, pid, transient)
 }
-func SubmitUpdatePrescription(contract *client.Contract, pid string, b64gob string) {
-	_, err := contract.SubmitTransaction("UpdatePrescription", pid, b64gob)
+
+// returns the transient map to submit
+func (c *Client) PrepareUpdatePrescription(ctx context.Context, pid string, update *Prescription) (map[string][]byte, error) {
+	stampPrescription(update)
+	// An update without a validity keeps the validity of the prescription it replaces
+	if update.ValidFrom.IsZero() && update.ValidUntil.IsZero() {
+		current, err := c.ReadPrescription(ctx, pid)
+		if err != nil {
+			return nil, err
+		}
+		update.ValidFrom = current.ValidFrom
+		update.ValidUntil = current.ValidUntil
+	}
+	err := c.signPrescription(pid, update)
+	if err != nil {
+		return nil, err
+	}
+	b64gob, err := c.reencryptPrescriptionSet(ctx, pid, update)
 	if err != nil {
-		panic(ChaincodeParseError(err))
+		return nil, err
 	}
+	return prescriptionTransient(b64gob, update), nil
+}
+func (c *Client) SubmitUpdatePrescription(ctx context.Context, pid string, transient map[string][]byte) error {
+	_, err := c.submit(ctx, "UpdatePrescription",
+		client.WithArguments(pid),
+		client.WithTransient(transient))
+	return err
 }
 
 // ====================================================================//
-// Setfill Prescription
+// Dispense Prescription
 // ====================================================================//
-func SetfillPrescription(contract *client.Contract, pid string, newfill uint8) {
-	SubmitSetfillPrescription(contract, pid, PrepareSetfillPrescription(contract, pid, newfill))
+// the prescription must carry a valid prescriber signature before it is dispensed
+func (c *Client) DispensePrescription(ctx context.Context, pid string, quantity uint8) error {
+	prescription, err := c.ReadPrescription(ctx, pid)
+	if err != nil {
+		return err
+	}
+	if prescription.Signer == nil {
+		return fmt.Errorf("%w: prescription %v is not signed by its prescriber", ErrInvalidSignature, pid)
+	}
+	if !prescription.Signer.Valid {
+		return fmt.Errorf("%w: prescription %v: %v", ErrInvalidSignature, pid, prescription.Signer.Problem)
+	}
+	_, err = c.submit(ctx, "DispensePrescription",
+		client.WithArguments(pid),
+		client.WithTransient(map[string][]byte{transientQuantity: []byte(strconv.Itoa(int(quantity)))}))
+	return err
 }
-func PrepareSetfillPrescription(contract *client.Contract, pid string, newfill uint8) string {
-	prescription := ReadPrescription(contract, pid)
-
-	prescription.PiecesFilled = newfill
 
-	b64gob, err := reencryptPrescriptionSet(contract, pid, prescription)
+// ====================================================================//
+// Prescription Dispenses
+// ====================================================================//
+func (c *Client) PrescriptionDispenses(ctx context.Context, pid string) ([]Dispense, error) {
+	b64records, err := c.evaluate(ctx, "PrescriptionDispenses", client.WithArguments(pid))
+	if err != nil {
+		return nil, err
+	}
+	records, err := unpackageStringSlice(string(b64records))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return b64gob
+	dispenses := make([]Dispense, 0, len(*records))
+	for _, b64record := range *records {
+		record, err := base64.StdEncoding.DecodeString(b64record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode dispense record: %v", err)
+		}
+		dispense, err := decodeDispense(record)
+		if err != nil {
+			return nil, err
+		}
+		dispenses = append(dispenses, *dispense)
+	}
+	sort.Slice(dispenses, func(i, j int) bool {
+		return dispenses[i].Timestamp < dispenses[j].Timestamp
+	})
+	return dispenses, nil
 }
-func SubmitSetfillPrescription(contract *client.Contract, pid string, b64gob string) {
-	_, err := contract.SubmitTransaction("SetfillPrescription", pid, b64gob)
+
+// ====================================================================//
+// Prescription Status
+// ====================================================================//
+func (c *Client) PrescriptionStatus(ctx context.Context, pid string) (string, error) {
+	status, err := c.evaluate(ctx, "PrescriptionStatus", client.WithArguments(pid))
 	if err != nil {
-		panic(ChaincodeParseError(err))
+		return "", err
 	}
+	return string(status), nil
+}
+
+// ====================================================================//
+// Cancel Prescription
+// ====================================================================//
+func (c *Client) CancelPrescription(ctx context.Context, pid string) error {
+	_, err := c.submit(ctx, "CancelPrescription", client.WithArguments(pid))
+	return err
+}
+
+// ====================================================================//
+// Expire Prescription
+// ====================================================================//
+func (c *Client) ExpirePrescription(ctx context.Context, pid string) error {
+	_, err := c.submit(ctx, "ExpirePrescription", client.WithArguments(pid))
+	return err
 }
 
 // ====================================================================//
 // Delete Prescription
 // ====================================================================//
-func DeletePrescription(contract *client.Contract, pid string) error {
-	_, err := contract.SubmitTransaction("DeletePrescription", pid)
+func (c *Client) DeletePrescription(ctx context.Context, pid string) error {
+	_, err := c.submit(ctx, "DeletePrescription", client.WithArguments(pid))
+	return err
+}
+
+// ====================================================================//
+// Migrate Prescription
+// Patient only. Moves a prescription stored in the old single-value
+// format to one entry per recipient, and records the patient as its
+// owner
+// ====================================================================//
+func (c *Client) MigratePrescription(ctx context.Context, pid string) error {
+	_, err := c.submit(ctx, "MigratePrescription", client.WithArguments(pid))
+	return err
+}
+
+// ====================================================================//
+// Migrate Identity
+// Admin only. Moves a user of the admin's org from their old obscured
+// name, a hash of the bare username, to their MSP-qualified one. Local
+// key files of the user are moved along, and if present, their pubkey
+// is stored again. Otherwise the user has to store their pubkey
+// themselves.
+// ====================================================================//
+func (c *Client) MigrateIdentity(ctx context.Context, username string) error {
+	identity := c.QualifiedName(username)
+	_, enrollmentID, _ := strings.Cut(identity, "/")
+	oldName := legacyHashName(enrollmentID)
+	newName, err := c.hashName(identity)
+	if err != nil {
+		return err
+	}
+	// The identity is sent in the transient map, as with RekeyPseudonym
+	_, err = c.submit(ctx, "MigrateIdentity",
+		client.WithTransient(map[string][]byte{transientIdentity: []byte(identity)}))
 	if err != nil {
-		return ChaincodeParseError(err)
+		return err
+	}
+	_, err = os.Stat(filepath.Join(c.keyFolder, oldName))
+	if err == nil {
+		err = c.migrateLocalKeys(oldName, newName)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = os.Stat(filepath.Join(c.keyFolder, newName, pubFilename))
+	if err == nil {
+		return c.SendPubkey(ctx, username)
 	}
 	return nil
 }
 
 // ====================================================================//
-// Report Register
+// Rotate Key
+// Generates a new key pair for the current user, re-encrypts every
+// prescription copy they have under it, and swaps their pubkey on
+// chain in one transaction. The old private key is only replaced
+// once the transaction has committed. Legacy prescriptions must be
+// migrated first, as their copies are not found. The new key uses
+// the given algorithm, or the algorithm of the current key if it is
+// empty, so rotation can also switch a user between RSA and X25519.
+// If the transaction may have committed, as when waiting for its
+// commit status times out, the new key is kept as pending and
+// FinishKeyRotation has to be called.
 // ====================================================================//
-func ChainReportAddReader(contract *client.Contract) error {
-	_, err := contract.SubmitTransaction("RegisterMeAsReportReader")
+func (c *Client) RotateKey(ctx context.Context, algorithm string) error {
+	me, err := c.currentUserObscure()
 	if err != nil {
-		return ChaincodeParseError(err)
+		return err
 	}
-	return nil
+	if c.hasPendingKeyFiles(me) {
+		return fmt.Errorf("%w: the last key rotation of %v has to be finished first", ErrRotationPending, c.identity.UserId)
+	}
+	oldPrivkey, err := readLocalPrivkey(c.keystore, me)
+	if err != nil {
+		return err
+	}
+	if algorithm == "" {
+		algorithm = pubkeyAlgorithm(oldPrivkey.Public())
+	}
+	b64pids, err := c.evaluate(ctx, "MyPrescriptions")
+	if err != nil {
+		return err
+	}
+	pids, err := unpackageStringSlice(string(b64pids))
+	if err != nil {
+		return err
+	}
+	newPubkey, err := c.generatePendingKeyFiles(me, algorithm)
+	if err != nil {
+		return err
+	}
+	keepPending := false
+	defer func() {
+		if !keepPending {
+			c.discardPendingKeyFiles(me)
+		}
+	}()
+	// Re-encrypt the decrypted bytes as they are, so that signatures inside are kept
+	entries := make(map[string]string, len(*pids))
+	for _, pid := range *pids {
+		pdata, err := c.EvaluateReadPrescription(ctx, pid)
+		if err != nil {
+			return err
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(pdata)
+		if err != nil {
+			return fmt.Errorf("base64 failed to decode prescription %v: %v", pid, err)
+		}
+		plaintext, err := decryptBytes(ciphertext, oldPrivkey)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt prescription %v: %v", pid, err)
+		}
+		reencrypted, err := encryptBytes(plaintext, newPubkey)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt prescription %v: %v", pid, err)
+		}
+		entries[pid] = base64.StdEncoding.EncodeToString(reencrypted)
+	}
+	b64entries, err := packagePrescriptionSet(&entries)
+	if err != nil {
+		return err
+	}
+	pubkey, err := readLocalKey(c.keyFolder, me, pubFilename+pendingSuffix)
+	if err != nil {
+		return err
+	}
+	b64registration, err := c.packageKeyRegistration(c.QualifiedName(c.identity.UserId), me, pubkey)
+	if err != nil {
+		return err
+	}
+	_, err = c.submit(ctx, "RotateMyKey",
+		client.WithTransient(map[string][]byte{
+			transientPubkey: []byte(b64registration),
+			transientPset:   []byte(b64entries),
+		}))
+	if err != nil {
+		if !rejectedTransaction(err) {
+			keepPending = true
+			return fmt.Errorf("%w: the rotation of %v may have committed: %w", ErrRotationPending, c.identity.UserId, err)
+		}
+		return err
+	}
+	keepPending = true
+	return c.commitPendingKeyFiles(me)
+}
+
+// whether a submitted transaction certainly did not change the ledger, as it
+// was rejected on endorsement, or committed as invalid
+func rejectedTransaction(err error) bool {
+	var endorseErr *client.EndorseError
+	var commitErr *client.CommitError
+	return errors.As(err, &endorseErr) || errors.As(err, &commitErr)
 }
 
 // ====================================================================//
-// Report Get Readers
+// Finish Key Rotation
+// Settles a rotation that RotateKey left pending. The pending key
+// replaces the current one if the chain holds its pubkey, and is
+// discarded if the chain still holds the current pubkey. Returns
+// whether the rotation committed.
 // ====================================================================//
-func ChainReportGetReaders(contract *client.Contract) (*[]string, error) {
-	b64readers, err := contract.EvaluateTransaction("GetAllReportReaders")
+func (c *Client) FinishKeyRotation(ctx context.Context) (bool, error) {
+	me, err := c.currentUserObscure()
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	if !c.hasPendingKeyFiles(me) {
+		return false, fmt.Errorf("%w: no key rotation of %v is pending", ErrKeyNotFound, c.identity.UserId)
 	}
-	strings, err := unpackageStringSlice(string(b64readers))
+	chainPubkey, err := c.GetPubkey(ctx, me)
+	if err != nil {
+		return false, err
+	}
+	registered, err := marshalPubkey(chainPubkey)
+	if err != nil {
+		return false, err
+	}
+	pending, err := readLocalKey(c.keyFolder, me, pubFilename+pendingSuffix)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(registered, pending) {
+		return true, c.commitPendingKeyFiles(me)
+	}
+	current, err := readLocalKey(c.keyFolder, me, pubFilename)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(registered, current) {
+		c.discardPendingKeyFiles(me)
+		return false, nil
+	}
+	return false, fmt.Errorf("pubkey on chain is neither the current nor the pending key of %v", c.identity.UserId)
+}
+
+// ====================================================================//
+// Set Pseudonym Key
+// Admin only. Generates the pseudonym key locally if it is not
+// available yet, and stores it on chain. The key file then has to
+// be distributed to every user, or set in RSA_PSEUDONYM_KEY.
+// ====================================================================//
+func (c *Client) SetPseudonymKey(ctx context.Context) error {
+	key, err := c.generatePseudonymKey()
+	if err != nil {
+		return err
+	}
+	_, err = c.submit(ctx, "SetPseudonymKey",
+		client.WithTransient(map[string][]byte{transientPseudonymKey: []byte(base64.StdEncoding.EncodeToString(key))}))
+	return err
+}
+
+// ====================================================================//
+// Rekey Pseudonym
+// Admin only. Moves a user's data from their legacy SHA-256
+// pseudonym to their keyed pseudonym. Local key files of the user
+// are moved along, and if present, their pubkey is stored again.
+// Otherwise the user has to store their pubkey themselves.
+// ====================================================================//
+func (c *Client) RekeyPseudonym(ctx context.Context, username string) error {
+	identity := c.QualifiedName(username)
+	oldName := legacyHashName(identity)
+	newName, err := c.hashName(identity)
+	if err != nil {
+		return err
+	}
+	if oldName == newName {
+		return fmt.Errorf("%w: no pseudonym key is available", ErrKeyNotFound)
+	}
+	// The identity is sent in the transient map, so that blocks do not record whose pseudonym it is
+	_, err = c.submit(ctx, "RekeyPseudonym",
+		client.WithTransient(map[string][]byte{transientIdentity: []byte(identity)}))
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filepath.Join(c.keyFolder, oldName))
+	if err == nil {
+		err = c.migrateLocalKeys(oldName, newName)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = os.Stat(filepath.Join(c.keyFolder, newName, pubFilename))
+	if err == nil {
+		return c.SendPubkey(ctx, username)
+	}
+	return nil
+}
+
+// ====================================================================//
+// Report Register
+// ====================================================================//
+func (c *Client) ChainReportAddReader(ctx context.Context) error {
+	_, err := c.submit(ctx, "RegisterMeAsReportReader")
+	return err
+}
+
+// ====================================================================//
+// Report Get Readers
+// ====================================================================//
+func (c *Client) ChainReportGetReaders(ctx context.Context) (*[]string, error) {
+	b64readers, err := c.evaluate(ctx, "GetAllReportReaders")
 	if err != nil {
 		return nil, err
 	}
-	return strings, nil
+	return unpackageStringSlice(string(b64readers))
 }
 
 // ====================================================================//
 // Report Update
 // ====================================================================//
-func ReportUpdate(contract *client.Contract, pid string) {
-	SubmitReportUpdate(contract, pid, PrepareReportUpdate(contract, pid))
+func (c *Client) ReportUpdate(ctx context.Context, pid string) error {
+	b64reports, err := c.PrepareReportUpdate(ctx, pid)
+	if err != nil {
+		return err
+	}
+	return c.SubmitReportUpdate(ctx, pid, b64reports)
 }
 
-func PrepareReportUpdate(contract *client.Contract, pid string) string {
-	readers, err := ChainReportGetReaders(contract)
+func (c *Client) PrepareReportUpdate(ctx context.Context, pid string) (string, error) {
+	readers, err := c.ChainReportGetReaders(ctx)
+	if err != nil {
+		return "", err
+	}
+	prescription, err := c.ReadPrescription(ctx, pid)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	prescription := ReadPrescription(contract, pid)
 
-	pset := make(map[string]string)
+	pubkeys := make(map[string]crypto.PublicKey)
 	for _, obscuredName := range *readers {
-		pubkey := GetPubkey(contract, obscuredName)
-		b64encrypted, err := packagePrescription(pubkey, prescription)
+		pubkeys[obscuredName], err = c.GetPubkey(ctx, obscuredName)
 		if err != nil {
-			panic(err)
+			return "", err
 		}
-		pset[obscuredName] = b64encrypted
 	}
-	b64reports, err := packagePrescriptionSet(&pset)
+	pset, err := packagePrescriptionForAll(pubkeys, prescription)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return b64reports
+	return packagePrescriptionSet(&pset)
 }
 
-func SubmitReportUpdate(contract *client.Contract, pid string, b64reports string) {
-	_, err := contract.SubmitTransaction("UpdateReport", pid, b64reports)
-	if err != nil {
-		panic(ChaincodeParseError(err))
-	}
+func (c *Client) SubmitReportUpdate(ctx context.Context, pid string, b64reports string) error {
+	_, err := c.submit(ctx, "UpdateReport",
+		client.WithArguments(pid),
+		client.WithTransient(map[string][]byte{transientReports: []byte(b64reports)}))
+	return err
 }
 
 // ====================================================================//
 // Report View
 // ====================================================================//
-func ReportView(contract *client.Contract) string {
-	return ProcessReportView(EvaluateReportView(contract))
+func (c *Client) ReportView(ctx context.Context) (string, error) {
+	b64all, err := c.EvaluateReportView(ctx)
+	if err != nil {
+		return "", err
+	}
+	return c.ProcessReportView(b64all)
 }
-func EvaluateReportView(contract *client.Contract) string {
-	b64all, err := contract.EvaluateTransaction("GetPrescriptionReport")
+func (c *Client) EvaluateReportView(ctx context.Context) (string, error) {
+	b64all, err := c.evaluate(ctx, "GetPrescriptionReport")
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return string(b64all)
+	return string(b64all), nil
 }
-func ProcessReportView(b64all string) string {
+func (c *Client) ProcessReportView(b64all string) (string, error) {
 	prescriptions, err := unpackagePrescriptionSet(string(b64all))
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	var output string
 	for _, pdata := range *prescriptions {
 		if pdata != "" {
-			prescription, err := unpackagePrescription(pdata)
+			prescription, err := c.unpackagePrescription(pdata)
 			if err != nil {
-				panic(err)
+				return "", err
 			}
 			output += fmt.Sprintf("prescription: %v\n", prescription)
 		}
 	}
 
-	return output
-}
-
-func ChaincodeParseError(err error) error {
-	var errorString string
-	switch err := err.(type) {
-	case *client.EndorseError:
-		errorString += fmt.Sprintf("Endorse error for transaction %s with gRPC status %v: %s\n", err.TransactionID, status.Code(err), err)
-	case *client.SubmitError:
-		errorString += fmt.Sprintf("Submit error for transaction %s with gRPC status %v: %s\n", err.TransactionID, status.Code(err), err)
-	case *client.CommitStatusError:
-		if errors.Is(err, context.DeadlineExceeded) {
-			errorString += fmt.Sprintf("Timeout waiting for transaction %s commit status: %s", err.TransactionID, err)
-		} else {
-			errorString += fmt.Sprintf("Error obtaining commit status for transaction %s with gRPC status %v: %s\n", err.TransactionID, status.Code(err), err)
-		}
-	case *client.CommitError:
-		errorString += fmt.Sprintf("Transaction %s failed to commit with status %d: %s\n", err.TransactionID, int32(err.Code), err)
-	default:
-		panic(fmt.Errorf("unexpected error type %T: %w", err, err))
-	}
-
-	// Any error that originates from a peer or orderer node external to the gateway will have its details
-	// embedded within the gRPC status error. The following code shows how to extract that.
-	statusErr := status.Convert(err)
-
-	details := statusErr.Details()
-	if len(details) > 0 {
-		errorString += "Error Details:\n"
-
-		for _, detail := range details {
-			switch detail := detail.(type) {
-			case *gateway.ErrorDetail:
-				errorString += fmt.Sprintf("- address: %s, mspId: %s, message: %s\n", detail.Address, detail.MspId, detail.Message)
-			}
-		}
-	}
-	return fmt.Errorf("\033[0;31m%v\033[0m", errorString)
+	return output, nil
 }
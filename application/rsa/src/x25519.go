@@ -0,0 +1,107 @@
+package src
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// =====================================================
+// X25519 Key Wrapping (ECIES)
+// An alternative to RSA-OAEP for wrapping the data key
+// of an envelope. A fresh ephemeral X25519 key is made
+// for each recipient, and the data key is encrypted
+// with AES-256-GCM under a key derived with HKDF-SHA256
+// from the shared secret, the ephemeral pubkey and the
+// recipient pubkey.
+//
+// Wrapped key layout:
+// ephemeral pubkey (32) | nonce (12) | AES-GCM ciphertext
+//
+// The ephemeral pubkey is authenticated as additional
+// data.
+// =====================================================
+
+const x25519WrapInfo = "rsa-envelope-x25519-v1"
+
+func x25519WrapKey(shared []byte, ephemeral []byte, recipient []byte) ([]byte, error) {
+	info := append([]byte(x25519WrapInfo), ephemeral...)
+	info = append(info, recipient...)
+	key := make([]byte, dataKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving wrapping key : %v", err)
+	}
+	return key, nil
+}
+
+func wrapX25519(dataKey []byte, pub *ecdh.PublicKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating ephemeral key : %v", err)
+	}
+	shared, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping data key : %v", err)
+	}
+	ephemeralBytes := ephemeral.PublicKey().Bytes()
+	key, err := x25519WrapKey(shared, ephemeralBytes, pub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("error generating nonce : %v", err)
+	}
+	wrapped := append(append([]byte{}, ephemeralBytes...), nonce...)
+	return gcm.Seal(wrapped, nonce, dataKey, ephemeralBytes), nil
+}
+
+// x25519Privkey unwraps data keys wrapped by wrapX25519, so that X25519 keys
+// can be used wherever an RSA crypto.Decrypter is
+type x25519Privkey struct {
+	key *ecdh.PrivateKey
+}
+
+func (priv *x25519Privkey) Public() crypto.PublicKey {
+	return priv.key.PublicKey()
+}
+
+func (priv *x25519Privkey) Decrypt(_ io.Reader, wrapped []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	keySize := len(priv.key.PublicKey().Bytes())
+	if len(wrapped) < keySize {
+		return nil, fmt.Errorf("wrapped key is truncated")
+	}
+	ephemeralBytes := wrapped[:keySize]
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key : %v", err)
+	}
+	shared, err := priv.key.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key : %v", err)
+	}
+	key, err := x25519WrapKey(shared, ephemeralBytes, priv.key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	body := wrapped[keySize:]
+	if len(body) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is truncated")
+	}
+	return gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():], ephemeralBytes)
+}
@@ -0,0 +1,266 @@
+package src
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ============================================================ //
+// Migrate Identity
+// Admin only. Moves the prescription copies, dispense records
+// and report reader registration of a user of the admin's own
+// org from their old obscured name, which was a hash of the CN
+// only, to their MSP-qualified obscured name. The user is given
+// as "<mspid>/<username>" in the transient map. Since the CN
+// alone does not say which org the old data belonged to, users
+// cannot migrate themselves; an admin vouches for it instead.
+// The old pubkey record is deleted, and the pubkey has to be
+// stored again afterwards, as its registration signature covers
+// the obscured name.
+// ============================================================ //
+func (s *SmartContract) MigrateIdentity(ctx contractapi.TransactionContextInterface) error {
+	err := ctx.GetClientIdentity().AssertAttributeValue("hf.Type", ADMIN_TYPE)
+	if err != nil {
+		return fmt.Errorf("only admins can migrate identities: %v", err)
+	}
+	identity, err := getTransient(ctx, transientIdentity)
+	if err != nil {
+		return err
+	}
+	enrollmentID, err := checkOwnMSPIdentity(ctx, identity)
+	if err != nil {
+		return err
+	}
+	legacyName := legacyObscureName(enrollmentID)
+	newName, err := obscureName(ctx, identity)
+	if err != nil {
+		return err
+	}
+	err = movePseudonym(ctx, legacyName, newName)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().DelPrivateData(collectionPubkeyRSA, legacyName)
+	if err != nil {
+		return fmt.Errorf("failed to delete old RSA pubkey: %v", err)
+	}
+	return nil
+}
+
+// checks that identity, written as "<mspid>/<username>", is of a user of the
+// calling admin's own MSP, and returns its username
+func checkOwnMSPIdentity(ctx contractapi.TransactionContextInterface, identity string) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read client MSP ID: %v", err)
+	}
+	enrollmentID := strings.TrimPrefix(identity, mspID+"/")
+	if !strings.HasPrefix(identity, mspID+"/") || enrollmentID == "" {
+		return "", fmt.Errorf("admins can only act for users of their own MSP %v", mspID)
+	}
+	return enrollmentID, nil
+}
+
+// ============================================================ //
+// Rekey Pseudonym
+// Admin only. Moves the data of the given identity of the
+// admin's own MSP, written as "<mspid>/<username>", from its
+// legacy bare SHA-256 pseudonym to its current HMAC pseudonym.
+// The identity is given in the transient map, so that blocks do
+// not link it to its pseudonym.
+// The old pubkey record is deleted, since its registration
+// signature covers the old pseudonym; the pubkey has to be
+// stored again afterwards.
+// ============================================================ //
+func (s *SmartContract) RekeyPseudonym(ctx contractapi.TransactionContextInterface) error {
+	err := ctx.GetClientIdentity().AssertAttributeValue("hf.Type", ADMIN_TYPE)
+	if err != nil {
+		return fmt.Errorf("only admins can rekey pseudonyms: %v", err)
+	}
+	identity, err := getTransient(ctx, transientIdentity)
+	if err != nil {
+		return err
+	}
+	_, err = checkOwnMSPIdentity(ctx, identity)
+	if err != nil {
+		return err
+	}
+	oldName := legacyObscureName(identity)
+	newName, err := obscureName(ctx, identity)
+	if err != nil {
+		return err
+	}
+	if oldName == newName {
+		return fmt.Errorf("no pseudonym key is set")
+	}
+	err = movePseudonym(ctx, oldName, newName)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().DelPrivateData(collectionPubkeyRSA, oldName)
+	if err != nil {
+		return fmt.Errorf("failed to delete old RSA pubkey: %v", err)
+	}
+	return nil
+}
+
+// moves the prescription copies, prescription roles, dispense
+// records and report reader registration and reports of oldName
+// to newName
+func movePseudonym(ctx contractapi.TransactionContextInterface, oldName string, newName string) error {
+	// Move every prescription copy of the user
+	pids, err := recipientPrescriptions(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		entry, err := getPrescriptionEntry(ctx, pid, oldName)
+		if err != nil {
+			return err
+		}
+		err = putPrescriptionEntry(ctx, pid, newName, string(entry))
+		if err != nil {
+			return err
+		}
+		err = delPrescriptionEntry(ctx, pid, oldName)
+		if err != nil {
+			return err
+		}
+	}
+	// Move the user's roles in the info of those prescriptions
+	for _, pid := range pids {
+		info, err := getPrescriptionInfo(ctx, pid)
+		if err != nil {
+			return err
+		}
+		changed := false
+		for field, name := range info {
+			if name == oldName {
+				info[field] = newName
+				changed = true
+			}
+		}
+		if changed {
+			err = putPrescriptionInfo(ctx, pid, info)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Move the user's dispense records, if they are a pharmacist
+	dispenseIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collectionPrescription, pharmacistIndex, []string{oldName})
+	if err != nil {
+		return err
+	}
+	defer dispenseIterator.Close()
+	for dispenseIterator.HasNext() {
+		entry, err := dispenseIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return err
+		}
+		pid, txID := parts[1], parts[2]
+		key, err := ctx.GetStub().CreateCompositeKey(dispenseIndex, []string{pid, txID})
+		if err != nil {
+			return err
+		}
+		data, err := ctx.GetStub().GetPrivateData(collectionPrescription, key)
+		if err != nil {
+			return fmt.Errorf("failed to read dispense record: %v", err)
+		}
+		record, err := decodeCanonicalMap(data)
+		if err != nil {
+			return err
+		}
+		record[dispensePharmacist] = newName
+		encoded, err := encodeCanonicalMap(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode dispense record: %v", err)
+		}
+		err = ctx.GetStub().PutPrivateData(collectionPrescription, key, encoded)
+		if err != nil {
+			return fmt.Errorf("failed to store dispense record: %v", err)
+		}
+		err = delPharmacistIndex(ctx, oldName, pid, txID)
+		if err != nil {
+			return err
+		}
+		err = putPharmacistIndex(ctx, newName, pid, txID)
+		if err != nil {
+			return err
+		}
+	}
+	// Move the report reader registration
+	isReader, err := isReportReader(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if isReader {
+		reports, err := reportPrescriptions(ctx, oldName)
+		if err != nil {
+			return err
+		}
+		for _, pid := range reports {
+			err = putReportIndex(ctx, newName, pid)
+			if err != nil {
+				return err
+			}
+			err = delReportIndex(ctx, oldName, pid)
+			if err != nil {
+				return err
+			}
+		}
+		err = ctx.GetStub().PutPrivateData(collectionReportReaders, newName, []byte(newName))
+		if err != nil {
+			return err
+		}
+		err = ctx.GetStub().DelPrivateData(collectionReportReaders, oldName)
+		if err != nil {
+			return fmt.Errorf("error in removing report reader: %v", err)
+		}
+	}
+	return nil
+}
+
+// ============================================================ //
+// Set Pseudonym Key
+// Admin only. Stores the channel secret used to derive HMAC
+// pseudonyms. The key is passed base64 encoded in the transient
+// map, and can only be set once, since changing it would orphan
+// every pseudonym derived from it.
+// ============================================================ //
+func (s *SmartContract) SetPseudonymKey(ctx contractapi.TransactionContextInterface) error {
+	err := ctx.GetClientIdentity().AssertAttributeValue("hf.Type", ADMIN_TYPE)
+	if err != nil {
+		return fmt.Errorf("only admins can set the pseudonym key: %v", err)
+	}
+	existing, err := ctx.GetStub().GetPrivateData(collectionPseudonymKey, pseudonymKeyName)
+	if err != nil {
+		return fmt.Errorf("failed to read pseudonym key: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("pseudonym key is already set")
+	}
+	b64key, err := getTransient(ctx, transientPseudonymKey)
+	if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(b64key)
+	if err != nil {
+		return fmt.Errorf("base64 decoding of pseudonym key failed: %v", err)
+	}
+	if len(key) < 32 {
+		return fmt.Errorf("pseudonym key must be at least 32 bytes")
+	}
+	err = ctx.GetStub().PutPrivateData(collectionPseudonymKey, pseudonymKeyName, key)
+	if err != nil {
+		return fmt.Errorf("failed to store pseudonym key: %v", err)
+	}
+	return nil
+}
@@ -1,24 +1,259 @@
 package src
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
-func (s *SmartContract) StoreUserRSAPubkey(ctx contractapi.TransactionContextInterface, username string, b64pubkey string) error {
-	pubkey, err := base64.StdEncoding.DecodeString(b64pubkey)
+// ============================================================ //
+// Key Registration
+// A pubkey is stored as a record holding the pubkey and its
+// algorithm, the cert and MSP ID of the identity that registered
+// it, and its signature over the algorithm, username and pubkey.
+// Clients verify the signature before encrypting for the user.
+// Registrations without an algorithm are RSA. The signed message
+// must match keyRegistrationMessage in the application.
+// A pubkey stored by an admin for a user of its own MSP also
+// records the user's identity, "<mspid>/<username>", so that
+// clients can check that the admin may vouch for the user.
+// ============================================================ //
+const (
+	keyRecordPubkey    = "pubkey"
+	keyRecordAlgorithm = "algorithm"
+	keyRecordSignature = "signature"
+	keyRecordCert      = "cert"
+	keyRecordMSP       = "mspid"
+	keyRecordIdentity  = "identity"
+)
+
+const (
+	algorithmRSA            = "rsa"
+	algorithmX25519         = "x25519"
+	algorithmX25519MLKEM768 = "x25519-mlkem768"
+)
+
+// PKIX encodings of X25519 pubkeys are this prefix, then the 32 byte key
+var x25519PKIXPrefix = []byte{0x30, 0x2a, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x6e, 0x03, 0x21, 0x00}
+
+// Hybrid pubkeys are this prefix, then the 32 byte X25519 key and the
+// 1184 byte ML-KEM-768 encapsulation key. Must match hybrid.go in the application.
+var hybridPubkeyPrefix = []byte{'R', 'X', 'P', 1}
+
+const hybridPubkeySize = 4 + 32 + 1184
+
+func keyRegistrationMessage(algorithm string, obscuredName string, pubkey []byte) []byte {
+	message := []byte(algorithm + "-pubkey-registration:" + obscuredName + ":")
+	return append(message, pubkey...)
+}
+
+// checks that the encoded pubkey is a key of the given algorithm
+func checkPubkey(algorithm string, pubkey []byte) error {
+	switch algorithm {
+	case algorithmRSA:
+		parsed, err := x509.ParsePKIXPublicKey(pubkey)
+		if err != nil {
+			return fmt.Errorf("failed to parse RSA pubkey: %v", err)
+		}
+		if _, ok := parsed.(*rsa.PublicKey); !ok {
+			return fmt.Errorf("pubkey of type %T is not an RSA pubkey", parsed)
+		}
+	case algorithmX25519:
+		if len(pubkey) != len(x25519PKIXPrefix)+32 || !bytes.HasPrefix(pubkey, x25519PKIXPrefix) {
+			return fmt.Errorf("pubkey is not an X25519 pubkey")
+		}
+	case algorithmX25519MLKEM768:
+		if len(pubkey) != hybridPubkeySize || !bytes.HasPrefix(pubkey, hybridPubkeyPrefix) {
+			return fmt.Errorf("pubkey is not an X25519 + ML-KEM-768 pubkey")
+		}
+	default:
+		return fmt.Errorf("unsupported key algorithm '%v'", algorithm)
+	}
+	return nil
+}
+
+func verifyKeyRegistration(cert *x509.Certificate, algorithm string, obscuredName string, pubkey []byte, signature []byte) error {
+	var signatureAlgorithm x509.SignatureAlgorithm
+	switch cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		signatureAlgorithm = x509.ECDSAWithSHA256
+	case *rsa.PublicKey:
+		signatureAlgorithm = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("unsupported enrollment key type %T", cert.PublicKey)
+	}
+	err := cert.CheckSignature(signatureAlgorithm, keyRegistrationMessage(algorithm, obscuredName, pubkey), signature)
+	if err != nil {
+		return fmt.Errorf("pubkey registration signature is invalid: %v", err)
+	}
+	return nil
+}
+
+// Users can only register their own pubkey. Admins may register a pubkey for users of their
+// own MSP, whose identity is given in the registration.
+func (s *SmartContract) StoreUserRSAPubkey(ctx contractapi.TransactionContextInterface, username string) error {
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
+	b64registration, err := getTransient(ctx, transientPubkey)
+	if err != nil {
+		return err
+	}
+	registration, err := unpackagePrescriptionSet(b64registration)
+	if err != nil {
+		return fmt.Errorf("failed to unpack pubkey registration: %v", err)
+	}
+	identity := ""
+	if username != currentUser {
+		err := ctx.GetClientIdentity().AssertAttributeValue("hf.Type", ADMIN_TYPE)
+		if err != nil {
+			return fmt.Errorf("only admins can store the RSA pubkey of another user: %v", err)
+		}
+		identity = (*registration)[keyRecordIdentity]
+		_, err = checkOwnMSPIdentity(ctx, identity)
+		if err != nil {
+			return err
+		}
+		obscuredIdentity, err := obscureName(ctx, identity)
+		if err != nil {
+			return err
+		}
+		if obscuredIdentity != username {
+			return fmt.Errorf("pubkey registration is for another user than %v", identity)
+		}
+	}
+	return putPubkeyRegistration(ctx, username, registration, identity)
+}
+
+// verifies a pubkey registration signed by the caller, and stores it as the user's pubkey record.
+// identity is recorded if the caller is an admin registering the pubkey of another user
+func putPubkeyRegistration(ctx contractapi.TransactionContextInterface, username string, registration *map[string]string, identity string) error {
+	pubkey, err := base64.StdEncoding.DecodeString((*registration)[keyRecordPubkey])
+	if err != nil {
+		return fmt.Errorf("base64 decoding of pubkey failed: %v", err)
+	}
+	algorithm := (*registration)[keyRecordAlgorithm]
+	if algorithm == "" {
+		algorithm = algorithmRSA
+	}
+	err = checkPubkey(algorithm, pubkey)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString((*registration)[keyRecordSignature])
 	if err != nil {
-		return fmt.Errorf("base64 decoding of RSA pubkey failed: %v", err)
+		return fmt.Errorf("base64 decoding of registration signature failed: %v", err)
 	}
-	err = ctx.GetStub().PutPrivateData(collectionPubkeyRSA, username, pubkey)
+	// The registration must be signed by the enrollment key of the caller
+	cert, err := ctx.GetClientIdentity().GetX509Certificate()
+	if err != nil {
+		return fmt.Errorf("failed to read client certificate: %v", err)
+	}
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read client MSP ID: %v", err)
+	}
+	err = verifyKeyRegistration(cert, algorithm, username, pubkey, signature)
+	if err != nil {
+		return err
+	}
+	record := map[string]string{
+		keyRecordPubkey:    (*registration)[keyRecordPubkey],
+		keyRecordAlgorithm: algorithm,
+		keyRecordSignature: (*registration)[keyRecordSignature],
+		keyRecordCert:      string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		keyRecordMSP:       mspID,
+	}
+	if identity != "" {
+		record[keyRecordIdentity] = identity
+	}
+	encoded, err := encodeCanonicalMap(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode user RSA Pubkey: %v", err)
+	}
+	err = ctx.GetStub().PutPrivateData(collectionPubkeyRSA, username, encoded)
 	if err != nil {
 		return fmt.Errorf("failed to store user RSA Pubkey: %v", err)
 	}
 	return nil
 }
 
+// ============================================================ //
+// Rotate My Key
+// Replaces the current user's pubkey, along with every copy of a
+// prescription encrypted for them, in one transaction. The new
+// registration comes in the transient map as with
+// StoreUserRSAPubkey, and the re-encrypted copies as a
+// prescription set from pid to copy, which must cover exactly the
+// prescriptions the user has a copy of.
+// ============================================================ //
+func (s *SmartContract) RotateMyKey(ctx contractapi.TransactionContextInterface) error {
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
+	b64registration, err := getTransient(ctx, transientPubkey)
+	if err != nil {
+		return err
+	}
+	b64entries, err := getTransient(ctx, transientPset)
+	if err != nil {
+		return err
+	}
+	entries, err := unpackagePrescriptionSet(b64entries)
+	if err != nil {
+		return err
+	}
+	pids, err := recipientPrescriptions(ctx, currentUser)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		_, exists := (*entries)[pid]
+		if !exists {
+			return fmt.Errorf("key rotation is missing the copy of prescription %v", pid)
+		}
+	}
+	if len(*entries) != len(pids) {
+		return fmt.Errorf("key rotation has copies of prescriptions the user has no access to")
+	}
+	for pid, b64prescription := range *entries {
+		err = putPrescriptionEntry(ctx, pid, currentUser, b64prescription)
+		if err != nil {
+			return err
+		}
+	}
+	registration, err := unpackagePrescriptionSet(b64registration)
+	if err != nil {
+		return fmt.Errorf("failed to unpack pubkey registration: %v", err)
+	}
+	return putPubkeyRegistration(ctx, currentUser, registration, "")
+}
+
+// ============================================================ //
+// My Prescriptions
+// Returns the pids of every prescription the current user has a
+// copy of, as a packaged string slice
+// ============================================================ //
+func (s *SmartContract) MyPrescriptions(ctx contractapi.TransactionContextInterface) (string, error) {
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return "", err
+	}
+	pids, err := recipientPrescriptions(ctx, currentUser)
+	if err != nil {
+		return "", err
+	}
+	return packageStringSlice(&pids)
+}
+
 func (s *SmartContract) RetrieveUserRSAPubkey(ctx contractapi.TransactionContextInterface, username string) (string, error) {
 	pubkey, err := ctx.GetStub().GetPrivateData(collectionPubkeyRSA, username)
 	if err != nil {
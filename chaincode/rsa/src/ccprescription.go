@@ -1,7 +1,10 @@
 package src
 
 import (
+	"encoding/base64"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
@@ -9,195 +12,798 @@ import (
 /*
 ACCESS CONTROLS
 
-Patient - CreatePrescription, SharePrescription, Delete Prescription
-Doctor - Update Prescription
-Pharmacist - SetFill Prescription
-All - Read Prescription
+Patient - CreatePrescription, SharePrescription, UnsharePrescription, Delete Prescription, Cancel Prescription
+Doctor - Issue Prescription, Update Prescription, Cancel Prescription, Expire Prescription (early, if the prescriber)
+Pharmacist - Dispense Prescription, Expire Prescription (once past its validity)
+All - Read Prescription, Prescription Status, Prescription Dispenses
+
+STATUS TRANSITIONS
+
+Create -> DRAFT
+Issue -> ISSUED
+DRAFT -> ISSUED (Update)
+ISSUED -> ISSUED (Update), PARTIALLY_FILLED, FILLED (Dispense)
+PARTIALLY_FILLED -> PARTIALLY_FILLED, FILLED (Dispense)
+DRAFT, ISSUED, PARTIALLY_FILLED -> CANCELLED (Cancel)
+ISSUED, PARTIALLY_FILLED -> EXPIRED (Expire)
+FILLED, CANCELLED and EXPIRED are final
+
+Prescriptions can only be dispensed within their validity window.
+Past its valid-until time, a prescription is reported as EXPIRED,
+and any doctor or pharmacist with a copy may expire it. Before
+then, only its prescriber may.
 */
+
+// ============================================================ //
+// Prescription Status
+// Maps each status to the statuses it may be entered from.
+// Prescriptions migrated from before statuses were recorded
+// have none, and are treated as ISSUED.
+// ============================================================ //
+var statusTransitions = map[string][]string{
+	STATUS_ISSUED:           {STATUS_DRAFT, STATUS_ISSUED},
+	STATUS_PARTIALLY_FILLED: {STATUS_ISSUED, STATUS_PARTIALLY_FILLED},
+	STATUS_FILLED:           {STATUS_ISSUED, STATUS_PARTIALLY_FILLED},
+	STATUS_CANCELLED:        {STATUS_DRAFT, STATUS_ISSUED, STATUS_PARTIALLY_FILLED},
+	STATUS_EXPIRED:          {STATUS_ISSUED, STATUS_PARTIALLY_FILLED},
+}
+
+func prescriptionStatus(info map[string]string) string {
+	status, exists := info[infoStatus]
+	if !exists {
+		return STATUS_ISSUED
+	}
+	return status
+}
+
+// checks that the prescription may move to the given status, and records it in info.
+// info is not stored, so that callers can make other changes to it first
+func transitionStatus(pid string, info map[string]string, to string) error {
+	from := prescriptionStatus(info)
+	for _, allowed := range statusTransitions[to] {
+		if from == allowed {
+			info[infoStatus] = to
+			return nil
+		}
+	}
+	return fmt.Errorf("prescription %v cannot be changed from %v to %v", pid, from, to)
+}
+
+func (s *SmartContract) PrescriptionStatus(ctx contractapi.TransactionContextInterface, pid string) (string, error) {
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return "", err
+	}
+	info, err := getPrescriptionInfo(ctx, pid)
+	if err != nil {
+		return "", err
+	}
+	// Confirm that user has access to this prescription in particular.
+	// Expired prescriptions have no copies left, so their owner and
+	// prescriber are let through by the info kept for them
+	expiredParty := prescriptionStatus(info) == STATUS_EXPIRED &&
+		(currentUser == info[infoOwner] || currentUser == info[infoPrescriber])
+	if !expiredParty {
+		err = checkAccess(ctx, pid, currentUser)
+		if err != nil {
+			return "", err
+		}
+	}
+	// Prescriptions that could still be filled are expired once past their validity
+	status := prescriptionStatus(info)
+	if status == STATUS_ISSUED || status == STATUS_PARTIALLY_FILLED {
+		expired, err := isExpired(ctx, info)
+		if err != nil {
+			return "", err
+		}
+		if expired {
+			return STATUS_EXPIRED, nil
+		}
+	}
+	return status, nil
+}
+
+// ============================================================ //
+// Prescription Validity
+// The validity window is given by the doctor when issuing or
+// updating a prescription, as RFC 3339 times in the transient
+// map. Either end may be left out. It is checked against the
+// transaction timestamp, which every endorser agrees on.
+// ============================================================ //
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+	return timestamp.AsTime(), nil
+}
+
+// reads the validity window from the transient map into info. If neither
+// bound is given, the window already in info is kept
+func putTransientValidity(ctx contractapi.TransactionContextInterface, info map[string]string) error {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("failed to read transient map: %v", err)
+	}
+	var from, until time.Time
+	for field, bound := range map[string]*time.Time{transientValidFrom: &from, transientValidUntil: &until} {
+		value := string(transientMap[field])
+		if value == "" {
+			continue
+		}
+		*bound, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("failed to parse %v: %v", field, err)
+		}
+	}
+	if from.IsZero() && until.IsZero() {
+		return nil
+	}
+	if !from.IsZero() && !until.IsZero() && !until.After(from) {
+		return fmt.Errorf("prescription must be valid until after it is valid from")
+	}
+	delete(info, infoValidFrom)
+	delete(info, infoValidUntil)
+	if !from.IsZero() {
+		info[infoValidFrom] = from.UTC().Format(time.RFC3339)
+	}
+	if !until.IsZero() {
+		info[infoValidUntil] = until.UTC().Format(time.RFC3339)
+	}
+	return nil
+}
+
+func isExpired(ctx contractapi.TransactionContextInterface, info map[string]string) (bool, error) {
+	if info[infoValidUntil] == "" {
+		return false, nil
+	}
+	until, err := time.Parse(time.RFC3339, info[infoValidUntil])
+	if err != nil {
+		return false, fmt.Errorf("failed to parse valid until time: %v", err)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return false, err
+	}
+	return now.After(until), nil
+}
+
+// checks that the prescription is within its validity window
+func checkValidity(ctx contractapi.TransactionContextInterface, pid string, info map[string]string) error {
+	expired, err := isExpired(ctx, info)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return fmt.Errorf("prescription %v expired at %v", pid, info[infoValidUntil])
+	}
+	if info[infoValidFrom] == "" {
+		return nil
+	}
+	from, err := time.Parse(time.RFC3339, info[infoValidFrom])
+	if err != nil {
+		return fmt.Errorf("failed to parse valid from time: %v", err)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	if now.Before(from) {
+		return fmt.Errorf("prescription %v is not valid until %v", pid, info[infoValidFrom])
+	}
+	return nil
+}
+
 // ============================================================ //
 // Create Prescription
 // ============================================================ //
-func (s *SmartContract) CreatePrescription(ctx contractapi.TransactionContextInterface, b64prescription string) (string, error) {
+func (s *SmartContract) CreatePrescription(ctx contractapi.TransactionContextInterface, nonce string) (string, error) {
 	// Verify if current user is a Patient
 	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_PATIENT)
 	if err != nil {
 		return "", err
 	}
-
-	// Generate ID, and check if no prescription already exists with the given id
-	pid := genPrescriptionId()
-	prev, err := ctx.GetStub().GetPrivateData(collectionPrescription, pid)
+	b64prescription, err := getTransient(ctx, transientPrescription)
 	if err != nil {
 		return "", err
 	}
-	if prev != nil {
-		return "", fmt.Errorf("cannot create prescription %v as it already exists", pid)
-	}
-	// Get requesting user
-	currentUser := clientObscuredName(ctx)
 
-	// Make map pset, consisting of all different encryptions of the same prescription
-	pset := make(map[string]string)
-	// Insert given b64-encoded & encrypted prescription into the pset where key = current user's name
-	pset[currentUser] = b64prescription
-	// Package the pset
-	b64pset, err := packagePrescriptionSet(&pset)
+	// Generate ID, and check if no prescription already exists with the given id.
+	// On collision, the next attempt number is tried, which every endorser does the same way
+	txID := ctx.GetStub().GetTxID()
+	var pid string
+	for attempt := 0; ; attempt++ {
+		if attempt == maxPidAttempts {
+			return "", fmt.Errorf("cannot create prescription as no unused pid could be generated")
+		}
+		pid = genPrescriptionId(txID, nonce, attempt)
+		recipients, err := prescriptionRecipients(ctx, pid)
+		if err != nil {
+			return "", err
+		}
+		if len(recipients) == 0 {
+			break
+		}
+	}
+	// Insert given b64-encoded & encrypted prescription where recipient = current user's name
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = putPrescriptionEntry(ctx, pid, currentUser, b64prescription)
 	if err != nil {
 		return "", err
 	}
-	err = ctx.GetStub().PutPrivateData(collectionPrescription, pid, []byte(b64pset))
+	// Record the current user as the owning patient, with the prescription yet to be issued
+	err = putPrescriptionInfo(ctx, pid, map[string]string{infoOwner: currentUser, infoStatus: STATUS_DRAFT})
 	if err != nil {
-		return "", fmt.Errorf("failed to add prescription to private data: %v", err)
+		return "", err
 	}
 	return pid, nil
 }
 
+// ============================================================ //
+// Issue Prescription
+// A doctor creates a fully written prescription for a patient,
+// with a copy for the doctor and the patient only. The patient
+// becomes its owner. The pid is chosen by the client, since the
+// prescriber signature inside the copies covers it.
+// ============================================================ //
+func (s *SmartContract) IssuePrescription(ctx contractapi.TransactionContextInterface, pid string, patient string) error {
+	// Verify if current user is a Doctor
+	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_DOCTOR)
+	if err != nil {
+		return err
+	}
+	b64pset, err := getTransient(ctx, transientPset)
+	if err != nil {
+		return err
+	}
+	total, err := getTransientTotal(ctx)
+	if err != nil {
+		return err
+	}
+	// Check that the pid is well formed, and not used by any prescription
+	err = checkPrescriptionIdFormat(pid)
+	if err != nil {
+		return err
+	}
+	recipients, err := prescriptionRecipients(ctx, pid)
+	if err != nil {
+		return err
+	}
+	if len(recipients) != 0 {
+		return fmt.Errorf("cannot issue prescription as pid %v is already in use", pid)
+	}
+	// The patient must be registered, and have a copy along with the doctor
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
+	if patient == currentUser {
+		return fmt.Errorf("doctors cannot issue prescriptions to themselves")
+	}
+	err = checkIfUserPubkeyExists(ctx, patient)
+	if err != nil {
+		return err
+	}
+	pset, err := unpackagePrescriptionSet(b64pset)
+	if err != nil {
+		return err
+	}
+	_, hasDoctor := (*pset)[currentUser]
+	_, hasPatient := (*pset)[patient]
+	if !hasDoctor || !hasPatient || len(*pset) != 2 {
+		return fmt.Errorf("issued prescription must have a copy for exactly the doctor and the patient")
+	}
+	info := map[string]string{
+		infoOwner:      patient,
+		infoPrescriber: currentUser,
+		infoStatus:     STATUS_ISSUED,
+		infoTotal:      strconv.FormatUint(total, 10),
+	}
+	err = putTransientValidity(ctx, info)
+	if err != nil {
+		return err
+	}
+	err = putPrescriptionSet(ctx, pid, pset)
+	if err != nil {
+		return err
+	}
+	return putPrescriptionInfo(ctx, pid, info)
+}
+
 // ============================================================ //
 // Read Prescription
 // ============================================================ //
 func (s *SmartContract) ReadPrescription(ctx contractapi.TransactionContextInterface, pid string) (string, error) {
-	// Get Prescription Set
-	b64pset, err := ctx.GetStub().GetPrivateData(collectionPrescription, pid)
+	// Get only the current user's copy of the prescription
+	currentUser, err := clientObscuredName(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to read prescription: %v", err)
-	}
-	if b64pset == nil {
-		return "", fmt.Errorf("no prescription set to read with given pid: %v", err)
+		return "", err
 	}
-	obscureName := clientObscuredName(ctx)
-	pset, err := unpackageAndCheckAccess(ctx, string(b64pset), obscureName)
+	entry, err := getPrescriptionEntry(ctx, pid, currentUser)
 	if err != nil {
 		return "", err
 	}
-	return (*pset)[obscureName], nil
+	if entry == nil {
+		return "", fmt.Errorf("client does not have access to prescription %v, or it does not exist", pid)
+	}
+	return string(entry), nil
 }
 
 // ============================================================ //
 // Share Prescription
 // ============================================================ //
-func (s *SmartContract) SharePrescription(ctx contractapi.TransactionContextInterface, pid string, shareToUser string, b64prescription string) error {
+func (s *SmartContract) SharePrescription(ctx contractapi.TransactionContextInterface, pid string, shareToUser string) error {
 	// Verify if current user is a Patient
 	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_PATIENT)
 	if err != nil {
 		return err
 	}
-	// Get Prescription Set
-	b64pset, err := ctx.GetStub().GetPrivateData(collectionPrescription, pid)
+	b64prescription, err := getTransient(ctx, transientPrescription)
 	if err != nil {
 		return err
 	}
-	if b64pset == nil {
-		return fmt.Errorf("cannot create prescription %v as it does not exist", pid)
+	// Only the patient who owns the prescription may share it
+	err = checkClientOwner(ctx, pid)
+	if err != nil {
+		return err
+	}
+	// The user shared to must exist, and must not have a copy already
+	err = checkIfUserPubkeyExists(ctx, shareToUser)
+	if err != nil {
+		return err
+	}
+	entry, err := getPrescriptionEntry(ctx, pid, shareToUser)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		return fmt.Errorf("prescription %v is already shared to the given user", pid)
 	}
-	// Unpackage prescription set
-	pset, err := unpackageAndCheckAccess(ctx, string(b64pset), clientObscuredName(ctx))
+	// Insert prescription with recipient=user shared to
+	return putPrescriptionEntry(ctx, pid, shareToUser, b64prescription)
+}
+
+// checks that the current client is the patient who owns the prescription
+func checkClientOwner(ctx contractapi.TransactionContextInterface, pid string) error {
+	currentUser, err := clientObscuredName(ctx)
 	if err != nil {
 		return err
 	}
-	// Insert prescription with key=user shared to
-	(*pset)[shareToUser] = b64prescription
-	// Repackage the prescription set
-	b64updatedpset, err := packagePrescriptionSet(pset)
+	err = checkAccess(ctx, pid, currentUser)
 	if err != nil {
 		return err
 	}
-	// Save to Private Data
-	err = ctx.GetStub().PutPrivateData(collectionPrescription, pid, []byte(b64updatedpset))
+	info, err := getPrescriptionInfo(ctx, pid)
 	if err != nil {
-		return fmt.Errorf("failed to add prescription to private data: %v", err)
+		return err
+	}
+	if info[infoOwner] == "" {
+		return fmt.Errorf("prescription %v has no recorded owner", pid)
+	}
+	if info[infoOwner] != currentUser {
+		return fmt.Errorf("only the patient who owns prescription %v may do this", pid)
 	}
 	return nil
 }
 
+// ============================================================ //
+// Unshare Prescription
+// ============================================================ //
+func (s *SmartContract) UnsharePrescription(ctx contractapi.TransactionContextInterface, pid string, unshareFromUser string) error {
+	// Verify if current user is a Patient
+	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_PATIENT)
+	if err != nil {
+		return err
+	}
+	// The patient cannot remove their own copy of the prescription
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
+	if unshareFromUser == currentUser {
+		return fmt.Errorf("cannot unshare prescription %v from its own patient", pid)
+	}
+	// Only the patient who owns the prescription may unshare it
+	err = checkClientOwner(ctx, pid)
+	if err != nil {
+		return err
+	}
+	// Remove prescription with recipient=user unshared from
+	entry, err := getPrescriptionEntry(ctx, pid, unshareFromUser)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("prescription %v is not shared to the given user", pid)
+	}
+	return delPrescriptionEntry(ctx, pid, unshareFromUser)
+}
+
 // ============================================================ //
 // Users this prescriptin is Shared TO
+// Only users with access may see this. Patients do not see
+// report readers, and pharmacists only see whether the patient
+// and prescriber are present, as the roles PATIENT and DOCTOR.
 // ============================================================ //
 func (s *SmartContract) PrescriptionSharedTo(ctx contractapi.TransactionContextInterface, pid string) (string, error) {
-	// Get Prescription Set
-	b64pset, err := ctx.GetStub().GetPrivateData(collectionPrescription, pid)
+	// Confirm that user has access to this prescription in particular
+	err := checkClientAccess(ctx, pid)
 	if err != nil {
-		return "", fmt.Errorf("failed to read prescription: %v", err)
+		return "", err
 	}
-	if b64pset == nil {
-		return "", fmt.Errorf("no prescription with given pid: %v", err)
+	// Get list of recipients with a partial key query
+	recipients, err := prescriptionRecipients(ctx, pid)
+	if err != nil {
+		return "", err
+	}
+	role, _, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return "", err
+	}
+	switch role {
+	case USER_PATIENT:
+		recipients, err = withoutReportReaders(ctx, recipients)
+		if err != nil {
+			return "", err
+		}
+	case USER_PHARMACIST:
+		recipients, err = presentRoles(ctx, pid, recipients)
+		if err != nil {
+			return "", err
+		}
+	}
+	// Encode this list of recipients
+	b64slice, err := packageStringSlice(&recipients)
+	if err != nil {
+		return "", err
+	}
+	return b64slice, nil
+}
+
+// ============================================================ //
+// Users this prescription is updated for
+// The recipients whose copies must be re-encrypted on an update,
+// which excludes report readers
+// ============================================================ //
+func (s *SmartContract) PrescriptionUpdateRecipients(ctx contractapi.TransactionContextInterface, pid string) (string, error) {
+	// Verify if current user is a Doctor
+	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_DOCTOR)
+	if err != nil {
+		return "", err
+	}
+	// Confirm that user has access to this prescription in particular
+	err = checkClientAccess(ctx, pid)
+	if err != nil {
+		return "", err
 	}
-	// Unpackage the data
-	pset, err := unpackagePrescriptionSet(string(b64pset))
+	recipients, err := prescriptionRecipients(ctx, pid)
 	if err != nil {
-		return "", fmt.Errorf("failed to unpack prescription set: %v", err)
+		return "", err
 	}
-	// Get list of keys in map
-	strslice := make([]string, len(*pset))
-	i := 0
-	for key := range *pset {
-		strslice[i] = key
-		i++
+	recipients, err = withoutReportReaders(ctx, recipients)
+	if err != nil {
+		return "", err
 	}
-	// Encode this list of map keys
-	b64slice, err := packageStringSlice(&strslice)
+	b64slice, err := packageStringSlice(&recipients)
 	if err != nil {
 		return "", err
 	}
 	return b64slice, nil
 }
 
+func withoutReportReaders(ctx contractapi.TransactionContextInterface, recipients []string) ([]string, error) {
+	var filtered []string
+	for _, recipient := range recipients {
+		isReader, err := isReportReader(ctx, recipient)
+		if err != nil {
+			return nil, err
+		}
+		if !isReader {
+			filtered = append(filtered, recipient)
+		}
+	}
+	return filtered, nil
+}
+
+func presentRoles(ctx contractapi.TransactionContextInterface, pid string, recipients []string) ([]string, error) {
+	info, err := getPrescriptionInfo(ctx, pid)
+	if err != nil {
+		return nil, err
+	}
+	var roles []string
+	for _, recipient := range recipients {
+		if info[infoOwner] != "" && recipient == info[infoOwner] {
+			roles = append(roles, USER_PATIENT)
+		}
+		if info[infoPrescriber] != "" && recipient == info[infoPrescriber] {
+			roles = append(roles, USER_DOCTOR)
+		}
+	}
+	return roles, nil
+}
+
 // ============================================================ //
 // Update Prescription
 // ============================================================ //
-func (s *SmartContract) UpdatePrescription(ctx contractapi.TransactionContextInterface, pid string, b64pset string) error {
+func (s *SmartContract) UpdatePrescription(ctx contractapi.TransactionContextInterface, pid string) error {
 	// Verify if current user is a Doctor
 	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_DOCTOR)
 	if err != nil {
 		return err
 	}
-	// Verify if a prescription already exists with the given id
-	oldb64pset, err := ctx.GetStub().GetPrivateData(collectionPrescription, pid)
+	b64pset, err := getTransient(ctx, transientPset)
 	if err != nil {
 		return err
 	}
-	if oldb64pset == nil {
-		return fmt.Errorf("cannot create prescription %v as it does not exist", pid)
-	}
 	// Confirm that user has access to this prescription in particular
-	_, err = unpackageAndCheckAccess(ctx, string(oldb64pset), clientObscuredName(ctx))
+	err = checkClientAccess(ctx, pid)
 	if err != nil {
 		return err
 	}
-	//Upload the update
-	err = ctx.GetStub().PutPrivateData(collectionPrescription, pid, []byte(b64pset))
+	// Confirm that the update has a copy for exactly the current recipients
+	pset, err := unpackagePrescriptionSet(b64pset)
 	if err != nil {
-		return fmt.Errorf("failed to add prescription to private data: %v", err)
+		return err
 	}
-	return nil
+	err = checkPsetRecipients(ctx, pid, pset)
+	if err != nil {
+		return err
+	}
+	// Issue the prescription, and record the current user as the prescriber
+	info, err := getPrescriptionInfo(ctx, pid)
+	if err != nil {
+		return err
+	}
+	err = transitionStatus(pid, info, STATUS_ISSUED)
+	if err != nil {
+		return err
+	}
+	// Record the prescribed quantity, which fills are checked against
+	total, err := getTransientTotal(ctx)
+	if err != nil {
+		return err
+	}
+	info[infoTotal] = strconv.FormatUint(total, 10)
+	err = putTransientValidity(ctx, info)
+	if err != nil {
+		return err
+	}
+	info[infoPrescriber], err = clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
+	err = putPrescriptionInfo(ctx, pid, info)
+	if err != nil {
+		return err
+	}
+	//Upload the update
+	return putPrescriptionSet(ctx, pid, pset)
 }
 
 // ============================================================ //
-// Setfill Prescription
+// Dispense Prescription
+// Records the quantity a pharmacist dispenses as its own record,
+// and adds it to the dispensed total of the prescription. The
+// total can only increase, and never beyond the prescribed
+// quantity. The encrypted prescription is left unchanged.
 // ============================================================ //
-func (s *SmartContract) SetfillPrescription(ctx contractapi.TransactionContextInterface, pid string, b64pset string) error {
+const (
+	dispenseIndex   = "dispense~pid~txid"
+	pharmacistIndex = "pharmacist~pid~txid"
+)
+
+const (
+	dispensePharmacist = "pharmacist"
+	dispenseQuantity   = "quantity"
+	dispenseTimestamp  = "timestamp"
+)
+
+func (s *SmartContract) DispensePrescription(ctx contractapi.TransactionContextInterface, pid string) error {
 	// Verify if current user is a Pharmacist
 	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_PHARMACIST)
 	if err != nil {
 		return err
 	}
-	// Verify if a prescription already exists with the given id
-	oldb64pset, err := ctx.GetStub().GetPrivateData(collectionPrescription, pid)
+	quantity, err := getTransientQuantity(ctx)
 	if err != nil {
 		return err
 	}
-	if oldb64pset == nil {
-		return fmt.Errorf("cannot create prescription %v as it does not exist", pid)
+	if quantity == 0 {
+		return fmt.Errorf("dispensed quantity must be greater than zero")
+	}
+	// Confirm that user has access to this prescription in particular
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkAccess(ctx, pid, currentUser)
+	if err != nil {
+		return err
+	}
+	// Check the new dispensed total against the prescribed quantity
+	info, err := getPrescriptionInfo(ctx, pid)
+	if err != nil {
+		return err
+	}
+	if info[infoTotal] == "" {
+		return fmt.Errorf("prescription %v has no prescribed quantity, and must be updated by its doctor first", pid)
+	}
+	err = checkValidity(ctx, pid, info)
+	if err != nil {
+		return err
+	}
+	total, err := strconv.ParseUint(info[infoTotal], 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse prescribed quantity: %v", err)
+	}
+	var dispensed uint64
+	if info[infoDispensed] != "" {
+		dispensed, err = strconv.ParseUint(info[infoDispensed], 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse dispensed quantity: %v", err)
+		}
+	}
+	if quantity > total-dispensed {
+		return fmt.Errorf("cannot dispense %v of prescription %v, as only %v of %v remain", quantity, pid, total-dispensed, total)
+	}
+	dispensed += quantity
+	status := STATUS_PARTIALLY_FILLED
+	if dispensed == total {
+		status = STATUS_FILLED
+	}
+	err = transitionStatus(pid, info, status)
+	if err != nil {
+		return err
+	}
+	info[infoDispensed] = strconv.FormatUint(dispensed, 10)
+	err = putPrescriptionInfo(ctx, pid, info)
+	if err != nil {
+		return err
+	}
+	// Store the dispense record, using the tx timestamp so every endorser agrees on it
+	timestamp, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	record := map[string]string{
+		dispensePharmacist: currentUser,
+		dispenseQuantity:   strconv.FormatUint(quantity, 10),
+		dispenseTimestamp:  timestamp.UTC().Format(time.RFC3339),
 	}
+	key, err := ctx.GetStub().CreateCompositeKey(dispenseIndex, []string{pid, ctx.GetStub().GetTxID()})
+	if err != nil {
+		return err
+	}
+	encoded, err := encodeCanonicalMap(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode dispense record: %v", err)
+	}
+	err = ctx.GetStub().PutPrivateData(collectionPrescription, key, encoded)
+	if err != nil {
+		return fmt.Errorf("failed to store dispense record: %v", err)
+	}
+	return putPharmacistIndex(ctx, currentUser, pid, ctx.GetStub().GetTxID())
+}
+
+// indexes a dispense record by its pharmacist, so that their records can be found without scanning every record
+func putPharmacistIndex(ctx contractapi.TransactionContextInterface, pharmacist string, pid string, txID string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(pharmacistIndex, []string{pharmacist, pid, txID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutPrivateData(collectionPrescription, key, []byte{0x00})
+	if err != nil {
+		return fmt.Errorf("failed to index dispense record: %v", err)
+	}
+	return nil
+}
+
+func delPharmacistIndex(ctx contractapi.TransactionContextInterface, pharmacist string, pid string, txID string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(pharmacistIndex, []string{pharmacist, pid, txID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().DelPrivateData(collectionPrescription, key)
+	if err != nil {
+		return fmt.Errorf("error in deleting dispense record index: %v", err)
+	}
+	return nil
+}
 
+// ============================================================ //
+// Prescription Dispenses
+// Returns every dispense record of the prescription, each one
+// canonically encoded then base64 encoded, as a packaged string
+// slice
+// ============================================================ //
+func (s *SmartContract) PrescriptionDispenses(ctx contractapi.TransactionContextInterface, pid string) (string, error) {
 	// Confirm that user has access to this prescription in particular
-	_, err = unpackageAndCheckAccess(ctx, string(oldb64pset), clientObscuredName(ctx))
+	err := checkClientAccess(ctx, pid)
+	if err != nil {
+		return "", err
+	}
+	records, err := dispenseRecords(ctx, pid)
+	if err != nil {
+		return "", err
+	}
+	return packageStringSlice(&records)
+}
+
+func dispenseRecords(ctx contractapi.TransactionContextInterface, pid string) ([]string, error) {
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collectionPrescription, dispenseIndex, []string{pid})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	var records []string
+	for resultsIterator.HasNext() {
+		entry, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, base64.StdEncoding.EncodeToString(entry.Value))
+	}
+	return records, nil
+}
+
+// reads the quantity given in the transient map
+func getTransientQuantity(ctx contractapi.TransactionContextInterface) (uint64, error) {
+	str, err := getTransient(ctx, transientQuantity)
+	if err != nil {
+		return 0, err
+	}
+	quantity, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse quantity: %v", err)
+	}
+	return quantity, nil
+}
+
+// reads the prescribed quantity given in the transient map, which must not be zero
+func getTransientTotal(ctx contractapi.TransactionContextInterface) (uint64, error) {
+	total, err := getTransientQuantity(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("prescribed quantity must be greater than zero")
+	}
+	return total, nil
+}
+
+// writes every copy in the given pset to its own recipient's key
+func putPrescriptionSet(ctx contractapi.TransactionContextInterface, pid string, pset *map[string]string) error {
+	for recipient, b64prescription := range *pset {
+		err := putPrescriptionEntry(ctx, pid, recipient, b64prescription)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checks that the pset has a copy for exactly the users the prescription is shared to.
+// Report readers are left out, as their copies can only be changed with UpdateReport
+func checkPsetRecipients(ctx contractapi.TransactionContextInterface, pid string, pset *map[string]string) error {
+	recipients, err := prescriptionRecipients(ctx, pid)
 	if err != nil {
 		return err
 	}
-	//Upload the update
-	err = ctx.GetStub().PutPrivateData(collectionPrescription, pid, []byte(b64pset))
+	recipients, err = withoutReportReaders(ctx, recipients)
 	if err != nil {
-		return fmt.Errorf("failed to add prescription to private data: %v", err)
+		return err
+	}
+	for _, recipient := range recipients {
+		_, exists := (*pset)[recipient]
+		if !exists {
+			return fmt.Errorf("update for prescription %v is missing the copy of an existing recipient", pid)
+		}
+	}
+	if len(*pset) != len(recipients) {
+		return fmt.Errorf("update for prescription %v adds recipients it is not shared to, or changes a report reader's copy", pid)
 	}
 	return nil
 }
@@ -206,6 +812,192 @@ func (s *SmartContract) SetfillPrescription(ctx contractapi.TransactionContextIn
 // Delete Prescription
 // ============================================================ //
 func (s *SmartContract) DeletePrescription(ctx contractapi.TransactionContextInterface, pid string) error {
+	// Verify if current user is a Patient
+	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_PATIENT)
+	if err != nil {
+		return err
+	}
+	// Only the patient who owns the prescription may delete it
+	err = checkClientOwner(ctx, pid)
+	if err != nil {
+		return err
+	}
+	// Prescriptions that can still be filled must be cancelled first
+	info, err := getPrescriptionInfo(ctx, pid)
+	if err != nil {
+		return err
+	}
+	status := prescriptionStatus(info)
+	if status == STATUS_ISSUED || status == STATUS_PARTIALLY_FILLED {
+		return fmt.Errorf("prescription %v is %v, and must be cancelled before it is deleted", pid, status)
+	}
+	return removePrescription(ctx, pid, ctx.GetStub().DelPrivateData)
+}
+
+// removes every recipient's copy of the prescription, its dispense records
+// and its info, along with their index keys, using either DelPrivateData or
+// PurgePrivateData
+func removePrescription(ctx contractapi.TransactionContextInterface, pid string, remove func(collection string, key string) error) error {
+	err := removePrescriptionData(ctx, pid, remove)
+	if err != nil {
+		return err
+	}
+	infoKey, err := ctx.GetStub().CreateCompositeKey(infoIndex, []string{pid})
+	if err != nil {
+		return err
+	}
+	err = remove(collectionPrescription, infoKey)
+	if err != nil {
+		return fmt.Errorf("error in removing prescription info: %v", err)
+	}
+	return nil
+}
+
+// removes every recipient's copy of the prescription and its dispense
+// records, along with their index keys, leaving its info
+func removePrescriptionData(ctx contractapi.TransactionContextInterface, pid string, remove func(collection string, key string) error) error {
+	// Remove every recipient's copy
+	recipients, err := prescriptionRecipients(ctx, pid)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		for _, key := range [][]string{{psetIndex, pid, recipient}, {recipientIndex, recipient, pid}, {reportIndex, recipient, pid}} {
+			compositeKey, err := ctx.GetStub().CreateCompositeKey(key[0], key[1:])
+			if err != nil {
+				return err
+			}
+			err = remove(collectionPrescription, compositeKey)
+			if err != nil {
+				return fmt.Errorf("error in removing prescription data: %v", err)
+			}
+		}
+	}
+	// Remove its dispense records
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collectionPrescription, dispenseIndex, []string{pid})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		entry, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		err = remove(collectionPrescription, entry.Key)
+		if err != nil {
+			return fmt.Errorf("error in removing dispense record: %v", err)
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return err
+		}
+		record, err := decodeCanonicalMap(entry.Value)
+		if err != nil {
+			return err
+		}
+		indexKey, err := ctx.GetStub().CreateCompositeKey(pharmacistIndex, []string{record[dispensePharmacist], parts[0], parts[1]})
+		if err != nil {
+			return err
+		}
+		err = remove(collectionPrescription, indexKey)
+		if err != nil {
+			return fmt.Errorf("error in removing dispense record index: %v", err)
+		}
+	}
+	return nil
+}
+
+// ============================================================ //
+// Cancel Prescription
+// ============================================================ //
+func (s *SmartContract) CancelPrescription(ctx contractapi.TransactionContextInterface, pid string) error {
+	// Verify if current user is a Patient or Doctor
+	not_patient := ctx.GetClientIdentity().AssertAttributeValue("role", USER_PATIENT)
+	not_doctor := ctx.GetClientIdentity().AssertAttributeValue("role", USER_DOCTOR)
+	if not_patient != nil && not_doctor != nil {
+		return fmt.Errorf("client certificate does not have role=PATIENT or role=DOCTOR. cannot cancel prescription")
+	}
+	return changeStatus(ctx, pid, STATUS_CANCELLED)
+}
+
+// ============================================================ //
+// Expire Prescription
+// The prescriber may expire a prescription at any time, while
+// other doctors and pharmacists may only once it is past its
+// validity. An expired prescription can never be dispensed
+// again, so every copy of it is purged from private data, along
+// with its dispense records. Its info is kept with the EXPIRED
+// status, so that its owner and prescriber can still see that it
+// expired. Purging also removes the private data from the
+// history of the peers, which needs Fabric 2.5 or later.
+// ============================================================ //
+func (s *SmartContract) ExpirePrescription(ctx contractapi.TransactionContextInterface, pid string) error {
+	// Verify if current user is a Doctor or Pharmacist
+	not_doctor := ctx.GetClientIdentity().AssertAttributeValue("role", USER_DOCTOR)
+	not_pharma := ctx.GetClientIdentity().AssertAttributeValue("role", USER_PHARMACIST)
+	if not_doctor != nil && not_pharma != nil {
+		return fmt.Errorf("client certificate does not have role=DOCTOR or role=PHARMA. cannot expire prescription")
+	}
+	// Confirm that user has access to this prescription in particular
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkAccess(ctx, pid, currentUser)
+	if err != nil {
+		return err
+	}
+	info, err := getPrescriptionInfo(ctx, pid)
+	if err != nil {
+		return err
+	}
+	if not_doctor != nil || info[infoPrescriber] != currentUser {
+		expired, err := isExpired(ctx, info)
+		if err != nil {
+			return err
+		}
+		if !expired {
+			return fmt.Errorf("only the prescriber may expire prescription %v before its valid until time", pid)
+		}
+	}
+	err = transitionStatus(pid, info, STATUS_EXPIRED)
+	if err != nil {
+		return err
+	}
+	err = removePrescriptionData(ctx, pid, ctx.GetStub().PurgePrivateData)
+	if err != nil {
+		return err
+	}
+	return putPrescriptionInfo(ctx, pid, info)
+}
+
+// moves a prescription the current user has access to into the given status
+func changeStatus(ctx contractapi.TransactionContextInterface, pid string, status string) error {
+	// Confirm that user has access to this prescription in particular
+	err := checkClientAccess(ctx, pid)
+	if err != nil {
+		return err
+	}
+	info, err := getPrescriptionInfo(ctx, pid)
+	if err != nil {
+		return err
+	}
+	err = transitionStatus(pid, info, status)
+	if err != nil {
+		return err
+	}
+	return putPrescriptionInfo(ctx, pid, info)
+}
+
+// ============================================================ //
+// Migrate Prescription
+// Splits a legacy prescription set, stored as one value under
+// the pid, into one entry per recipient. Legacy prescriptions
+// have no info, so the patient who migrates one is recorded as
+// its owner, which lets them share, unshare and delete it.
+// ============================================================ //
+func (s *SmartContract) MigratePrescription(ctx contractapi.TransactionContextInterface, pid string) error {
 	// Verify if current user is a Patient
 	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_PATIENT)
 	if err != nil {
@@ -217,14 +1009,32 @@ func (s *SmartContract) DeletePrescription(ctx contractapi.TransactionContextInt
 		return err
 	}
 	if oldb64pset == nil {
-		return fmt.Errorf("cannot delete prescription %v as it does not exist", pid)
+		return fmt.Errorf("cannot migrate prescription %v as it does not exist", pid)
 	}
 	// Confirm that user has access to this prescription in particular
-	_, err = unpackageAndCheckAccess(ctx, string(oldb64pset), clientObscuredName(ctx))
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
+	pset, err := unpackageAndCheckAccess(ctx, string(oldb64pset), currentUser)
+	if err != nil {
+		return err
+	}
+	err = putPrescriptionSet(ctx, pid, pset)
+	if err != nil {
+		return err
+	}
+	info, err := getPrescriptionInfo(ctx, pid)
 	if err != nil {
 		return err
 	}
-	// Delete data
+	if info[infoOwner] == "" {
+		info[infoOwner] = currentUser
+		err = putPrescriptionInfo(ctx, pid, info)
+		if err != nil {
+			return err
+		}
+	}
 	err = ctx.GetStub().DelPrivateData(collectionPrescription, pid)
 	if err != nil {
 		return fmt.Errorf("error in deleting prescription data: %v", err)
@@ -0,0 +1,375 @@
+package src
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const testPid = "0123-4567-M"
+
+// has the doctor issue testPid to the patient with the given transient fields,
+// besides the prescription set, and has the patient share it to the pharmacist
+func issueTestPrescription(t *testing.T, stub *mockStub, transient map[string]string) {
+	t.Helper()
+	for _, user := range []string{"doctor", "patient", "pharmacist"} {
+		stub.registerUser(user)
+	}
+	fields := map[string]string{
+		transientPset: testPset(t, map[string]string{
+			testObscuredName("doctor"):  "copy of doctor",
+			testObscuredName("patient"): "copy of patient",
+		}),
+	}
+	for field, value := range transient {
+		fields[field] = value
+	}
+	stub.newTx(fields)
+	err := new(SmartContract).IssuePrescription(stub.as("doctor", USER_DOCTOR), testPid, testObscuredName("patient"))
+	if err != nil {
+		t.Fatalf("IssuePrescription: %v", err)
+	}
+	stub.newTx(map[string]string{transientPrescription: "copy of pharmacist"})
+	err = new(SmartContract).SharePrescription(stub.as("patient", USER_PATIENT), testPid, testObscuredName("pharmacist"))
+	if err != nil {
+		t.Fatalf("SharePrescription: %v", err)
+	}
+}
+
+func testInfo(t *testing.T, stub *mockStub) map[string]string {
+	t.Helper()
+	stub.newTx(nil)
+	info, err := getPrescriptionInfo(stub.as("doctor", USER_DOCTOR), testPid)
+	if err != nil {
+		t.Fatalf("getPrescriptionInfo: %v", err)
+	}
+	return info
+}
+
+func TestTransitionStatus(t *testing.T) {
+	// the statuses each status may be entered from, written out rather than
+	// read from statusTransitions so that a change to it is caught
+	allowed := map[string][]string{
+		STATUS_DRAFT:            {},
+		STATUS_ISSUED:           {STATUS_DRAFT, STATUS_ISSUED},
+		STATUS_PARTIALLY_FILLED: {STATUS_ISSUED, STATUS_PARTIALLY_FILLED},
+		STATUS_FILLED:           {STATUS_ISSUED, STATUS_PARTIALLY_FILLED},
+		STATUS_CANCELLED:        {STATUS_DRAFT, STATUS_ISSUED, STATUS_PARTIALLY_FILLED},
+		STATUS_EXPIRED:          {STATUS_ISSUED, STATUS_PARTIALLY_FILLED},
+	}
+	for to, froms := range allowed {
+		for from := range allowed {
+			want := false
+			for _, allowedFrom := range froms {
+				want = want || from == allowedFrom
+			}
+			info := map[string]string{infoStatus: from}
+			err := transitionStatus(testPid, info, to)
+			if (err == nil) != want {
+				t.Fatalf("transitionStatus from %v to %v = %v, want allowed %v", from, to, err, want)
+			}
+			if want && info[infoStatus] != to || !want && info[infoStatus] != from {
+				t.Fatalf("transitionStatus from %v to %v left status %v", from, to, info[infoStatus])
+			}
+		}
+		// prescriptions migrated without a status are treated as ISSUED
+		err := transitionStatus(testPid, map[string]string{}, to)
+		if (err == nil) != (to != STATUS_DRAFT) {
+			t.Fatalf("transitionStatus from no status to %v = %v", to, err)
+		}
+	}
+}
+
+func TestIssuePrescriptionRejectsZeroTotal(t *testing.T) {
+	stub := newMockStub()
+	stub.registerUser("patient")
+	stub.newTx(map[string]string{
+		transientPset: testPset(t, map[string]string{
+			testObscuredName("doctor"):  "copy of doctor",
+			testObscuredName("patient"): "copy of patient",
+		}),
+		transientQuantity: "0",
+	})
+	err := new(SmartContract).IssuePrescription(stub.as("doctor", USER_DOCTOR), testPid, testObscuredName("patient"))
+	if err == nil {
+		t.Fatalf("IssuePrescription with a quantity of 0 succeeded, want an error")
+	}
+}
+
+func TestDispensePrescription(t *testing.T) {
+	stub := newMockStub()
+	issueTestPrescription(t, stub, map[string]string{transientQuantity: "10"})
+	steps := []struct {
+		quantity  string
+		ok        bool
+		status    string
+		dispensed string
+	}{
+		{"0", false, STATUS_ISSUED, ""},
+		{"11", false, STATUS_ISSUED, ""},
+		{"-1", false, STATUS_ISSUED, ""},
+		{"4", true, STATUS_PARTIALLY_FILLED, "4"},
+		{"7", false, STATUS_PARTIALLY_FILLED, "4"},
+		{"6", true, STATUS_FILLED, "10"},
+		{"1", false, STATUS_FILLED, "10"},
+	}
+	for _, step := range steps {
+		stub.newTx(map[string]string{transientQuantity: step.quantity})
+		err := new(SmartContract).DispensePrescription(stub.as("pharmacist", USER_PHARMACIST), testPid)
+		if (err == nil) != step.ok {
+			t.Fatalf("dispensing %v = %v, want success %v", step.quantity, err, step.ok)
+		}
+		info := testInfo(t, stub)
+		if info[infoStatus] != step.status || info[infoDispensed] != step.dispensed {
+			t.Fatalf("after dispensing %v, status is %v with %v dispensed, want %v with %v",
+				step.quantity, info[infoStatus], info[infoDispensed], step.status, step.dispensed)
+		}
+	}
+	records, err := dispenseRecords(stub.as("doctor", USER_DOCTOR), testPid)
+	if err != nil {
+		t.Fatalf("dispenseRecords: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("dispenseRecords = %v records, want 2", len(records))
+	}
+}
+
+func TestDispensePrescriptionAccess(t *testing.T) {
+	stub := newMockStub()
+	issueTestPrescription(t, stub, map[string]string{transientQuantity: "10"})
+	callers := []struct {
+		user string
+		role string
+	}{
+		{"doctor", USER_DOCTOR},
+		{"patient", USER_PATIENT},
+		{"stranger", USER_PHARMACIST},
+	}
+	for _, caller := range callers {
+		stub.newTx(map[string]string{transientQuantity: "1"})
+		err := new(SmartContract).DispensePrescription(stub.as(caller.user, caller.role), testPid)
+		if err == nil {
+			t.Fatalf("DispensePrescription by %v succeeded, want an error", caller.user)
+		}
+	}
+}
+
+func TestDispensePrescriptionValidity(t *testing.T) {
+	stub := newMockStub()
+	issueTestPrescription(t, stub, map[string]string{
+		transientQuantity:   "10",
+		transientValidFrom:  testTxTime.Add(24 * time.Hour).Format(time.RFC3339),
+		transientValidUntil: testTxTime.Add(48 * time.Hour).Format(time.RFC3339),
+	})
+	times := []struct {
+		after time.Duration
+		ok    bool
+	}{
+		{12 * time.Hour, false},
+		{36 * time.Hour, true},
+		{60 * time.Hour, false},
+	}
+	for _, tt := range times {
+		stub.TxTimestamp = timestamppb.New(testTxTime.Add(tt.after))
+		stub.newTx(map[string]string{transientQuantity: "1"})
+		err := new(SmartContract).DispensePrescription(stub.as("pharmacist", USER_PHARMACIST), testPid)
+		if (err == nil) != tt.ok {
+			t.Fatalf("dispensing %v after issue = %v, want success %v", tt.after, err, tt.ok)
+		}
+	}
+	stub.newTx(nil)
+	status, err := new(SmartContract).PrescriptionStatus(stub.as("patient", USER_PATIENT), testPid)
+	if err != nil || status != STATUS_EXPIRED {
+		t.Fatalf("PrescriptionStatus past its validity = %v, %v, want %v", status, err, STATUS_EXPIRED)
+	}
+}
+
+func TestCheckPsetRecipients(t *testing.T) {
+	stub := newMockStub()
+	issueTestPrescription(t, stub, map[string]string{transientQuantity: "10"})
+	stub.registerUser("reader")
+	stub.PutPrivateData(collectionReportReaders, testObscuredName("reader"), []byte(testObscuredName("reader")))
+	putPrescriptionEntry(stub.as("doctor", USER_DOCTOR), testPid, testObscuredName("reader"), "report of reader")
+
+	psets := []struct {
+		name  string
+		users []string
+		ok    bool
+	}{
+		{"every recipient", []string{"doctor", "patient", "pharmacist"}, true},
+		{"a missing recipient", []string{"doctor", "patient"}, false},
+		{"an extra user", []string{"doctor", "patient", "pharmacist", "stranger"}, false},
+		{"the report reader", []string{"doctor", "patient", "pharmacist", "reader"}, false},
+	}
+	for _, tt := range psets {
+		pset := make(map[string]string)
+		for _, user := range tt.users {
+			pset[testObscuredName(user)] = "update of " + user
+		}
+		stub.newTx(nil)
+		err := checkPsetRecipients(stub.as("doctor", USER_DOCTOR), testPid, &pset)
+		if (err == nil) != tt.ok {
+			t.Fatalf("checkPsetRecipients with %v = %v, want success %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestUpdatePrescriptionRejectsZeroTotal(t *testing.T) {
+	stub := newMockStub()
+	issueTestPrescription(t, stub, map[string]string{transientQuantity: "10"})
+	pset := map[string]string{}
+	for _, user := range []string{"doctor", "patient", "pharmacist"} {
+		pset[testObscuredName(user)] = "update of " + user
+	}
+	stub.newTx(map[string]string{transientPset: testPset(t, pset), transientQuantity: "0"})
+	err := new(SmartContract).UpdatePrescription(stub.as("doctor", USER_DOCTOR), testPid)
+	if err == nil {
+		t.Fatalf("UpdatePrescription with a quantity of 0 succeeded, want an error")
+	}
+	if info := testInfo(t, stub); info[infoTotal] != "10" {
+		t.Fatalf("rejected update changed the prescribed quantity to %v", info[infoTotal])
+	}
+}
+
+func TestOwnerChecks(t *testing.T) {
+	stub := newMockStub()
+	issueTestPrescription(t, stub, map[string]string{transientQuantity: "10"})
+	stub.registerUser("other")
+	// another patient with a copy is not the owner
+	putPrescriptionEntry(stub.as("doctor", USER_DOCTOR), testPid, testObscuredName("other"), "copy of other")
+	contract := new(SmartContract)
+
+	stub.newTx(map[string]string{transientPrescription: "copy of doctor"})
+	if err := contract.SharePrescription(stub.as("other", USER_PATIENT), testPid, testObscuredName("doctor")); err == nil {
+		t.Fatalf("SharePrescription by a patient who is not the owner succeeded")
+	}
+	stub.newTx(nil)
+	if err := contract.UnsharePrescription(stub.as("other", USER_PATIENT), testPid, testObscuredName("pharmacist")); err == nil {
+		t.Fatalf("UnsharePrescription by a patient who is not the owner succeeded")
+	}
+	stub.newTx(nil)
+	if err := contract.DeletePrescription(stub.as("other", USER_PATIENT), testPid); err == nil {
+		t.Fatalf("DeletePrescription by a patient who is not the owner succeeded")
+	}
+	stub.newTx(nil)
+	if err := contract.UnsharePrescription(stub.as("patient", USER_PATIENT), testPid, testObscuredName("patient")); err == nil {
+		t.Fatalf("UnsharePrescription of the owner's own copy succeeded")
+	}
+	stub.newTx(nil)
+	if err := contract.DeletePrescription(stub.as("patient", USER_PATIENT), testPid); err == nil {
+		t.Fatalf("DeletePrescription of an issued prescription succeeded")
+	}
+
+	stub.newTx(nil)
+	if err := contract.UnsharePrescription(stub.as("patient", USER_PATIENT), testPid, testObscuredName("other")); err != nil {
+		t.Fatalf("UnsharePrescription by the owner: %v", err)
+	}
+	stub.newTx(nil)
+	if err := contract.CancelPrescription(stub.as("patient", USER_PATIENT), testPid); err != nil {
+		t.Fatalf("CancelPrescription by the owner: %v", err)
+	}
+	stub.newTx(nil)
+	if err := contract.DeletePrescription(stub.as("patient", USER_PATIENT), testPid); err != nil {
+		t.Fatalf("DeletePrescription by the owner: %v", err)
+	}
+	if len(stub.PvtState[collectionPrescription]) != 0 {
+		t.Fatalf("DeletePrescription left %v keys behind", len(stub.PvtState[collectionPrescription]))
+	}
+}
+
+func TestMigratePrescriptionRecordsOwner(t *testing.T) {
+	stub := newMockStub()
+	for _, user := range []string{"doctor", "patient", "pharmacist"} {
+		stub.registerUser(user)
+	}
+	legacy := testPset(t, map[string]string{
+		testObscuredName("doctor"):  "copy of doctor",
+		testObscuredName("patient"): "copy of patient",
+	})
+	stub.PutPrivateData(collectionPrescription, testPid, []byte(legacy))
+	contract := new(SmartContract)
+
+	stub.newTx(nil)
+	if err := contract.MigratePrescription(stub.as("doctor", USER_DOCTOR), testPid); err == nil {
+		t.Fatalf("MigratePrescription by a doctor succeeded, want an error")
+	}
+	stub.newTx(nil)
+	if err := contract.MigratePrescription(stub.as("patient", USER_PATIENT), testPid); err != nil {
+		t.Fatalf("MigratePrescription: %v", err)
+	}
+	if info := testInfo(t, stub); info[infoOwner] != testObscuredName("patient") {
+		t.Fatalf("migrated prescription has owner %q, want the patient", info[infoOwner])
+	}
+	stub.newTx(map[string]string{transientPrescription: "copy of pharmacist"})
+	if err := contract.SharePrescription(stub.as("patient", USER_PATIENT), testPid, testObscuredName("pharmacist")); err != nil {
+		t.Fatalf("SharePrescription of a migrated prescription: %v", err)
+	}
+}
+
+func TestExpirePrescription(t *testing.T) {
+	stub := newMockStub()
+	issueTestPrescription(t, stub, map[string]string{
+		transientQuantity:   "10",
+		transientValidUntil: testTxTime.Add(24 * time.Hour).Format(time.RFC3339),
+	})
+	stub.registerUser("other")
+	putPrescriptionEntry(stub.as("doctor", USER_DOCTOR), testPid, testObscuredName("other"), "copy of other")
+	stub.newTx(map[string]string{transientQuantity: "4"})
+	err := new(SmartContract).DispensePrescription(stub.as("pharmacist", USER_PHARMACIST), testPid)
+	if err != nil {
+		t.Fatalf("DispensePrescription: %v", err)
+	}
+	contract := new(SmartContract)
+
+	// only the prescriber may expire it before its valid until time
+	stub.newTx(nil)
+	if err := contract.ExpirePrescription(stub.as("pharmacist", USER_PHARMACIST), testPid); err == nil {
+		t.Fatalf("early ExpirePrescription by a pharmacist succeeded")
+	}
+	stub.newTx(nil)
+	if err := contract.ExpirePrescription(stub.as("other", USER_DOCTOR), testPid); err == nil {
+		t.Fatalf("early ExpirePrescription by a doctor who is not the prescriber succeeded")
+	}
+	stub.newTx(nil)
+	if err := contract.ExpirePrescription(stub.as("doctor", USER_DOCTOR), testPid); err != nil {
+		t.Fatalf("early ExpirePrescription by the prescriber: %v", err)
+	}
+
+	// every copy and dispense record is purged, leaving the info with its status
+	infoKey, _ := stub.CreateCompositeKey(infoIndex, []string{testPid})
+	for key := range stub.PvtState[collectionPrescription] {
+		if key != infoKey {
+			t.Fatalf("ExpirePrescription left key %q", strings.ReplaceAll(key, "\x00", " "))
+		}
+	}
+	if info := testInfo(t, stub); info[infoStatus] != STATUS_EXPIRED {
+		t.Fatalf("expired prescription has status %v", info[infoStatus])
+	}
+	for user, role := range map[string]string{"doctor": USER_DOCTOR, "patient": USER_PATIENT} {
+		stub.newTx(nil)
+		status, err := contract.PrescriptionStatus(stub.as(user, role), testPid)
+		if err != nil || status != STATUS_EXPIRED {
+			t.Fatalf("PrescriptionStatus of an expired prescription for %v = %v, %v", user, status, err)
+		}
+	}
+	stub.newTx(nil)
+	if _, err := contract.PrescriptionStatus(stub.as("pharmacist", USER_PHARMACIST), testPid); err == nil {
+		t.Fatalf("PrescriptionStatus of an expired prescription succeeded for its pharmacist")
+	}
+}
+
+func TestExpirePrescriptionPastValidity(t *testing.T) {
+	stub := newMockStub()
+	issueTestPrescription(t, stub, map[string]string{
+		transientQuantity:   "10",
+		transientValidUntil: testTxTime.Add(24 * time.Hour).Format(time.RFC3339),
+	})
+	stub.TxTimestamp = timestamppb.New(testTxTime.Add(48 * time.Hour))
+	stub.newTx(nil)
+	err := new(SmartContract).ExpirePrescription(stub.as("pharmacist", USER_PHARMACIST), testPid)
+	if err != nil {
+		t.Fatalf("ExpirePrescription past its validity by a pharmacist: %v", err)
+	}
+}
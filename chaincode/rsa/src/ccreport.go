@@ -6,13 +6,25 @@ import (
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
+// ============================================================ //
+// REPORT ENTRIES
+// A report reader's copy of a prescription is stored as an
+// ordinary prescription entry, which UpdateReport also indexes
+// under an empty reader~pid key, so that the copies made for
+// reports can be told apart from copies shared to the reader.
+// ============================================================ //
+const reportIndex = "report~reader~pid"
+
 func (s *SmartContract) RegisterMeAsReportReader(ctx contractapi.TransactionContextInterface) error {
 	// Verify if current user is a Report Reader role
 	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_READER)
 	if err != nil {
 		return err
 	}
-	obscuredName := clientObscuredName(ctx)
+	obscuredName, err := clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
 	//verify if user has public key information (i.e. if the user exists properly)
 	err = checkIfUserPubkeyExists(ctx, obscuredName)
 	if err != nil {
@@ -27,15 +39,54 @@ func (s *SmartContract) RegisterMeAsReportReader(ctx contractapi.TransactionCont
 }
 
 func (s *SmartContract) UnregisterMeAsReportReader(ctx contractapi.TransactionContextInterface) error {
-	obscuredName := clientObscuredName(ctx)
+	// Verify if current user is a Report Reader role
+	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_READER)
+	if err != nil {
+		return err
+	}
+	obscuredName, err := clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
+	isReader, err := isReportReader(ctx, obscuredName)
+	if err != nil {
+		return err
+	}
+	if !isReader {
+		return fmt.Errorf("given user is not a report reader")
+	}
+	// remove the reports encrypted for them, so that they are not taken for ordinary recipients.
+	// copies shared to them as an ordinary recipient are kept
+	pids, err := reportPrescriptions(ctx, obscuredName)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		err = delPrescriptionEntry(ctx, pid, obscuredName)
+		if err != nil {
+			return err
+		}
+		err = delReportIndex(ctx, obscuredName, pid)
+		if err != nil {
+			return err
+		}
+	}
 	// remove the given report reader
-	err := ctx.GetStub().DelPrivateData(collectionReportReaders, obscuredName)
+	err = ctx.GetStub().DelPrivateData(collectionReportReaders, obscuredName)
 	if err != nil {
 		return fmt.Errorf("error in removing report reader: %v", err)
 	}
 	return nil
 }
 
+func isReportReader(ctx contractapi.TransactionContextInterface, obscuredName string) (bool, error) {
+	exists, err := ctx.GetStub().GetPrivateData(collectionReportReaders, obscuredName)
+	if err != nil {
+		return false, fmt.Errorf("failed to check report readers: %v", err)
+	}
+	return exists != nil, nil
+}
+
 func (s *SmartContract) GetAllReportReaders(ctx contractapi.TransactionContextInterface) (string, error) {
 	resultsIterator, err := ctx.GetStub().GetPrivateDataByRange(collectionReportReaders, "", "")
 	if err != nil {
@@ -58,41 +109,44 @@ func (s *SmartContract) GetAllReportReaders(ctx contractapi.TransactionContextIn
 	return b64slice, nil
 }
 
-func (s *SmartContract) UpdateReport(ctx contractapi.TransactionContextInterface, pid string, b64reports string) error {
-	// Verify if current user is a Doctor or Pharmacist (This is intended to be called directly after Update or Setfill)
-	not_doctor := ctx.GetClientIdentity().AssertAttributeValue("role", USER_DOCTOR)
-	not_pharma := ctx.GetClientIdentity().AssertAttributeValue("role", USER_PHARMACIST)
-	if not_doctor != nil && not_pharma != nil {
-		return fmt.Errorf("client certificate does not have role=DOCTOR or role=PHARMA. cannot update report")
-	}
-	// unpack the b64 reports
-	reportset, err := unpackagePrescriptionSet(b64reports)
+func (s *SmartContract) UpdateReport(ctx contractapi.TransactionContextInterface, pid string) error {
+	// Verify if current user is a Doctor (This is intended to be called directly after Update)
+	err := ctx.GetClientIdentity().AssertAttributeValue("role", USER_DOCTOR)
 	if err != nil {
 		return err
 	}
-	// get the current pset for the given pid
-	b64pset, err := ctx.GetStub().GetPrivateData(collectionPrescription, pid)
+	// unpack the b64 reports
+	b64reports, err := getTransient(ctx, transientReports)
 	if err != nil {
 		return err
 	}
-	// Unpackage pset and check access
-	pset, err := unpackageAndCheckAccess(ctx, string(b64pset), clientObscuredName(ctx))
+	reportset, err := unpackagePrescriptionSet(b64reports)
 	if err != nil {
 		return err
 	}
-	// Iterate over the report set and add each prescription inside to the pset
-	for key, value := range *reportset {
-		(*pset)[key] = value
-	}
-	// repackage pset
-	b64psetNew, err := packagePrescriptionSet(pset)
+	// Confirm that user has access to this prescription in particular
+	err = checkClientAccess(ctx, pid)
 	if err != nil {
 		return err
 	}
-	// update private data
-	err = ctx.GetStub().PutPrivateData(collectionPrescription, pid, []byte(b64psetNew))
-	if err != nil {
-		return fmt.Errorf("failed to add prescription to private data: %v", err)
+	// Iterate over the report set and store each prescription inside under its reader's key.
+	// Only registered report readers are accepted, so no other user's copy can be overwritten
+	for key, value := range *reportset {
+		isReader, err := isReportReader(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !isReader {
+			return fmt.Errorf("report set contains a user who is not a registered report reader")
+		}
+		err = putPrescriptionEntry(ctx, pid, key, value)
+		if err != nil {
+			return err
+		}
+		err = putReportIndex(ctx, key, pid)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -104,7 +158,10 @@ func (s *SmartContract) GetPrescriptionReport(ctx contractapi.TransactionContext
 		return "", err
 	}
 	// Get current user
-	currentUser := clientObscuredName(ctx)
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return "", err
+	}
 	// Check if current user is in report readers
 	exists, err := ctx.GetStub().GetPrivateData(collectionReportReaders, currentUser)
 	if err != nil {
@@ -113,28 +170,18 @@ func (s *SmartContract) GetPrescriptionReport(ctx contractapi.TransactionContext
 	if exists == nil {
 		return "", fmt.Errorf("given user is not a report reader")
 	}
-	// Create Iterator
-	resultsIterator, err := ctx.GetStub().GetPrivateDataByRange(collectionPrescription, "", "")
+	// Create set of reports (all prescriptions, encrypted for given user)
+	pids, err := recipientPrescriptions(ctx, currentUser)
 	if err != nil {
 		return "", err
 	}
-	defer resultsIterator.Close()
-
-	// Create set of reports (all prescriptions, encrypted for given user)
 	reportset := make(map[string]string)
-	for resultsIterator.HasNext() {
-		// get each prescription set
-		b64pset, err := resultsIterator.Next()
+	for _, pid := range pids {
+		entry, err := getPrescriptionEntry(ctx, pid, currentUser)
 		if err != nil {
 			return "", err
 		}
-		// unpackage the prescription set
-		pset, err := unpackagePrescriptionSet(string(b64pset.Value))
-		if err != nil {
-			return "", err
-		}
-		// get the prescription with the given username
-		reportset[string(b64pset.Key)] = (*pset)[currentUser]
+		reportset[pid] = string(entry)
 	}
 	// package the reportset
 	b64reports, err := packagePrescriptionSet(&reportset)
@@ -143,3 +190,49 @@ func (s *SmartContract) GetPrescriptionReport(ctx contractapi.TransactionContext
 	}
 	return b64reports, nil
 }
+
+func putReportIndex(ctx contractapi.TransactionContextInterface, reader string, pid string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(reportIndex, []string{reader, pid})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutPrivateData(collectionPrescription, key, []byte{0x00})
+	if err != nil {
+		return fmt.Errorf("failed to index report: %v", err)
+	}
+	return nil
+}
+
+func delReportIndex(ctx contractapi.TransactionContextInterface, reader string, pid string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(reportIndex, []string{reader, pid})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().DelPrivateData(collectionPrescription, key)
+	if err != nil {
+		return fmt.Errorf("error in deleting report index: %v", err)
+	}
+	return nil
+}
+
+// returns the pids of every prescription the reader has a report copy of
+func reportPrescriptions(ctx contractapi.TransactionContextInterface, reader string) ([]string, error) {
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collectionPrescription, reportIndex, []string{reader})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	pids := []string{}
+	for resultsIterator.HasNext() {
+		entry, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		pids = append(pids, parts[1])
+	}
+	return pids, nil
+}
@@ -0,0 +1,103 @@
+package src
+
+import (
+	"testing"
+)
+
+// registers the reader as a report reader, and has the doctor send them a report of testPid
+func reportTestPrescription(t *testing.T, stub *mockStub, reader string) {
+	t.Helper()
+	stub.registerUser(reader)
+	stub.newTx(nil)
+	err := new(SmartContract).RegisterMeAsReportReader(stub.as(reader, USER_READER))
+	if err != nil {
+		t.Fatalf("RegisterMeAsReportReader: %v", err)
+	}
+	stub.newTx(map[string]string{transientReports: testPset(t, map[string]string{testObscuredName(reader): "report of " + reader})})
+	err = new(SmartContract).UpdateReport(stub.as("doctor", USER_DOCTOR), testPid)
+	if err != nil {
+		t.Fatalf("UpdateReport: %v", err)
+	}
+}
+
+func TestUpdateReport(t *testing.T) {
+	stub := newMockStub()
+	issueTestPrescription(t, stub, map[string]string{transientQuantity: "10"})
+	reportTestPrescription(t, stub, "reader")
+	contract := new(SmartContract)
+
+	stub.newTx(nil)
+	b64reports, err := contract.GetPrescriptionReport(stub.as("reader", USER_READER))
+	if err != nil {
+		t.Fatalf("GetPrescriptionReport: %v", err)
+	}
+	reports, err := unpackagePrescriptionSet(b64reports)
+	if err != nil {
+		t.Fatalf("unpackagePrescriptionSet: %v", err)
+	}
+	if len(*reports) != 1 || (*reports)[testPid] != "report of reader" {
+		t.Fatalf("GetPrescriptionReport = %v, want the report of %v", *reports, testPid)
+	}
+
+	// only registered report readers may be sent reports, so no other copy can be overwritten
+	for _, user := range []string{"patient", "stranger"} {
+		stub.newTx(map[string]string{transientReports: testPset(t, map[string]string{testObscuredName(user): "report of " + user})})
+		if err := contract.UpdateReport(stub.as("doctor", USER_DOCTOR), testPid); err == nil {
+			t.Fatalf("UpdateReport for %v, who is not a report reader, succeeded", user)
+		}
+	}
+	entry, err := getPrescriptionEntry(stub.as("doctor", USER_DOCTOR), testPid, testObscuredName("patient"))
+	if err != nil || string(entry) != "copy of patient" {
+		t.Fatalf("patient's copy is %q, %v after a rejected report", entry, err)
+	}
+	// the doctor must have access to the prescription
+	stub.registerUser("other")
+	stub.newTx(map[string]string{transientReports: testPset(t, map[string]string{testObscuredName("reader"): "report of reader"})})
+	if err := contract.UpdateReport(stub.as("other", USER_DOCTOR), testPid); err == nil {
+		t.Fatalf("UpdateReport by a doctor without access succeeded")
+	}
+}
+
+func TestUnregisterMeAsReportReader(t *testing.T) {
+	stub := newMockStub()
+	issueTestPrescription(t, stub, map[string]string{transientQuantity: "10"})
+	reportTestPrescription(t, stub, "reader")
+	// the reader also has a copy of another prescription shared to them, which is not a report
+	const sharedPid = "0123-4568-K"
+	putPrescriptionEntry(stub.as("patient", USER_PATIENT), sharedPid, testObscuredName("reader"), "copy of reader")
+	contract := new(SmartContract)
+
+	stub.newTx(nil)
+	if err := contract.UnregisterMeAsReportReader(stub.as("reader", USER_PATIENT)); err == nil {
+		t.Fatalf("UnregisterMeAsReportReader without the READER role succeeded")
+	}
+	stub.registerUser("unregistered")
+	putPrescriptionEntry(stub.as("patient", USER_PATIENT), sharedPid, testObscuredName("unregistered"), "copy of unregistered")
+	stub.newTx(nil)
+	if err := contract.UnregisterMeAsReportReader(stub.as("unregistered", USER_READER)); err == nil {
+		t.Fatalf("UnregisterMeAsReportReader by a reader who is not registered succeeded")
+	}
+	if pids, _ := recipientPrescriptions(stub.as("unregistered", USER_READER), testObscuredName("unregistered")); len(pids) != 1 {
+		t.Fatalf("rejected UnregisterMeAsReportReader deleted copies, leaving %v", pids)
+	}
+
+	stub.newTx(nil)
+	if err := contract.UnregisterMeAsReportReader(stub.as("reader", USER_READER)); err != nil {
+		t.Fatalf("UnregisterMeAsReportReader: %v", err)
+	}
+	isReader, err := isReportReader(stub.as("reader", USER_READER), testObscuredName("reader"))
+	if err != nil || isReader {
+		t.Fatalf("reader is still registered after unregistering: %v", err)
+	}
+	pids, err := recipientPrescriptions(stub.as("reader", USER_READER), testObscuredName("reader"))
+	if err != nil {
+		t.Fatalf("recipientPrescriptions: %v", err)
+	}
+	if len(pids) != 1 || pids[0] != sharedPid {
+		t.Fatalf("after unregistering, reader has copies of %v, want only %v", pids, sharedPid)
+	}
+	reports, err := reportPrescriptions(stub.as("reader", USER_READER), testObscuredName("reader"))
+	if err != nil || len(reports) != 0 {
+		t.Fatalf("after unregistering, reader still has reports of %v, %v", reports, err)
+	}
+}
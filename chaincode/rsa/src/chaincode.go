@@ -1,13 +1,11 @@
 package src
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
 	"fmt"
-	"math/rand"
-	"regexp"
-	"time"
+	"strings"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
@@ -16,6 +14,7 @@ const (
 	collectionPrescription  = "collectionPrescription"
 	collectionPubkeyRSA     = "collectionPubkeyRSA"
 	collectionReportReaders = "collectionReportReaders"
+	collectionPseudonymKey  = "collectionPseudonymKey"
 )
 
 // String Constants for User Roles
@@ -26,19 +25,134 @@ const (
 	USER_READER     = "READER"
 )
 
+// String Constants for Prescription Status
+const (
+	STATUS_DRAFT            = "DRAFT"
+	STATUS_ISSUED           = "ISSUED"
+	STATUS_PARTIALLY_FILLED = "PARTIALLY_FILLED"
+	STATUS_FILLED           = "FILLED"
+	STATUS_CANCELLED        = "CANCELLED"
+	STATUS_EXPIRED          = "EXPIRED"
+)
+
+// Value of the hf.Type attribute for Fabric CA admins
+const ADMIN_TYPE = "admin"
+
+// Transient map fields. Prescription data and pubkeys are sent through
+// the transient map so that they are never written into blocks.
+const (
+	transientPrescription = "prescription"
+	transientPset         = "pset"
+	transientReports      = "reports"
+	transientPubkey       = "pubkey"
+	transientPseudonymKey = "pseudonymkey"
+	transientQuantity     = "quantity"
+	transientValidFrom    = "validfrom"
+	transientValidUntil   = "validuntil"
+	transientIdentity     = "identity"
+)
+
 type SmartContract struct {
 	contractapi.Contract
 }
 
-func obscureName(username string) string {
-	raw := sha256.Sum256([]byte(username))
+// ============================================================ //
+// PSEUDONYMS
+// Users are known to the chaincode only by pseudonym. Once a
+// channel secret is stored in collectionPseudonymKey, the
+// pseudonym is a versioned HMAC of the identity name. Before
+// that, it is the legacy bare SHA-256 hex of the name.
+// Must match the application.
+// ============================================================ //
+const (
+	pseudonymKeyName = "pseudonymkey"
+	pseudonymPrefix  = "p1."
+)
+
+func obscureName(ctx contractapi.TransactionContextInterface, name string) (string, error) {
+	secret, err := ctx.GetStub().GetPrivateData(collectionPseudonymKey, pseudonymKeyName)
+	if err != nil {
+		return "", fmt.Errorf("failed to read pseudonym key: %v", err)
+	}
+	if secret == nil {
+		return legacyObscureName(name), nil
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(name))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func legacyObscureName(name string) string {
+	raw := sha256.Sum256([]byte(name))
 	return hex.EncodeToString(raw[:])
 }
 
-func genPrescriptionId() string {
-	rand.Seed(time.Now().UnixNano())
-	pid := rand.Uint64()
-	return fmt.Sprintf("%v", pid)
+func getTransient(ctx contractapi.TransactionContextInterface, field string) (string, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return "", fmt.Errorf("failed to read transient map: %v", err)
+	}
+	value, exists := transientMap[field]
+	if !exists || len(value) == 0 {
+		return "", fmt.Errorf("'%v' must be given in the transient map", field)
+	}
+	return string(value), nil
+}
+
+// ============================================================ //
+// PRESCRIPTION ID
+// Derived from the transaction ID so that every endorser
+// generates the same pid. Format is XXXX-XXXX-C, using the
+// Crockford base32 alphabet, where C is a Luhn mod 32 check
+// character so that mistyped pids can be caught.
+// ============================================================ //
+const (
+	pidAlphabet    = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	pidLength      = 8
+	maxPidAttempts = 8
+)
+
+func genPrescriptionId(txID string, nonce string, attempt int) string {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%v:%v:%v", txID, nonce, attempt)))
+	body := make([]byte, pidLength)
+	for i := range body {
+		body[i] = pidAlphabet[digest[i]%byte(len(pidAlphabet))]
+	}
+	return fmt.Sprintf("%s-%s-%c", body[:pidLength/2], body[pidLength/2:], pidCheckChar(body))
+}
+
+// checks that a pid chosen by the client is in canonical form, with a valid check character
+func checkPrescriptionIdFormat(pid string) error {
+	if len(pid) != pidLength+3 || pid[pidLength/2] != '-' || pid[pidLength+1] != '-' {
+		return fmt.Errorf("prescription id '%v' is not of the form XXXX-XXXX-C", pid)
+	}
+	body := []byte(pid[:pidLength/2] + pid[pidLength/2+1:pidLength+1])
+	for _, c := range body {
+		if strings.IndexByte(pidAlphabet, c) < 0 {
+			return fmt.Errorf("prescription id '%v' has invalid character '%c'", pid, c)
+		}
+	}
+	if pidCheckChar(body) != pid[pidLength+2] {
+		return fmt.Errorf("prescription id '%v' has an invalid check character", pid)
+	}
+	return nil
+}
+
+// Luhn mod N check character over the pid alphabet
+func pidCheckChar(body []byte) byte {
+	n := len(pidAlphabet)
+	factor := 2
+	sum := 0
+	for i := len(body) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(pidAlphabet, body[i])
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+		sum += addend/n + addend%n
+	}
+	return pidAlphabet[(n-sum%n)%n]
 }
 
 func checkIfUserPubkeyExists(ctx contractapi.TransactionContextInterface, obscuredName string) error {
@@ -53,8 +167,194 @@ func checkIfUserPubkeyExists(ctx contractapi.TransactionContextInterface, obscur
 	return nil
 }
 
+// ============================================================ //
+// PRESCRIPTION ENTRIES
+// Each recipient's copy of a prescription is stored under its
+// own composite key pid~recipient, so that transactions only
+// read and write the copies they need. Every entry also has an
+// empty recipient~pid index key, so that the prescriptions of a
+// recipient can be found without scanning every entry.
+// ============================================================ //
+const (
+	psetIndex      = "pid~recipient"
+	recipientIndex = "recipient~pid"
+)
+
+func getPrescriptionEntry(ctx contractapi.TransactionContextInterface, pid string, recipient string) ([]byte, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(psetIndex, []string{pid, recipient})
+	if err != nil {
+		return nil, err
+	}
+	entry, err := ctx.GetStub().GetPrivateData(collectionPrescription, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prescription: %v", err)
+	}
+	return entry, nil
+}
+
+func putPrescriptionEntry(ctx contractapi.TransactionContextInterface, pid string, recipient string, b64prescription string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(psetIndex, []string{pid, recipient})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutPrivateData(collectionPrescription, key, []byte(b64prescription))
+	if err != nil {
+		return fmt.Errorf("failed to add prescription to private data: %v", err)
+	}
+	indexKey, err := ctx.GetStub().CreateCompositeKey(recipientIndex, []string{recipient, pid})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutPrivateData(collectionPrescription, indexKey, []byte{0x00})
+	if err != nil {
+		return fmt.Errorf("failed to index prescription: %v", err)
+	}
+	return nil
+}
+
+func delPrescriptionEntry(ctx contractapi.TransactionContextInterface, pid string, recipient string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(psetIndex, []string{pid, recipient})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().DelPrivateData(collectionPrescription, key)
+	if err != nil {
+		return fmt.Errorf("error in deleting prescription data: %v", err)
+	}
+	indexKey, err := ctx.GetStub().CreateCompositeKey(recipientIndex, []string{recipient, pid})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().DelPrivateData(collectionPrescription, indexKey)
+	if err != nil {
+		return fmt.Errorf("error in deleting prescription index: %v", err)
+	}
+	return nil
+}
+
+// returns the obscured names of all users with a copy of the prescription
+func prescriptionRecipients(ctx contractapi.TransactionContextInterface, pid string) ([]string, error) {
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collectionPrescription, psetIndex, []string{pid})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	var recipients []string
+	for resultsIterator.HasNext() {
+		entry, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, parts[1])
+	}
+	return recipients, nil
+}
+
+// returns the pids of every prescription the recipient has a copy of
+func recipientPrescriptions(ctx contractapi.TransactionContextInterface, recipient string) ([]string, error) {
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(collectionPrescription, recipientIndex, []string{recipient})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	pids := []string{}
+	for resultsIterator.HasNext() {
+		entry, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		pids = append(pids, parts[1])
+	}
+	return pids, nil
+}
+
+// ============================================================ //
+// PRESCRIPTION INFO
+// Plaintext-free information kept beside each pid, such as
+// which recipients are the owning patient and the prescriber,
+// the status of the prescription, its prescribed and dispensed
+// quantities, and the window in which it is valid.
+// ============================================================ //
+const (
+	infoIndex      = "info~pid"
+	infoOwner      = "owner"
+	infoPrescriber = "prescriber"
+	infoStatus     = "status"
+	infoTotal      = "total"
+	infoDispensed  = "dispensed"
+	infoValidFrom  = "validfrom"
+	infoValidUntil = "validuntil"
+)
+
+// returns an empty map if the prescription has no info, as with migrated prescriptions
+func getPrescriptionInfo(ctx contractapi.TransactionContextInterface, pid string) (map[string]string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(infoIndex, []string{pid})
+	if err != nil {
+		return nil, err
+	}
+	data, err := ctx.GetStub().GetPrivateData(collectionPrescription, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prescription info: %v", err)
+	}
+	if data == nil {
+		return make(map[string]string), nil
+	}
+	return decodeCanonicalMap(data)
+}
+
+func putPrescriptionInfo(ctx contractapi.TransactionContextInterface, pid string, info map[string]string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(infoIndex, []string{pid})
+	if err != nil {
+		return err
+	}
+	encoded, err := encodeCanonicalMap(info)
+	if err != nil {
+		return fmt.Errorf("failed to encode prescription info: %v", err)
+	}
+	err = ctx.GetStub().PutPrivateData(collectionPrescription, key, encoded)
+	if err != nil {
+		return fmt.Errorf("failed to store prescription info: %v", err)
+	}
+	return nil
+}
+
+// ============================================================ //
+// Check Access
+// checks if the given user has a copy of the prescription,
+// which is what grants them access to it
+// ============================================================ //
+func checkAccess(ctx contractapi.TransactionContextInterface, pid string, obscureName string) error {
+	entry, err := getPrescriptionEntry(ctx, pid, obscureName)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("client does not have access to prescription %v, or it does not exist", pid)
+	}
+	return nil
+}
+
+// checks if the current client has access to the prescription
+func checkClientAccess(ctx contractapi.TransactionContextInterface, pid string) error {
+	currentUser, err := clientObscuredName(ctx)
+	if err != nil {
+		return err
+	}
+	return checkAccess(ctx, pid, currentUser)
+}
+
 // ============================================================ //
 // Unpackage & Check Access
+// Only used for legacy prescription sets, where every copy
+// was stored in one value under the pid.
 // unpackages a set of prescriptions, checks if current user
 // has access to any of the prescriptions inside of it
 // ============================================================ //
@@ -72,22 +372,41 @@ func unpackageAndCheckAccess(ctx contractapi.TransactionContextInterface, b64pse
 
 // ============================================================ //
 // CLIENT IDENTITY
-// From certificate, get identity, obscured name, and check
-// if user if allowed to access chaincode
+// A user is identified by their MSP ID and enrollment ID, so
+// that users with the same name in different orgs are kept
+// apart. Must match identityName in the application.
 // ============================================================ //
-func clientObscuredName(ctx contractapi.TransactionContextInterface) string {
-	b64ID, err := ctx.GetClientIdentity().GetID()
+func identityName(mspID string, enrollmentID string) string {
+	return mspID + "/" + enrollmentID
+}
+
+func clientIdentityName(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
 	if err != nil {
-		panic(fmt.Errorf("failed to read clientID: %v", err))
+		return "", fmt.Errorf("failed to read client MSP ID: %v", err)
 	}
-	identity, err := base64.StdEncoding.DecodeString(b64ID)
+	enrollmentID, found, err := ctx.GetClientIdentity().GetAttributeValue("hf.EnrollmentID")
 	if err != nil {
-		panic(fmt.Errorf("failed to base64 decode clientID: %v", err))
+		return "", fmt.Errorf("failed to read client enrollment ID: %v", err)
+	}
+	if !found {
+		// certs not issued by Fabric CA have no attributes, so the full subject CN is used
+		cert, err := ctx.GetClientIdentity().GetX509Certificate()
+		if err != nil {
+			return "", fmt.Errorf("failed to read client certificate: %v", err)
+		}
+		enrollmentID = cert.Subject.CommonName
 	}
-	cnregex, err := regexp.Compile(`CN=(\w*),`)
+	if enrollmentID == "" {
+		return "", fmt.Errorf("client certificate has no enrollment ID or common name")
+	}
+	return identityName(mspID, enrollmentID), nil
+}
+
+func clientObscuredName(ctx contractapi.TransactionContextInterface) (string, error) {
+	name, err := clientIdentityName(ctx)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	username := cnregex.FindStringSubmatch(string(identity))[1]
-	return obscureName(username)
+	return obscureName(ctx, name)
 }
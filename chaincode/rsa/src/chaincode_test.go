@@ -0,0 +1,95 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// returns every pid one mistype away from pid: each character of the body or check
+// character replaced by another, and each adjacent pair swapped. Luhn mod 32 cannot
+// catch a swap of '0' and 'Z', as doubling either gives the same digit sum, so those
+// are left out.
+func pidTypos(pid string) []string {
+	typed := []byte(strings.ReplaceAll(pid, "-", ""))
+	format := func(chars []byte) string {
+		return fmt.Sprintf("%s-%s-%s", chars[:pidLength/2], chars[pidLength/2:pidLength], chars[pidLength:])
+	}
+	var typos []string
+	for i := range typed {
+		for j := 0; j < len(pidAlphabet); j++ {
+			if pidAlphabet[j] != typed[i] {
+				typo := []byte(string(typed))
+				typo[i] = pidAlphabet[j]
+				typos = append(typos, format(typo))
+			}
+		}
+	}
+	for i := 0; i+1 < len(typed); i++ {
+		a, b := typed[i], typed[i+1]
+		if a == b || (a == '0' && b == 'Z') || (a == 'Z' && b == '0') {
+			continue
+		}
+		typo := []byte(string(typed))
+		typo[i], typo[i+1] = b, a
+		typos = append(typos, format(typo))
+	}
+	return typos
+}
+
+func TestGenPrescriptionId(t *testing.T) {
+	seen := make(map[string]bool)
+	for attempt := 0; attempt < maxPidAttempts; attempt++ {
+		pid := genPrescriptionId("txid", "nonce", attempt)
+		if err := checkPrescriptionIdFormat(pid); err != nil {
+			t.Fatalf("genPrescriptionId = %v: %v", pid, err)
+		}
+		if again := genPrescriptionId("txid", "nonce", attempt); again != pid {
+			t.Fatalf("genPrescriptionId is not deterministic: %v then %v", pid, again)
+		}
+		if seen[pid] {
+			t.Fatalf("genPrescriptionId repeated %v for attempt %v", pid, attempt)
+		}
+		seen[pid] = true
+	}
+}
+
+func TestCheckPrescriptionIdRejectsTypos(t *testing.T) {
+	pids := []string{"0000-0000-0", "ZZZZ-ZZZZ-" + string(pidCheckChar([]byte("ZZZZZZZZ")))}
+	for i := 0; i < 50; i++ {
+		pids = append(pids, genPrescriptionId(fmt.Sprint(i), "", 0))
+	}
+	for _, pid := range pids {
+		if err := checkPrescriptionIdFormat(pid); err != nil {
+			t.Fatalf("checkPrescriptionIdFormat(%v): %v", pid, err)
+		}
+		for _, typo := range pidTypos(pid) {
+			if checkPrescriptionIdFormat(typo) == nil {
+				t.Fatalf("checkPrescriptionIdFormat accepted %v, a mistype of %v", typo, pid)
+			}
+		}
+	}
+}
+
+func TestCheckPrescriptionIdFormat(t *testing.T) {
+	// the same pid is checked in the application tests, so that both sides agree
+	if err := checkPrescriptionIdFormat("0123-4567-M"); err != nil {
+		t.Fatalf("checkPrescriptionIdFormat(0123-4567-M): %v", err)
+	}
+	pid := genPrescriptionId("txid", "", 0)
+	invalid := []string{
+		"",
+		strings.ReplaceAll(pid, "-", ""),
+		strings.ToLower(pid),
+		pid[:pidLength/2] + "_" + pid[pidLength/2+1:],
+		"0U00-0000-0",
+		"0123-4567-R",
+		pid + "0",
+		"12345678901",
+	}
+	for _, pid := range invalid {
+		if checkPrescriptionIdFormat(pid) == nil {
+			t.Fatalf("checkPrescriptionIdFormat accepted %q", pid)
+		}
+	}
+}
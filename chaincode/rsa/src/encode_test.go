@@ -0,0 +1,164 @@
+package src
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+// Golden encodings of the wire format. Must be kept identical to the
+// tests in application/rsa/src/encode_test.go, so that the chaincode
+// and the application are checked against the same bytes.
+
+var canonicalMapTests = []struct {
+	m    map[string]string
+	want string
+}{
+	{map[string]string{}, "CNE\x02M{}"},
+	{map[string]string{"b": "2", "a": "1"}, "CNE\x02M" + `{"a":"1","b":"2"}`},
+	{map[string]string{"é": "<&>", "A": "\"quoted\"\n"}, "CNE\x02M" + `{"A":"\"quoted\"\n","é":"<&>"}`},
+}
+
+var canonicalSliceTests = []struct {
+	strs []string
+	want string
+}{
+	{[]string{}, "CNE\x02S[]"},
+	{nil, "CNE\x02S[]"},
+	{[]string{"c", "a", "b"}, "CNE\x02S" + `["a","b","c"]`},
+	{[]string{"é", "<&>", "A"}, "CNE\x02S" + `["<&>","A","é"]`},
+}
+
+func TestEncodeCanonicalMap(t *testing.T) {
+	for _, tt := range canonicalMapTests {
+		got, err := encodeCanonicalMap(tt.m)
+		if err != nil {
+			t.Fatalf("encodeCanonicalMap(%v): %v", tt.m, err)
+		}
+		if string(got) != tt.want {
+			t.Fatalf("encodeCanonicalMap(%v) = %q, want %q", tt.m, got, tt.want)
+		}
+		packaged, err := packagePrescriptionSet(&tt.m)
+		if err != nil {
+			t.Fatalf("packagePrescriptionSet(%v): %v", tt.m, err)
+		}
+		if packaged != base64.StdEncoding.EncodeToString([]byte(tt.want)) {
+			t.Fatalf("packagePrescriptionSet(%v) = %v, not the base64 of %q", tt.m, packaged, tt.want)
+		}
+		unpackaged, err := unpackagePrescriptionSet(packaged)
+		if err != nil {
+			t.Fatalf("unpackagePrescriptionSet(%v): %v", packaged, err)
+		}
+		if !reflect.DeepEqual(*unpackaged, tt.m) {
+			t.Fatalf("unpackagePrescriptionSet = %v, want %v", *unpackaged, tt.m)
+		}
+	}
+}
+
+func TestEncodeCanonicalSlice(t *testing.T) {
+	for _, tt := range canonicalSliceTests {
+		got, err := encodeCanonicalSlice(tt.strs)
+		if err != nil {
+			t.Fatalf("encodeCanonicalSlice(%v): %v", tt.strs, err)
+		}
+		if string(got) != tt.want {
+			t.Fatalf("encodeCanonicalSlice(%v) = %q, want %q", tt.strs, got, tt.want)
+		}
+		packaged, err := packageStringSlice(&tt.strs)
+		if err != nil {
+			t.Fatalf("packageStringSlice(%v): %v", tt.strs, err)
+		}
+		if packaged != base64.StdEncoding.EncodeToString([]byte(tt.want)) {
+			t.Fatalf("packageStringSlice(%v) = %v, not the base64 of %q", tt.strs, packaged, tt.want)
+		}
+		unpackaged, err := unpackageStringSlice(packaged)
+		if err != nil {
+			t.Fatalf("unpackageStringSlice(%v): %v", packaged, err)
+		}
+		// lists are sorted, so the unpackaged list encodes the same
+		again, err := encodeCanonicalSlice(*unpackaged)
+		if err != nil || string(again) != tt.want {
+			t.Fatalf("unpackageStringSlice = %v, want the elements of %v", *unpackaged, tt.strs)
+		}
+	}
+}
+
+func TestEncodeCanonicalRejectsInvalidUTF8(t *testing.T) {
+	if _, err := encodeCanonicalMap(map[string]string{"a": "\xff"}); err == nil {
+		t.Fatalf("encodeCanonicalMap accepted an invalid UTF-8 value")
+	}
+	if _, err := encodeCanonicalMap(map[string]string{"\xff": "a"}); err == nil {
+		t.Fatalf("encodeCanonicalMap accepted an invalid UTF-8 key")
+	}
+	if _, err := encodeCanonicalSlice([]string{"a", "\xff"}); err == nil {
+		t.Fatalf("encodeCanonicalSlice accepted an invalid UTF-8 string")
+	}
+}
+
+func TestDecodeCanonicalV1(t *testing.T) {
+	m, err := decodeCanonicalMap([]byte("CNE\x01M\x02\x01a\x011\x01b\x03two"))
+	if err != nil {
+		t.Fatalf("decodeCanonicalMap: %v", err)
+	}
+	if want := map[string]string{"a": "1", "b": "two"}; !reflect.DeepEqual(m, want) {
+		t.Fatalf("decodeCanonicalMap = %v, want %v", m, want)
+	}
+	strs, err := decodeCanonicalSlice([]byte("CNE\x01S\x02\x01b\x00"))
+	if err != nil {
+		t.Fatalf("decodeCanonicalSlice: %v", err)
+	}
+	if want := []string{"b", ""}; !reflect.DeepEqual(strs, want) {
+		t.Fatalf("decodeCanonicalSlice = %q, want %q", strs, want)
+	}
+}
+
+func TestDecodeCanonicalInvalid(t *testing.T) {
+	invalid := []string{
+		"CNE",
+		"CNE\x03M{}",
+		"CNE\x02S{}",
+		"CNE\x02Mnull",
+		"CNE\x01M\x01\x05a",
+		"CNE\x01M\x01\x01a\x09b",
+	}
+	for _, data := range invalid {
+		if m, err := decodeCanonicalMap([]byte(data)); err == nil {
+			t.Fatalf("decodeCanonicalMap(%q) = %v, want an error", data, m)
+		}
+	}
+	if strs, err := decodeCanonicalSlice([]byte("CNE\x01S\xff\x01")); err == nil {
+		t.Fatalf("decodeCanonicalSlice of an oversized count = %v, want an error", strs)
+	}
+}
+
+func gobPackage(t *testing.T, v interface{}) string {
+	t.Helper()
+	buf := bytes.Buffer{}
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		t.Fatalf("gob encoding %v: %v", v, err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestUnpackageLegacyGob(t *testing.T) {
+	pset := map[string]string{"user1": "ciphertext1", "user2": "ciphertext2"}
+	unpackagedSet, err := unpackagePrescriptionSet(gobPackage(t, pset))
+	if err != nil {
+		t.Fatalf("unpackagePrescriptionSet: %v", err)
+	}
+	if !reflect.DeepEqual(*unpackagedSet, pset) {
+		t.Fatalf("unpackagePrescriptionSet = %v, want %v", *unpackagedSet, pset)
+	}
+
+	strs := []string{"b", "a"}
+	unpackagedStrs, err := unpackageStringSlice(gobPackage(t, strs))
+	if err != nil {
+		t.Fatalf("unpackageStringSlice: %v", err)
+	}
+	if !reflect.DeepEqual(*unpackagedStrs, strs) {
+		t.Fatalf("unpackageStringSlice = %v, want %v", *unpackagedStrs, strs)
+	}
+}
@@ -0,0 +1,167 @@
+package src
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const testMSP = "Org1MSP"
+
+// the time every test transaction is stamped with, unless a test sets another
+var testTxTime = time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+
+// a shimtest.MockStub with the private data deletes and queries it leaves unimplemented.
+// Unlike on a peer, writes can be read back within the same transaction
+type mockStub struct {
+	*shimtest.MockStub
+	txCount int
+}
+
+func newMockStub() *mockStub {
+	stub := &mockStub{MockStub: shimtest.NewMockStub("rsa", nil)}
+	stub.TxTimestamp = timestamppb.New(testTxTime)
+	return stub
+}
+
+func (stub *mockStub) DelPrivateData(collection string, key string) error {
+	delete(stub.PvtState[collection], key)
+	return nil
+}
+
+func (stub *mockStub) PurgePrivateData(collection string, key string) error {
+	return stub.DelPrivateData(collection, key)
+}
+
+func (stub *mockStub) GetPrivateDataByRange(collection string, startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return stub.privateDataIterator(collection, func(key string) bool {
+		return (startKey == "" || key >= startKey) && (endKey == "" || key < endKey)
+	}), nil
+}
+
+func (stub *mockStub) GetPrivateDataByPartialCompositeKey(collection string, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return stub.privateDataIterator(collection, func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}), nil
+}
+
+// returns the matching entries of the collection in key order, as they are when called
+func (stub *mockStub) privateDataIterator(collection string, match func(key string) bool) *mockIterator {
+	var keys []string
+	for key := range stub.PvtState[collection] {
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	iterator := &mockIterator{}
+	for _, key := range keys {
+		iterator.entries = append(iterator.entries, &queryresult.KV{Key: key, Value: stub.PvtState[collection][key]})
+	}
+	return iterator
+}
+
+// starts a new transaction, with its own txid and the given transient map
+func (stub *mockStub) newTx(transient map[string]string) {
+	stub.txCount++
+	stub.TxID = fmt.Sprintf("tx%d", stub.txCount)
+	stub.TransientMap = make(map[string][]byte)
+	for field, value := range transient {
+		stub.TransientMap[field] = []byte(value)
+	}
+}
+
+// returns a transaction context of the given user of testMSP, which has the given role
+func (stub *mockStub) as(user string, role string) contractapi.TransactionContextInterface {
+	ctx := new(contractapi.TransactionContext)
+	ctx.SetStub(stub)
+	ctx.SetClientIdentity(&mockIdentity{
+		mspID: testMSP,
+		attrs: map[string]string{"hf.EnrollmentID": user, "hf.Type": "client", "role": role},
+	})
+	return ctx
+}
+
+// stores a pubkey record for the user, so that they count as registered
+func (stub *mockStub) registerUser(user string) {
+	stub.PutPrivateData(collectionPubkeyRSA, testObscuredName(user), []byte("pubkey of "+user))
+}
+
+// returns the pseudonym of the given user of testMSP, with no pseudonym key set
+func testObscuredName(user string) string {
+	return legacyObscureName(identityName(testMSP, user))
+}
+
+type mockIterator struct {
+	entries []*queryresult.KV
+}
+
+func (it *mockIterator) HasNext() bool {
+	return len(it.entries) > 0
+}
+
+func (it *mockIterator) Next() (*queryresult.KV, error) {
+	if len(it.entries) == 0 {
+		return nil, fmt.Errorf("iterator has no more entries")
+	}
+	entry := it.entries[0]
+	it.entries = it.entries[1:]
+	return entry, nil
+}
+
+func (it *mockIterator) Close() error {
+	return nil
+}
+
+// a client identity issued by Fabric CA, with the given attributes
+type mockIdentity struct {
+	mspID string
+	attrs map[string]string
+}
+
+func (id *mockIdentity) GetID() (string, error) {
+	return "x509::CN=" + id.attrs["hf.EnrollmentID"], nil
+}
+
+func (id *mockIdentity) GetMSPID() (string, error) {
+	return id.mspID, nil
+}
+
+func (id *mockIdentity) GetAttributeValue(attrName string) (string, bool, error) {
+	value, found := id.attrs[attrName]
+	return value, found, nil
+}
+
+func (id *mockIdentity) AssertAttributeValue(attrName string, attrValue string) error {
+	if id.attrs[attrName] != attrValue {
+		return fmt.Errorf("attribute '%v' equals '%v', not '%v'", attrName, id.attrs[attrName], attrValue)
+	}
+	return nil
+}
+
+func (id *mockIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, fmt.Errorf("mock identity has no certificate")
+}
+
+// packages a prescription set, failing the test on error
+func testPset(t *testing.T, pset map[string]string) string {
+	t.Helper()
+	packaged, err := packagePrescriptionSet(&pset)
+	if err != nil {
+		t.Fatalf("packagePrescriptionSet: %v", err)
+	}
+	return packaged
+}